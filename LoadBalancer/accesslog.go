@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// access is one finished tcp connection or http request, written to the
+// access log and counted in the metrics.
+type access struct {
+	start    time.Time
+	mode     string // tcp, http or websocket
+	id       string
+	client   string
+	route    string // http only
+	pool     string
+	backend  string // empty when no backend was reached
+	method   string
+	path     string
+	status   int // http only
+	bytesIn  int64
+	bytesOut int64
+	err      error
+}
+
+// newAccessLog writes access entries as JSON ("json", the default) or
+// logfmt ("text") lines to path, with "" or "stdout" meaning stdout.
+func newAccessLog(path, format string) (*slog.Logger, error) {
+	var w io.Writer = os.Stdout
+	if path != "" && path != "stdout" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	switch format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+// logAccess records a finished connection or request.
+func (lb *LB) logAccess(a *access) {
+	duration := time.Since(a.start)
+	if lb.Metrics != nil {
+		lb.Metrics.observe(a, duration)
+	}
+	if lb.AccessLog == nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("mode", a.mode),
+		slog.String("id", a.id),
+		slog.String("client", a.client),
+	}
+	if a.route != "" {
+		attrs = append(attrs, slog.String("route", a.route))
+	}
+	attrs = append(attrs, slog.String("pool", a.pool), slog.String("backend", a.backend))
+	if a.method != "" {
+		attrs = append(attrs, slog.String("method", a.method), slog.String("path", a.path), slog.Int("status", a.status))
+	}
+	attrs = append(attrs,
+		slog.Int64("bytesIn", a.bytesIn),
+		slog.Int64("bytesOut", a.bytesOut),
+		slog.Float64("durationMs", millis(duration)),
+	)
+	level := slog.LevelInfo
+	if a.err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", a.err.Error()))
+	}
+	lb.AccessLog.LogAttrs(context.Background(), level, "access", attrs...)
+}
+
+// accessWriter remembers the status and size of an http response.
+type accessWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (aw *accessWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.NewResponseController reach Flush and Hijack.
+func (aw *accessWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
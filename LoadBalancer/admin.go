@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// admin API, served on its own listener so it is never reachable through
+// the balanced port:
+//
+//	GET    /stats                                   per pool and backend counters
+//	GET    /metrics                                 the same and more for Prometheus
+//	POST   /pools/{pool}/backends                   {"host","port","weight","maxConns"}
+//	DELETE /pools/{pool}/backends/{addr}
+//	PUT    /pools/{pool}/backends/{addr}/weight     {"weight": 3}
+//	POST   /pools/{pool}/backends/{addr}/drain      stop sending new connections
+//	DELETE /pools/{pool}/backends/{addr}/drain      take new connections again
+func (lb *LB) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", lb.adminStats)
+	mux.HandleFunc("GET /metrics", lb.adminMetrics)
+	mux.HandleFunc("POST /pools/{pool}/backends", lb.adminAddBackend)
+	mux.HandleFunc("DELETE /pools/{pool}/backends/{addr}", lb.adminRemoveBackend)
+	mux.HandleFunc("PUT /pools/{pool}/backends/{addr}/weight", lb.adminSetWeight)
+	mux.HandleFunc("POST /pools/{pool}/backends/{addr}/drain", lb.adminDrain(true))
+	mux.HandleFunc("DELETE /pools/{pool}/backends/{addr}/drain", lb.adminDrain(false))
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errUnknownBackend) || errors.Is(err, errUnknownPool) {
+		status = http.StatusNotFound
+	}
+	if errors.Is(err, errDiscoveryOwned) {
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+var errUnknownPool = errors.New("unknown pool")
+
+func (lb *LB) pool(r *http.Request) (*Pool, error) {
+	pool, ok := lb.Pools[r.PathValue("pool")]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownPool, r.PathValue("pool"))
+	}
+	return pool, nil
+}
+
+func (lb *LB) adminStats(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(lb.Pools))
+	for name := range lb.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]PoolStats, 0, len(names))
+	for _, name := range names {
+		out = append(out, lb.Pools[name].Stats())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pools": out})
+}
+
+func (lb *LB) adminAddBackend(w http.ResponseWriter, r *http.Request) {
+	pool, err := lb.pool(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	var bc BackendConfig
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		writeAdminError(w, fmt.Errorf("invalid request payload: %w", err))
+		return
+	}
+	if bc.Host == "" || bc.Port == "" {
+		writeAdminError(w, errors.New("host and port are required"))
+		return
+	}
+	backend := &Backend{Host: bc.Host, Port: bc.Port, Weight: bc.Weight, MaxConns: bc.MaxConns}
+	if err := pool.Add(backend); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	fmt.Println("admin: added ", backend.Addr(), " to pool ", pool.Name)
+	writeJSON(w, http.StatusCreated, pool.Stats())
+}
+
+func (lb *LB) adminRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	pool, err := lb.pool(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := pool.Remove(r.PathValue("addr")); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	fmt.Println("admin: removed ", r.PathValue("addr"), " from pool ", pool.Name)
+	writeJSON(w, http.StatusOK, pool.Stats())
+}
+
+func (lb *LB) adminSetWeight(w http.ResponseWriter, r *http.Request) {
+	pool, err := lb.pool(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	var req struct {
+		Weight int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, fmt.Errorf("invalid request payload: %w", err))
+		return
+	}
+	if req.Weight <= 0 {
+		writeAdminError(w, errors.New("weight must be positive"))
+		return
+	}
+	if err := pool.SetWeight(r.PathValue("addr"), req.Weight); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Stats())
+}
+
+func (lb *LB) adminDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pool, err := lb.pool(r)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		if err := pool.SetDraining(r.PathValue("addr"), drain); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		fmt.Println("admin: draining ", r.PathValue("addr"), " in pool ", pool.Name, " = ", drain)
+		writeJSON(w, http.StatusOK, pool.Stats())
+	}
+}
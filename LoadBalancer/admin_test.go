@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAPI(t *testing.T) {
+	pool := NewPool("web", RoundRobin, []*Backend{{Host: "10.0.0.1", Port: "80"}})
+	admin := httptest.NewServer(testLB(pool).AdminHandler())
+	t.Cleanup(admin.Close)
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+		// the backends of pool web after the call, as addr=state/weight
+		backends string
+	}{
+		{method: "POST", path: "/pools/web/backends", body: `{"host":"10.0.0.2","port":"80","weight":2}`, want: 201, backends: "10.0.0.1:80=up/1 10.0.0.2:80=up/2"},
+		{method: "POST", path: "/pools/web/backends", body: `{"host":"10.0.0.2","port":"80"}`, want: 400},
+		{method: "POST", path: "/pools/web/backends", body: `{"host":"10.0.0.3"}`, want: 400},
+		{method: "POST", path: "/pools/web/backends", body: `{`, want: 400},
+		{method: "POST", path: "/pools/nope/backends", body: `{"host":"10.0.0.3","port":"80"}`, want: 404},
+		{method: "PUT", path: "/pools/web/backends/10.0.0.1:80/weight", body: `{"weight":5}`, want: 200, backends: "10.0.0.1:80=up/5 10.0.0.2:80=up/2"},
+		{method: "PUT", path: "/pools/web/backends/10.0.0.1:80/weight", body: `{"weight":0}`, want: 400},
+		{method: "PUT", path: "/pools/web/backends/10.0.0.9:80/weight", body: `{"weight":1}`, want: 404},
+		{method: "POST", path: "/pools/web/backends/10.0.0.2:80/drain", want: 200, backends: "10.0.0.1:80=up/5 10.0.0.2:80=draining/2"},
+		{method: "DELETE", path: "/pools/web/backends/10.0.0.2:80/drain", want: 200, backends: "10.0.0.1:80=up/5 10.0.0.2:80=up/2"},
+		{method: "DELETE", path: "/pools/web/backends/10.0.0.1:80", want: 200, backends: "10.0.0.2:80=up/2"},
+		{method: "DELETE", path: "/pools/web/backends/10.0.0.1:80", want: 404},
+		{method: "GET", path: "/pools/web/backends", want: 405},
+	} {
+		req, _ := http.NewRequest(tc.method, admin.URL+tc.path, strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s %s: %d, want %d", tc.method, tc.path, tc.body, resp.StatusCode, tc.want)
+		}
+		if tc.backends == "" {
+			continue
+		}
+		if got := adminBackends(t, admin.URL); got != tc.backends {
+			t.Errorf("%s %s: backends %s, want %s", tc.method, tc.path, got, tc.backends)
+		}
+	}
+}
+
+// adminBackends reads /stats and lists pool web as addr=state/weight.
+func adminBackends(t *testing.T, admin string) string {
+	t.Helper()
+	resp, err := http.Get(admin + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Pools []PoolStats `json:"pools"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, ps := range stats.Pools {
+		if ps.Name != "web" {
+			continue
+		}
+		for _, b := range ps.Backends {
+			out = append(out, b.Addr+"="+b.State+"/"+strconv.Itoa(b.Weight))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+func TestAdminStats(t *testing.T) {
+	a, b := &Backend{Host: "10.0.0.1", Port: "80"}, &Backend{Host: "10.0.0.2", Port: "80", Down: true}
+	web := NewPool("web", RoundRobin, []*Backend{a, b})
+	lb := testLB(web, NewPool("api", LeastConnections, nil))
+	web.Pick("")
+	web.Observe(a, 10, 20, 0, true)
+	for i := 1; i <= 100; i++ {
+		web.Observe(a, 0, 0, time.Duration(i)*time.Millisecond, false)
+	}
+
+	w := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		Pools []PoolStats `json:"pools"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Pools) != 2 || stats.Pools[0].Name != "api" || stats.Pools[1].Name != "web" {
+		t.Fatalf("pools %+v, want api then web", stats.Pools)
+	}
+	got := stats.Pools[1].Backends
+	if len(got) != 2 || got[1].State != "down" {
+		t.Fatalf("backends %+v", got)
+	}
+	s := got[0]
+	if s.Active != 1 || s.Total != 1 || s.BytesIn != 10 || s.BytesOut != 20 || s.Errors != 1 {
+		t.Errorf("counters %+v", s)
+	}
+	if s.P50Ms != 50 || s.P90Ms != 90 || s.P99Ms != 99 {
+		t.Errorf("latency p50 %v p90 %v p99 %v, want 50 90 99", s.P50Ms, s.P90Ms, s.P99Ms)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+
+	"loadBalancer/proxyproto"
 )
 
 // func handleConnection(conn net.Conn) {
@@ -19,9 +22,17 @@ func sayHello(w http.ResponseWriter, r *http.Request) {
 func main() {
 	http.HandleFunc("/", sayHello)
 	fmt.Println("8000 port server 1 started")
-	err := http.ListenAndServe(":8000", nil)
+	listener, err := net.Listen("tcp", ":8000")
+	if err != nil {
+		fmt.Println("Listen: ", err)
+		panic(err)
+	}
+	// r.RemoteAddr is the real client when the load balancer, running on
+	// this machine, sends a PROXY header
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	err = http.Serve(&proxyproto.Listener{Listener: listener, Trusted: []*net.IPNet{loopback}}, nil)
 	if err != nil {
-		fmt.Println("ListenAndServe: ", err)
+		fmt.Println("Serve: ", err)
 		panic(err)
 	}
 }
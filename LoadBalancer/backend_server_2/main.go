@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+
+	"loadBalancer/proxyproto"
 )
 
 func sayHello(w http.ResponseWriter, r *http.Request) {
@@ -13,9 +16,17 @@ func sayHello(w http.ResponseWriter, r *http.Request) {
 func main() {
 	http.HandleFunc("/", sayHello)
 	fmt.Println("started server 2 in port 9000")
-	err := http.ListenAndServe(":9000", nil)
+	listener, err := net.Listen("tcp", ":9000")
+	if err != nil {
+		fmt.Println("Listen: ", err)
+		panic(err)
+	}
+	// r.RemoteAddr is the real client when the load balancer, running on
+	// this machine, sends a PROXY header
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	err = http.Serve(&proxyproto.Listener{Listener: listener, Trusted: []*net.IPNet{loopback}}, nil)
 	if err != nil {
-		fmt.Println("ListenAndServe: ", err)
+		fmt.Println("Serve: ", err)
 		panic(err)
 	}
 
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"loadBalancer/proxyproto"
+)
+
+// Config is the JSON file passed with -config. See lb.json for an example.
+type Config struct {
+	Listen      string        `json:"listen"`
+	Mode        string        `json:"mode"` // "tcp" (default), "http" or "udp"
+	DefaultPool string        `json:"defaultPool"`
+	Pools       []PoolConfig  `json:"pools"`
+	Routes      []RouteConfig `json:"routes"`
+	Timeouts    TimeoutConfig `json:"timeouts"`
+	// DrainTimeout bounds how long shutdown waits for open connections
+	DrainTimeout string        `json:"drainTimeout"`
+	Admin        string        `json:"admin"`
+	TLS          *TLSConfig    `json:"tls"`
+	Limits       *LimitsConfig `json:"limits"`
+	// AcceptProxyProtocol reads PROXY v1/v2 headers from an upstream
+	// balancer
+	AcceptProxyProtocol *AcceptProxyConfig `json:"acceptProxyProtocol"`
+	// AccessLog defaults to JSON lines on stdout
+	AccessLog *AccessLogConfig `json:"accessLog"`
+}
+
+type AccessLogConfig struct {
+	Disabled bool   `json:"disabled"`
+	Path     string `json:"path"`   // file to append to, stdout when empty
+	Format   string `json:"format"` // "json" (default) or "text"
+}
+
+type AcceptProxyConfig struct {
+	Required bool     `json:"required"`
+	Trusted  []string `json:"trusted"` // CIDRs allowed to send a header, at least one
+}
+
+type LimitsConfig struct {
+	Rate          float64 `json:"rate"` // requests (http) or connections (tcp) per second
+	Burst         int     `json:"burst"`
+	Key           string  `json:"key"` // "ip" or "header:<name>"
+	MaxConnsPerIP int     `json:"maxConnsPerIP"`
+	Status        int     `json:"status"` // http mode, default 429
+	Body          string  `json:"body"`
+}
+
+type TLSConfig struct {
+	// Passthrough routes on the ClientHello SNI without decrypting (tcp
+	// mode only); otherwise TLS is terminated with Certificates.
+	Passthrough  bool             `json:"passthrough"`
+	Certificates []CertConfig     `json:"certificates"`
+	SNIRoutes    []SNIRouteConfig `json:"sniRoutes"`
+}
+
+type CertConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type SNIRouteConfig struct {
+	ServerName string `json:"serverName"`
+	Pool       string `json:"pool"`
+}
+
+// BackendTLSConfig re-encrypts traffic from the balancer to a pool.
+type BackendTLSConfig struct {
+	ServerName         string `json:"serverName"` // defaults to the backend host
+	CA                 string `json:"ca"`         // PEM bundle; system roots when empty
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+type TimeoutConfig struct {
+	Connect string `json:"connect"`
+	Idle    string `json:"idle"`
+	Read    string `json:"read"`
+	Write   string `json:"write"`
+}
+
+type BackendConfig struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Weight   int    `json:"weight"`
+	MaxConns int    `json:"maxConns"`
+}
+
+type PoolConfig struct {
+	Name        string             `json:"name"`
+	Algorithm   string             `json:"algorithm"`
+	Backends    []BackendConfig    `json:"backends"`
+	Sticky      *StickyConfig      `json:"sticky"`
+	HealthCheck *HealthCheckConfig `json:"healthCheck"`
+	TLS         *BackendTLSConfig  `json:"tls"`
+	// SendProxyProtocol announces the client to backends with a PROXY
+	// header of this version (1 or 2)
+	SendProxyProtocol int          `json:"sendProxyProtocol"`
+	Retry             *RetryConfig `json:"retry"`
+	// SlowStart ramps recovered and new backends up to their weight
+	SlowStart *SlowStartConfig `json:"slowStart"`
+	// Discovery replaces Backends with a watched file or DNS name
+	Discovery *DiscoveryConfig `json:"discovery"`
+}
+
+type DiscoveryConfig struct {
+	Type     string `json:"type"` // "file", "dns" (A/AAAA) or "srv"
+	Path     string `json:"path"` // file
+	Name     string `json:"name"` // dns and srv
+	Port     string `json:"port"` // dns
+	Interval string `json:"interval"`
+}
+
+type SlowStartConfig struct {
+	Window      string  `json:"window"`
+	Ramp        string  `json:"ramp"`        // "linear" (default) or "exponential"
+	MinFraction float64 `json:"minFraction"` // default 0.1
+}
+
+// RetryConfig enables retries and hedging for a pool in http mode.
+type RetryConfig struct {
+	Attempts     int    `json:"attempts"` // including the first try, default 3
+	Statuses     []int  `json:"statuses"` // default 502, 503, 504
+	BaseBackoff  string `json:"baseBackoff"`
+	MaxBackoff   string `json:"maxBackoff"`
+	MaxBodyBytes int64  `json:"maxBodyBytes"`
+	// BudgetRatio is retries allowed per request on top of
+	// BudgetPerSecond
+	BudgetRatio     float64 `json:"budgetRatio"`
+	BudgetPerSecond float64 `json:"budgetPerSecond"`
+	Hedge           bool    `json:"hedge"`
+	HedgePercentile float64 `json:"hedgePercentile"`
+	HedgeMinDelay   string  `json:"hedgeMinDelay"`
+}
+
+type StickyConfig struct {
+	Mode       string  `json:"mode"` // "cookie" or "hash"
+	Cookie     string  `json:"cookie"`
+	Key        string  `json:"key"`
+	LoadFactor float64 `json:"loadFactor"`
+	TTL        string  `json:"ttl"`
+}
+
+type HealthCheckConfig struct {
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+	Path     string `json:"path"`
+	Payload  string `json:"payload"` // udp mode: datagram that must get a reply
+}
+
+type RouteConfig struct {
+	Name        string            `json:"name"`
+	Priority    int               `json:"priority"`
+	Pool        string            `json:"pool"`
+	Host        string            `json:"host"`
+	PathPrefix  string            `json:"pathPrefix"`
+	PathRegex   string            `json:"pathRegex"`
+	Methods     []string          `json:"methods"`
+	Headers     map[string]string `json:"headers"`
+	StripPrefix bool              `json:"stripPrefix"`
+	Rewrite     string            `json:"rewrite"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// NewLBFromConfig builds pools and routes and checks that every route
+// points at a pool that exists.
+func NewLBFromConfig(cfg *Config) (*LB, error) {
+	lb := &LB{
+		Mode:   cfg.Mode,
+		Listen: cfg.Listen,
+		Admin:  cfg.Admin,
+		Pools:  make(map[string]*Pool),
+
+		Metrics: NewMetrics(),
+	}
+	if lb.Mode == "" {
+		lb.Mode = "tcp"
+	}
+	if lb.Mode != "tcp" && lb.Mode != "http" && lb.Mode != "udp" {
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+	if lb.Mode == "udp" && (cfg.TLS != nil || cfg.Limits != nil || cfg.AcceptProxyProtocol != nil) {
+		return nil, fmt.Errorf("tls, limits and acceptProxyProtocol are not supported in udp mode")
+	}
+	if lb.Listen == "" {
+		lb.Listen = ":7878"
+	}
+	var err error
+	if ac := cfg.AccessLog; ac == nil || !ac.Disabled {
+		if ac == nil {
+			ac = &AccessLogConfig{}
+		}
+		if lb.AccessLog, err = newAccessLog(ac.Path, ac.Format); err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+	}
+	if lb.Timeouts.Connect, err = parseDuration(cfg.Timeouts.Connect, defaultTimeouts.Connect); err != nil {
+		return nil, fmt.Errorf("connect timeout: %w", err)
+	}
+	if lb.Mode == "udp" {
+		// a udp session only ends by idling out, it needs a timeout
+		lb.Timeouts.Idle, err = positiveDuration(cfg.Timeouts.Idle, defaultUDPIdle)
+	} else {
+		lb.Timeouts.Idle, err = parseDuration(cfg.Timeouts.Idle, defaultTimeouts.Idle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("idle timeout: %w", err)
+	}
+	if lb.Timeouts.Read, err = parseDuration(cfg.Timeouts.Read, defaultTimeouts.Read); err != nil {
+		return nil, fmt.Errorf("read timeout: %w", err)
+	}
+	if lb.Timeouts.Write, err = parseDuration(cfg.Timeouts.Write, defaultTimeouts.Write); err != nil {
+		return nil, fmt.Errorf("write timeout: %w", err)
+	}
+	if lb.DrainTimeout, err = parseDuration(cfg.DrainTimeout, 30*time.Second); err != nil {
+		return nil, fmt.Errorf("drain timeout: %w", err)
+	}
+
+	for _, pc := range cfg.Pools {
+		if pc.Name == "" {
+			return nil, fmt.Errorf("pool without a name")
+		}
+		if _, dup := lb.Pools[pc.Name]; dup {
+			return nil, fmt.Errorf("pool %q declared twice", pc.Name)
+		}
+		if !validAlgorithm(pc.Algorithm) {
+			return nil, fmt.Errorf("pool %q: unknown algorithm %q", pc.Name, pc.Algorithm)
+		}
+		servers := make([]*Backend, 0, len(pc.Backends))
+		for _, bc := range pc.Backends {
+			servers = append(servers, &Backend{Host: bc.Host, Port: bc.Port, Weight: bc.Weight, MaxConns: bc.MaxConns})
+		}
+		pool := NewPool(pc.Name, pc.Algorithm, servers)
+		pool.HealthCheck.UDP = lb.Mode == "udp"
+		if sc := pc.SlowStart; sc != nil {
+			slowStart := &SlowStart{Ramp: sc.Ramp, MinFraction: sc.MinFraction}
+			if slowStart.Ramp == "" {
+				slowStart.Ramp = RampLinear
+			}
+			if slowStart.MinFraction == 0 {
+				slowStart.MinFraction = 0.1
+			}
+			var err error
+			if slowStart.Window, err = parseDuration(sc.Window, 30*time.Second); err != nil {
+				return nil, fmt.Errorf("pool %q: slow start window: %w", pc.Name, err)
+			}
+			if err := validSlowStart(slowStart); err != nil {
+				return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+			}
+			pool.SlowStart = slowStart
+			for _, b := range servers {
+				b.SlowStart = slowStart
+			}
+		}
+		if hc := pc.HealthCheck; hc != nil {
+			var err error
+			if pool.HealthCheck.Interval, err = positiveDuration(hc.Interval, defaultHealthCheck.Interval); err != nil {
+				return nil, fmt.Errorf("pool %q: health check interval: %w", pc.Name, err)
+			}
+			if pool.HealthCheck.Timeout, err = positiveDuration(hc.Timeout, defaultHealthCheck.Timeout); err != nil {
+				return nil, fmt.Errorf("pool %q: health check timeout: %w", pc.Name, err)
+			}
+			pool.HealthCheck.Path = hc.Path
+			pool.HealthCheck.Payload = hc.Payload
+		}
+		if sc := pc.Sticky; sc != nil {
+			sticky := &Sticky{Mode: sc.Mode, CookieName: sc.Cookie, Key: sc.Key, LoadFactor: sc.LoadFactor}
+			if sticky.LoadFactor == 0 {
+				sticky.LoadFactor = 1.25
+			}
+			var err error
+			if sticky.TTL, err = parseDuration(sc.TTL, 30*time.Minute); err != nil {
+				return nil, fmt.Errorf("pool %q: sticky ttl: %w", pc.Name, err)
+			}
+			if err := validSticky(sticky); err != nil {
+				return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+			}
+			if lb.Mode != "http" && (sticky.Mode == StickyCookie || (sticky.Key != "" && sticky.Key != "ip")) {
+				// a connection or datagram only has its source address
+				return nil, fmt.Errorf("pool %q: only ip stickiness works in %s mode", pc.Name, lb.Mode)
+			}
+			pool.SetSticky(sticky)
+		}
+		if pc.TLS != nil {
+			if pool.BackendTLS, err = backendTLSConfig(pc.TLS); err != nil {
+				return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+			}
+		}
+		if pc.SendProxyProtocol < 0 || pc.SendProxyProtocol > 2 {
+			return nil, fmt.Errorf("pool %q: unknown proxy protocol version %d", pc.Name, pc.SendProxyProtocol)
+		}
+		if pc.SendProxyProtocol > 0 && lb.Mode == "udp" {
+			return nil, fmt.Errorf("pool %q: proxy protocol is not supported in udp mode", pc.Name)
+		}
+		pool.SendProxyProtocol = pc.SendProxyProtocol
+		if rc := pc.Retry; rc != nil {
+			if lb.Mode != "http" {
+				return nil, fmt.Errorf("pool %q: retries need http mode", pc.Name)
+			}
+			if pool.Retry, err = retryPolicy(rc); err != nil {
+				return nil, fmt.Errorf("pool %q: retry: %w", pc.Name, err)
+			}
+		}
+		if dc := pc.Discovery; dc != nil {
+			if len(pc.Backends) > 0 {
+				return nil, fmt.Errorf("pool %q: backends and discovery are exclusive", pc.Name)
+			}
+			if pool.Discovery, err = discovery(dc); err != nil {
+				return nil, fmt.Errorf("pool %q: discovery: %w", pc.Name, err)
+			}
+			if pool.DiscoveryInterval, err = positiveDuration(dc.Interval, 10*time.Second); err != nil {
+				return nil, fmt.Errorf("pool %q: discovery interval: %w", pc.Name, err)
+			}
+		}
+		lb.Pools[pc.Name] = pool
+	}
+
+	defaultPool := cfg.DefaultPool
+	if defaultPool == "" && len(cfg.Pools) == 1 {
+		defaultPool = cfg.Pools[0].Name
+	}
+	if _, ok := lb.Pools[defaultPool]; !ok {
+		return nil, fmt.Errorf("default pool %q does not exist", defaultPool)
+	}
+
+	if lb.Mode != "http" && len(cfg.Routes) > 0 {
+		return nil, fmt.Errorf("routes need http mode, %s mode only has the default pool (and sniRoutes)", lb.Mode)
+	}
+	routes := make([]*Route, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		if _, ok := lb.Pools[rc.Pool]; !ok {
+			return nil, fmt.Errorf("route %q: pool %q does not exist", rc.Name, rc.Pool)
+		}
+		route := &Route{
+			Name:        rc.Name,
+			Priority:    rc.Priority,
+			Pool:        rc.Pool,
+			Host:        rc.Host,
+			PathPrefix:  rc.PathPrefix,
+			Methods:     rc.Methods,
+			Headers:     rc.Headers,
+			StripPrefix: rc.StripPrefix,
+			Rewrite:     rc.Rewrite,
+		}
+		if rc.PathRegex != "" {
+			re, err := regexp.Compile(rc.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", rc.Name, err)
+			}
+			route.PathRegex = re
+		}
+		routes = append(routes, route)
+	}
+	lb.Router = NewRouter(routes, defaultPool)
+
+	if tc := cfg.TLS; tc != nil {
+		lb.TLS = &TLS{Passthrough: tc.Passthrough}
+		if tc.Passthrough {
+			if lb.Mode != "tcp" {
+				return nil, fmt.Errorf("tls passthrough needs tcp mode")
+			}
+			for _, pool := range lb.Pools {
+				if pool.BackendTLS != nil {
+					return nil, fmt.Errorf("pool %q: tls passthrough cannot re-encrypt to backends", pool.Name)
+				}
+			}
+		} else if lb.TLS.Config, err = terminationConfig(tc.Certificates); err != nil {
+			return nil, err
+		}
+		for _, sr := range tc.SNIRoutes {
+			if _, ok := lb.Pools[sr.Pool]; !ok {
+				return nil, fmt.Errorf("sni route %q: pool %q does not exist", sr.ServerName, sr.Pool)
+			}
+			lb.TLS.SNIRoutes = append(lb.TLS.SNIRoutes, SNIRoute{ServerName: sr.ServerName, Pool: sr.Pool})
+		}
+	}
+	if lc := cfg.Limits; lc != nil {
+		limits := NewLimits()
+		limits.Rate = lc.Rate
+		limits.Burst = lc.Burst
+		limits.Key = lc.Key
+		limits.MaxConnsPerIP = lc.MaxConnsPerIP
+		if lc.Status != 0 {
+			limits.Status = lc.Status
+		}
+		if lc.Body != "" {
+			limits.Body = lc.Body
+		}
+		if limits.Rate < 0 || limits.MaxConnsPerIP < 0 {
+			return nil, fmt.Errorf("limits must not be negative")
+		}
+		if limits.Rate > 0 && limits.Burst < 1 {
+			limits.Burst = int(math.Ceil(limits.Rate))
+		}
+		if limits.Key != "" && limits.Key != "ip" && !strings.HasPrefix(limits.Key, "header:") {
+			return nil, fmt.Errorf("unknown limits key %q", limits.Key)
+		}
+		lb.Limits = limits
+	}
+	if ac := cfg.AcceptProxyProtocol; ac != nil {
+		if len(ac.Trusted) == 0 {
+			return nil, fmt.Errorf("acceptProxyProtocol needs the trusted CIDRs of the upstream balancers")
+		}
+		lb.AcceptProxyProtocol = &proxyproto.Listener{Required: ac.Required}
+		for _, cidr := range ac.Trusted {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("acceptProxyProtocol: %w", err)
+			}
+			lb.AcceptProxyProtocol.Trusted = append(lb.AcceptProxyProtocol.Trusted, n)
+		}
+	}
+	return lb, nil
+}
+
+// parseDuration reads a Go duration string such as "5s", returning def for
+// an empty string.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// positiveDuration is parseDuration for intervals that drive a ticker or a
+// deadline, where zero or less cannot work.
+func positiveDuration(s string, def time.Duration) (time.Duration, error) {
+	d, err := parseDuration(s, def)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("%q must be positive", s)
+	}
+	return d, err
+}
+
+func retryPolicy(rc *RetryConfig) (*RetryPolicy, error) {
+	rp := &RetryPolicy{
+		Attempts:        rc.Attempts,
+		Statuses:        rc.Statuses,
+		MaxBodyBytes:    rc.MaxBodyBytes,
+		Hedge:           rc.Hedge,
+		HedgePercentile: rc.HedgePercentile,
+		Budget:          &RetryBudget{Ratio: rc.BudgetRatio, MinPerSecond: rc.BudgetPerSecond},
+	}
+	if rp.Attempts == 0 {
+		rp.Attempts = 3
+	}
+	if rp.Statuses == nil {
+		rp.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if rp.MaxBodyBytes == 0 {
+		rp.MaxBodyBytes = 1 << 20
+	}
+	if rp.Budget.Ratio == 0 && rp.Budget.MinPerSecond == 0 {
+		rp.Budget.Ratio, rp.Budget.MinPerSecond = 0.2, 10
+	}
+	if rp.HedgePercentile == 0 {
+		rp.HedgePercentile = 95
+	}
+	if rp.Attempts < 1 || rp.HedgePercentile < 0 || rp.HedgePercentile > 100 {
+		return nil, fmt.Errorf("attempts must be at least 1 and hedgePercentile within 0-100")
+	}
+	var err error
+	if rp.BaseBackoff, err = parseDuration(rc.BaseBackoff, 25*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if rp.MaxBackoff, err = parseDuration(rc.MaxBackoff, time.Second); err != nil {
+		return nil, err
+	}
+	if rp.HedgeMinDelay, err = parseDuration(rc.HedgeMinDelay, 10*time.Millisecond); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+func discovery(dc *DiscoveryConfig) (Discovery, error) {
+	switch dc.Type {
+	case "file":
+		if dc.Path == "" {
+			return nil, fmt.Errorf("file discovery needs a path")
+		}
+		return &FileDiscovery{Path: dc.Path}, nil
+	case "dns":
+		if dc.Name == "" || dc.Port == "" {
+			return nil, fmt.Errorf("dns discovery needs a name and a port")
+		}
+		return &DNSDiscovery{Name: dc.Name, Port: dc.Port}, nil
+	case "srv":
+		if dc.Name == "" {
+			return nil, fmt.Errorf("srv discovery needs a name")
+		}
+		return &DNSDiscovery{Name: dc.Name, SRV: true}, nil
+	}
+	return nil, fmt.Errorf("unknown discovery type %q", dc.Type)
+}
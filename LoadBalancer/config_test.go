@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigRejectsNonPositiveIntervals(t *testing.T) {
+	for name, pool := range map[string]PoolConfig{
+		"health check interval": {HealthCheck: &HealthCheckConfig{Interval: "0s"}},
+		"health check timeout":  {HealthCheck: &HealthCheckConfig{Timeout: "-1s"}},
+		"discovery interval":    {Discovery: &DiscoveryConfig{Type: "dns", Name: "api.internal", Port: "80", Interval: "0s"}},
+	} {
+		pool.Name = "p"
+		_, err := NewLBFromConfig(&Config{Pools: []PoolConfig{pool}, AccessLog: &AccessLogConfig{Disabled: true}})
+		if err == nil || !strings.Contains(err.Error(), "must be positive") {
+			t.Errorf("%s: err = %v, want it rejected", name, err)
+		}
+	}
+}
+
+func TestConfigRejectsHTTPOnlyFeaturesInOtherModes(t *testing.T) {
+	sticky := func(sc StickyConfig) []PoolConfig {
+		return []PoolConfig{{Name: "p", Sticky: &sc}}
+	}
+	routes := []RouteConfig{{Name: "api", Pool: "p", PathPrefix: "/api"}}
+	for _, tc := range []struct {
+		name   string
+		pools  []PoolConfig
+		routes []RouteConfig
+		want   string
+	}{
+		{name: "cookie stickiness", pools: sticky(StickyConfig{Mode: StickyCookie, Cookie: "lb"}), want: "stickiness"},
+		{name: "header hash", pools: sticky(StickyConfig{Mode: StickyHash, Key: "header:X-User"}), want: "stickiness"},
+		{name: "cookie hash", pools: sticky(StickyConfig{Mode: StickyHash, Key: "cookie:session"}), want: "stickiness"},
+		{name: "routes", pools: []PoolConfig{{Name: "p"}}, routes: routes, want: "routes need http mode"},
+	} {
+		for _, mode := range []string{"tcp", "udp"} {
+			cfg := &Config{Mode: mode, Pools: tc.pools, Routes: tc.routes, AccessLog: &AccessLogConfig{Disabled: true}}
+			if _, err := NewLBFromConfig(cfg); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s in %s mode: err = %v, want it rejected", tc.name, mode, err)
+			}
+		}
+		cfg := &Config{Mode: "http", Pools: tc.pools, Routes: tc.routes, AccessLog: &AccessLogConfig{Disabled: true}}
+		if _, err := NewLBFromConfig(cfg); err != nil {
+			t.Errorf("%s in http mode: %v", tc.name, err)
+		}
+	}
+
+	// ip stickiness is all a connection has, and it works
+	for _, mode := range []string{"tcp", "udp"} {
+		for _, key := range []string{"", "ip"} {
+			cfg := &Config{Mode: mode, Pools: sticky(StickyConfig{Mode: StickyHash, Key: key}), AccessLog: &AccessLogConfig{Disabled: true}}
+			if _, err := NewLBFromConfig(cfg); err != nil {
+				t.Errorf("ip hash %q in %s mode: %v", key, mode, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery finds the current backends of a pool. A pool with a Discovery
+// polls it every DiscoveryInterval and reconciles its Servers with the
+// answer: new backends join (in slow start when the pool has one) and
+// backends that disappeared are drained, then dropped once their last
+// connection closes.
+type Discovery interface {
+	Backends(ctx context.Context) ([]*Backend, error)
+}
+
+// FileDiscovery reads host:port entries from a file, one per line with an
+// optional weight after a space. Blank lines and # comments are ignored.
+// The file is re-read on every poll, so edits are picked up without a
+// restart.
+type FileDiscovery struct {
+	Path string
+}
+
+func (fd *FileDiscovery) Backends(ctx context.Context) ([]*Backend, error) {
+	f, err := os.Open(fd.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var backends []*Backend
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fd.Path, line, err)
+		}
+		b := &Backend{Host: host, Port: port}
+		if len(fields) > 1 {
+			if b.Weight, err = strconv.Atoi(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad weight %q", fd.Path, line, fields[1])
+			}
+		}
+		backends = append(backends, b)
+	}
+	return backends, scanner.Err()
+}
+
+// Resolver is the part of *net.Resolver DNSDiscovery uses, so it can be
+// swapped for a fake.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSDiscovery resolves Name on every poll. With SRV set Name is a full SRV
+// name such as _http._tcp.api.internal and each record of the lowest
+// priority gives host, port and weight (records of higher priorities are
+// fallbacks, used only once the lower ones are gone from DNS); otherwise
+// every A/AAAA address of Name becomes a backend on Port.
+type DNSDiscovery struct {
+	Name     string
+	Port     string
+	SRV      bool
+	Resolver Resolver // nil uses net.DefaultResolver
+}
+
+func (dd *DNSDiscovery) Backends(ctx context.Context) ([]*Backend, error) {
+	var resolver Resolver = net.DefaultResolver
+	if dd.Resolver != nil {
+		resolver = dd.Resolver
+	}
+	var backends []*Backend
+	if dd.SRV {
+		_, records, err := resolver.LookupSRV(ctx, "", "", dd.Name)
+		if err != nil {
+			return nil, err
+		}
+		lowest := ^uint16(0)
+		for _, srv := range records {
+			lowest = min(lowest, srv.Priority)
+		}
+		for _, srv := range records {
+			if srv.Priority != lowest {
+				continue
+			}
+			backends = append(backends, &Backend{
+				Host:   strings.TrimSuffix(srv.Target, "."),
+				Port:   strconv.Itoa(int(srv.Port)),
+				Weight: int(srv.Weight),
+			})
+		}
+		return backends, nil
+	}
+	addrs, err := resolver.LookupHost(ctx, dd.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		backends = append(backends, &Backend{Host: addr, Port: dd.Port})
+	}
+	return backends, nil
+}
+
+// RunDiscovery keeps the pool in step with its Discovery. A failed lookup
+// leaves the servers as they are rather than emptying the pool.
+func (p *Pool) RunDiscovery() {
+	ticker := time.NewTicker(p.DiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		p.Discover()
+	}
+}
+
+// Discover runs one lookup and applies it.
+func (p *Pool) Discover() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.DiscoveryInterval)
+	defer cancel()
+	found, err := p.Discovery.Backends(ctx)
+	if err != nil {
+		fmt.Println("err while discovering backends of pool ", p.Name, " => ", err)
+		p.Reconcile(nil, false)
+		return
+	}
+	p.Reconcile(found, true)
+}
+
+// Reconcile makes found the pool's backends. Missing backends are drained
+// instead of removed, and removed once idle; with complete false nothing is
+// added or drained and only that cleanup runs.
+func (p *Pool) Reconcile(found []*Backend, complete bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	changed := false
+	if complete {
+		current := make(map[string]*Backend, len(p.Servers))
+		for _, b := range p.Servers {
+			current[b.Addr()] = b
+		}
+		seen := make(map[string]bool, len(found))
+		initial := len(p.Servers) == 0
+		for _, f := range found {
+			addr := f.Addr()
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			b, ok := current[addr]
+			switch {
+			case !ok:
+				f.SlowStart = p.SlowStart
+				if !initial {
+					f.startRamp(now)
+				}
+				p.Servers = append(p.Servers, f)
+				fmt.Println("discovery: added ", addr, " to pool ", p.Name)
+			case b.removed:
+				// came back before it finished draining
+				b.removed, b.Draining = false, false
+				b.startRamp(now)
+				fmt.Println("discovery: ", addr, " is back in pool ", p.Name)
+			case b.Weight == f.Weight:
+				continue
+			}
+			if ok {
+				b.Weight = f.Weight
+			}
+			changed = true
+		}
+		for _, b := range p.Servers {
+			if !seen[b.Addr()] && !b.removed {
+				b.removed, b.Draining = true, true
+				changed = true
+				fmt.Println("discovery: draining ", b.Addr(), " out of pool ", p.Name)
+			}
+		}
+	}
+	kept := p.Servers[:0:0]
+	for _, b := range p.Servers {
+		if b.removed && b.Active == 0 {
+			changed = true
+			fmt.Println("discovery: removed ", b.Addr(), " from pool ", p.Name)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	p.Servers = kept
+	if changed {
+		p.serversChanged()
+	}
+}
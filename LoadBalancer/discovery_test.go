@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers with whatever the test set last.
+type fakeResolver struct {
+	hosts []string
+	srv   []*net.SRV
+}
+
+func (f *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f.hosts, nil
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", f.srv, nil
+}
+
+func discoveredPool(d Discovery) *Pool {
+	pool := NewPool("discovered", RoundRobin, nil)
+	pool.Discovery = d
+	pool.DiscoveryInterval = time.Second
+	return pool
+}
+
+// state lists the pool's backends as addr => state, "removed" for those
+// discovery is draining out.
+func state(p *Pool) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]string, len(p.Servers))
+	for _, b := range p.Servers {
+		out[b.Addr()] = b.State()
+		if b.removed {
+			out[b.Addr()] = "removed"
+		}
+	}
+	return out
+}
+
+func backendAt(p *Pool, addr string) *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.Servers {
+		if b.Addr() == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+func sameState(got, want map[string]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for addr, s := range want {
+		if got[addr] != s {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReconcileAddsAndDrains(t *testing.T) {
+	resolver := &fakeResolver{hosts: []string{"10.0.0.1", "10.0.0.2"}}
+	pool := discoveredPool(&DNSDiscovery{Name: "api.internal", Port: "80", Resolver: resolver})
+
+	pool.Discover()
+	if got, want := state(pool), map[string]string{"10.0.0.1:80": "up", "10.0.0.2:80": "up"}; !sameState(got, want) {
+		t.Fatalf("after the first lookup %v, want %v", got, want)
+	}
+
+	// .1 is gone while a connection is still open on it
+	busy := backendAt(pool, "10.0.0.1:80")
+	busy.Active = 1
+	resolver.hosts = []string{"10.0.0.2", "10.0.0.3"}
+	pool.Discover()
+	if got, want := state(pool), map[string]string{"10.0.0.1:80": "removed", "10.0.0.2:80": "up", "10.0.0.3:80": "up"}; !sameState(got, want) {
+		t.Fatalf("after .1 left %v, want %v", got, want)
+	}
+	if !busy.Draining || busy.available() {
+		t.Error("a backend that left discovery still takes new connections")
+	}
+
+	// it goes once idle
+	pool.mu.Lock()
+	busy.Active = 0
+	pool.mu.Unlock()
+	pool.Discover()
+	if got, want := state(pool), map[string]string{"10.0.0.2:80": "up", "10.0.0.3:80": "up"}; !sameState(got, want) {
+		t.Fatalf("after .1 went idle %v, want %v", got, want)
+	}
+}
+
+func TestReconcileKeepsServersWhenLookupFails(t *testing.T) {
+	pool := discoveredPool(failingDiscovery{})
+	pool.Servers = []*Backend{{Host: "10.0.0.1", Port: "80"}}
+	pool.Discover()
+	if got := state(pool); got["10.0.0.1:80"] != "up" {
+		t.Errorf("a failed lookup changed the pool to %v", got)
+	}
+}
+
+type failingDiscovery struct{}
+
+func (failingDiscovery) Backends(ctx context.Context) ([]*Backend, error) {
+	return nil, errors.New("dns is down")
+}
+
+func TestSRVWeightsAndPriority(t *testing.T) {
+	resolver := &fakeResolver{srv: []*net.SRV{
+		{Target: "backup.internal.", Port: 80, Priority: 20, Weight: 1},
+		{Target: "a.internal.", Port: 80, Priority: 10, Weight: 1},
+		{Target: "b.internal.", Port: 8080, Priority: 10, Weight: 3},
+	}}
+	pool := discoveredPool(&DNSDiscovery{Name: "_http._tcp.api.internal", SRV: true, Resolver: resolver})
+	weights := func() map[string]int {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		out := make(map[string]int)
+		for _, b := range pool.Servers {
+			if !b.removed {
+				out[b.Addr()] = b.Weight
+			}
+		}
+		return out
+	}
+	keys := func(m map[string]int) []string {
+		var out []string
+		for k := range m {
+			out = append(out, k)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	pool.Discover()
+	got := weights()
+	if len(got) != 2 || got["a.internal:80"] != 1 || got["b.internal:8080"] != 3 {
+		t.Fatalf("backends %v, want only the priority 10 records with their weights", got)
+	}
+
+	resolver.srv[2].Weight = 5
+	pool.Discover()
+	if got := weights(); got["b.internal:8080"] != 5 {
+		t.Errorf("weight of b is %d after the record changed to 5", got["b.internal:8080"])
+	}
+
+	// the fallback only comes in once the preferred records are gone
+	resolver.srv = resolver.srv[:1]
+	pool.Discover()
+	if got := keys(weights()); len(got) != 1 || got[0] != "backup.internal:80" {
+		t.Errorf("backends %v, want only the fallback", got)
+	}
+}
+
+func TestAdminCannotOverrideDiscovery(t *testing.T) {
+	resolver := &fakeResolver{hosts: []string{"10.0.0.1", "10.0.0.2"}}
+	pool := discoveredPool(&DNSDiscovery{Name: "api.internal", Port: "80", Resolver: resolver})
+	pool.Discover()
+
+	if err := pool.Add(&Backend{Host: "10.0.0.9", Port: "80"}); !errors.Is(err, errDiscoveryOwned) {
+		t.Errorf("Add = %v, want errDiscoveryOwned", err)
+	}
+	if err := pool.Remove("10.0.0.1:80"); !errors.Is(err, errDiscoveryOwned) {
+		t.Errorf("Remove = %v, want errDiscoveryOwned", err)
+	}
+	if err := pool.SetWeight("10.0.0.1:80", 5); !errors.Is(err, errDiscoveryOwned) {
+		t.Errorf("SetWeight = %v, want errDiscoveryOwned", err)
+	}
+
+	// draining by hand still works, undraining what discovery dropped does not
+	if err := pool.SetDraining("10.0.0.2:80", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetDraining("10.0.0.2:80", false); err != nil {
+		t.Fatal(err)
+	}
+	backendAt(pool, "10.0.0.1:80").Active = 1
+	resolver.hosts = []string{"10.0.0.2"}
+	pool.Discover()
+	if err := pool.SetDraining("10.0.0.1:80", false); !errors.Is(err, errDiscoveryOwned) {
+		t.Errorf("undraining a removed backend = %v, want errDiscoveryOwned", err)
+	}
+	if b := backendAt(pool, "10.0.0.1:80"); !b.Draining {
+		t.Error("a removed backend was undrained")
+	}
+}
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+# self-signed certificates for trying out tls termination / sni routing
+# locally, e.g. curl -k --resolve server1.localhost:7878:127.0.0.1 https://server1.localhost:7878/
+
+DIR="certs"
+NAMES="server1.localhost server2.localhost"
+
+mkdir -p "$DIR"
+for name in $NAMES; do
+  echo "generating certificate for $name..."
+  openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+    -keyout "$DIR/$name-key.pem" -out "$DIR/$name.pem" \
+    -subj "/CN=$name" -addext "subjectAltName=DNS:$name" 2>/dev/null
+done
+
+echo "certificates written to $DIR/"
@@ -0,0 +1,3 @@
+module loadBalancer
+
+go 1.22.2
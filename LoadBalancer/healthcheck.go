@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthCheck probes every backend of a pool on an interval. A backend that
+// fails a probe is marked Down and skipped by every algorithm until a later
+// probe succeeds.
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Path     string // HTTP GET path; empty means a plain TCP connect
+	// UDP probes with a datagram instead, see probeUDP
+	UDP     bool
+	Payload string
+}
+
+var defaultHealthCheck = HealthCheck{Interval: 5 * time.Second, Timeout: time.Second}
+
+func (p *Pool) RunHealthChecks() {
+	hc := p.HealthCheck
+	// probes reach the backend the way proxied traffic does: a backend
+	// that requires a PROXY header drops connections without one
+	dial := (&net.Dialer{Timeout: hc.Timeout}).DialContext
+	if p.SendProxyProtocol > 0 {
+		dial = proxyHeaderDialer(&net.Dialer{Timeout: hc.Timeout}, p.SendProxyProtocol)
+	}
+	client := &http.Client{Timeout: hc.Timeout}
+	scheme := "http"
+	if p.BackendTLS != nil || p.SendProxyProtocol > 0 {
+		client.Transport = &http.Transport{
+			DialContext:       dial,
+			TLSClientConfig:   p.BackendTLS,
+			DisableKeepAlives: p.SendProxyProtocol > 0,
+		}
+	}
+	if p.BackendTLS != nil {
+		scheme = "https"
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		servers := append([]*Backend(nil), p.Servers...)
+		p.mu.Unlock()
+
+		for _, b := range servers {
+			var err error
+			if hc.UDP {
+				err = probeUDP(hc, b)
+			} else {
+				err = probe(client, dial, scheme, hc, b)
+			}
+			p.mu.Lock()
+			wasDown := b.Down
+			b.Down = err != nil
+			if wasDown && !b.Down {
+				b.startRamp(time.Now())
+			}
+			p.mu.Unlock()
+			if err != nil && !wasDown {
+				fmt.Println("pool ", p.Name, " backend ", b.Addr(), " marked down => ", err)
+			} else if err == nil && wasDown {
+				fmt.Println("pool ", p.Name, " backend ", b.Addr(), " is healthy again")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func probe(client *http.Client, dial func(ctx context.Context, network, addr string) (net.Conn, error), scheme string, hc HealthCheck, b *Backend) error {
+	if hc.Path == "" {
+		conn, err := dial(context.Background(), "tcp", b.Addr())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := client.Get(scheme + "://" + b.Addr() + hc.Path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"loadBalancer/proxyproto"
+)
+
+// TestProbeSendsProxyHeader checks that a backend which requires a PROXY
+// header still passes its health checks.
+func TestProbeSendsProxyHeader(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l := &proxyproto.Listener{Listener: inner, Required: true, Trusted: []*net.IPNet{loopback}, HeaderTimeout: time.Second}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	host, port, _ := net.SplitHostPort(inner.Addr().String())
+
+	for _, path := range []string{"/healthz", ""} {
+		for _, version := range []int{1, 2} {
+			b := &Backend{Host: host, Port: port, Down: true}
+			pool := NewPool("p", RoundRobin, []*Backend{b})
+			pool.SendProxyProtocol = version
+			pool.HealthCheck = HealthCheck{Interval: time.Hour, Timeout: time.Second, Path: path}
+			go pool.RunHealthChecks()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				pool.mu.Lock()
+				down := b.Down
+				pool.mu.Unlock()
+				if !down {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("path %q, proxy v%d: backend still down", path, version)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
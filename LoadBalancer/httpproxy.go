@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hop-by-hop headers are meaningful only for a single connection and must
+// not be forwarded (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// ServeHTTP is the L7 entry point: apply client limits, match a route, pick
+// a backend from the route's pool and forward the request to it, retrying
+// on other backends when the pool allows it.
+func (lb *LB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	aw := &accessWriter{ResponseWriter: w}
+	w = aw
+	a := &access{start: time.Now(), mode: "http", id: r.Header.Get("X-Request-Id"), client: r.RemoteAddr, method: r.Method, path: r.URL.Path}
+	defer func() {
+		// a hijacked websocket fills these in itself
+		if a.status == 0 {
+			a.status, a.bytesOut = aw.status, aw.written
+		}
+		lb.logAccess(a)
+	}()
+
+	if lb.Limits != nil && !lb.Limits.AllowRequest(w, r) {
+		return
+	}
+	route := lb.Router.Match(r)
+	pool := lb.Pools[route.Pool]
+	rp := pool.Retry
+	a.route, a.pool = route.Name, pool.Name
+
+	key := ""
+	if pool.Sticky != nil {
+		key = pool.Sticky.requestKey(r)
+	}
+	if isWebSocket(r) {
+		lb.serveWebSocket(w, r, route, pool, key, a)
+		return
+	}
+
+	var body []byte
+	replayable := false
+	if rp != nil {
+		rp.Budget.deposit()
+		var err error
+		body, replayable, err = bufferBody(r, rp.MaxBodyBytes)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var tried []*Backend
+	var prev *result
+	for attempt := 0; ; attempt++ {
+		res, sent, err := lb.send(r, route, pool, key, tried, body, replayable)
+		tried = sent
+		if prev != nil {
+			if err != nil {
+				// nowhere left to retry, hand back the last failure
+				lb.respond(w, pool, key, prev, a)
+				return
+			}
+			lb.release(pool, prev, 0, true)
+		}
+		if err != nil {
+			a.err = err
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if res.ok(rp) {
+			lb.respond(w, pool, key, res, a)
+			return
+		}
+
+		retry := rp != nil && attempt+1 < rp.Attempts && replayable &&
+			(idempotent(r) || notSent(res.err)) && r.Context().Err() == nil && rp.Budget.withdraw()
+		if !retry {
+			lb.respond(w, pool, key, res, a)
+			return
+		}
+		fmt.Println("retrying ", r.Method, " ", r.URL.Path, " after failure on ", res.backend.Addr(), " => ", res.failure())
+		prev = res
+		select {
+		case <-time.After(rp.backoff(attempt)):
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// result is one request sent to one backend.
+type result struct {
+	backend   *Backend
+	resp      *http.Response
+	err       error
+	latency   time.Duration
+	in        *countingReader
+	cancel    context.CancelFunc
+	longLived bool
+}
+
+func (res *result) ok(rp *RetryPolicy) bool {
+	return res.err == nil && (rp == nil || !rp.retryableStatus(res.resp.StatusCode))
+}
+
+func (res *result) failure() string {
+	if res.err != nil {
+		return res.err.Error()
+	}
+	return res.resp.Status
+}
+
+// send picks a backend outside tried and sends r to it. For a hedging pool
+// a second copy goes to another backend if the first is still pending after
+// the hedge delay; the first good response wins and the other is cancelled.
+// It returns tried with the backends it sent to added, so a retry skips the
+// hedge's backend too.
+func (lb *LB) send(r *http.Request, route *Route, pool *Pool, key string, tried []*Backend, body []byte, replayable bool) (*result, []*Backend, error) {
+	backend, err := pool.PickExcept(key, tried)
+	if err != nil {
+		return nil, tried, err
+	}
+	tried = append(tried, backend)
+	rp := pool.Retry
+	results := make(chan *result, 2)
+	cancels := make(map[*Backend]context.CancelFunc)
+	launch := func(b *Backend) {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels[b] = cancel
+		go func() { results <- lb.attempt(ctx, cancel, r, route, pool, b, body, replayable) }()
+	}
+	launch(backend)
+
+	var hedge <-chan time.Time
+	if rp != nil && rp.Hedge && replayable && idempotent(r) {
+		if delay, ok := pool.hedgeDelay(); ok {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			hedge = timer.C
+		}
+	}
+
+	inflight := 1
+	var failed *result
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			if rp.Budget.withdraw() {
+				if other, err := pool.PickExcept(key, tried); err == nil {
+					fmt.Println("hedging ", r.Method, " ", r.URL.Path, " to ", other.Addr(), ", ", backend.Addr(), " is slow")
+					tried = append(tried, other)
+					inflight++
+					launch(other)
+				}
+			}
+		case res := <-results:
+			inflight--
+			if !res.ok(rp) && inflight > 0 {
+				failed = res
+				continue
+			}
+			if failed != nil {
+				lb.release(pool, failed, 0, true)
+			}
+			if inflight > 0 {
+				for b, cancel := range cancels {
+					if b != res.backend {
+						cancel()
+					}
+				}
+				go func() { lb.release(pool, <-results, 0, false) }()
+			}
+			return res, tried, nil
+		}
+	}
+}
+
+// attempt sends one copy of r to backend.
+func (lb *LB) attempt(ctx context.Context, cancel context.CancelFunc, r *http.Request, route *Route, pool *Pool, backend *Backend, body []byte, replayable bool) *result {
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.URL.Scheme = "http"
+	if pool.BackendTLS != nil {
+		out.URL.Scheme = "https"
+	}
+	out.URL.Host = backend.Addr()
+	out.URL.Path = route.RewritePath(r.URL.Path)
+	out.URL.RawPath = ""
+	switch {
+	case replayable && len(body) > 0:
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	case replayable, r.ContentLength == 0:
+		out.Body = nil
+	}
+	removeHopHeaders(out.Header)
+	out.Header.Set("X-Forwarded-For", forwardedFor(r))
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if pool.SendProxyProtocol > 0 {
+		out = withClientAddrs(r, out)
+	}
+
+	res := &result{backend: backend, in: &countingReader{}, cancel: cancel}
+	if out.Body != nil {
+		res.in.r = out.Body
+		out.Body = io.NopCloser(res.in)
+	}
+	start := time.Now()
+	res.resp, res.err = pool.Transport.RoundTrip(out)
+	res.latency = time.Since(start)
+	return res
+}
+
+// respond copies the chosen result back to the client, releases it and
+// notes the backend on the access entry.
+func (lb *LB) respond(w http.ResponseWriter, pool *Pool, key string, res *result, a *access) {
+	a.backend = res.backend.Addr()
+	if res.err != nil {
+		a.err = res.err
+		http.Error(w, "backend server not avialable", http.StatusBadGateway)
+		lb.release(pool, res, 0, true)
+		return
+	}
+	if pool.Sticky != nil && pool.Sticky.Mode == StickyCookie && key != res.backend.ID() {
+		http.SetCookie(w, &http.Cookie{Name: pool.Sticky.CookieName, Value: res.backend.ID(), Path: "/", HttpOnly: true})
+	}
+	resp := res.resp
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	// lets us see from the client which backend answered
+	w.Header().Set("X-Backend-Server", res.backend.Addr())
+	w.WriteHeader(resp.StatusCode)
+	var written int64
+	var err error
+	if isEventStream(resp) {
+		pool.MarkLongLived(res.backend)
+		res.longLived = true
+		written, err = copyFlushing(w, resp.Body)
+	} else {
+		written, err = io.Copy(w, resp.Body)
+	}
+	if err != nil {
+		a.err = fmt.Errorf("coping response: %w", err)
+	}
+	a.bytesIn = res.in.n.Load()
+	lb.release(pool, res, written, err != nil || resp.StatusCode >= 500)
+}
+
+// release closes a result and records it against its backend.
+func (lb *LB) release(pool *Pool, res *result, written int64, failed bool) {
+	if res.resp != nil {
+		res.resp.Body.Close()
+	}
+	res.cancel()
+	latency := res.latency
+	if res.err != nil {
+		latency = 0
+	}
+	pool.Observe(res.backend, res.in.n.Load(), written, latency, failed)
+	if res.longLived {
+		pool.DoneLongLived(res.backend)
+	} else {
+		pool.Done(res.backend)
+	}
+}
+
+// bufferBody reads a request body of up to limit bytes into memory so it
+// can be sent more than once. A bigger body is put back together and left
+// streaming, and the request is not retried.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+		return nil, false, nil
+	}
+	return buf, true, nil
+}
+
+// countingReader counts request body bytes as the transport reads them.
+// The transport may still be reading when RoundTrip returns, hence atomic.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
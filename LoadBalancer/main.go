@@ -1,88 +1,293 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
+
+	"loadBalancer/proxyproto"
 )
 
 type Backend struct {
-	Host  string
-	Port  string
-	Total int
+	Host   string
+	Port   string
+	Total  int
+	Weight int
+	Active int
+	// LongLived is the part of Active held by websocket tunnels and event
+	// streams
+	LongLived int
+	Down      bool // set by health checks
+	// Draining backends keep their open connections but get no new ones
+	Draining bool
+	// MaxConns caps concurrent connections; 0 means unlimited
+	MaxConns int
+	// SlowStart ramps the weight up after recovery; nil disables it
+	SlowStart *SlowStart
+
+	BytesIn  int64 // client to backend
+	BytesOut int64 // backend to client
+	Errors   int
+
+	// guarded by the pool
+	current   int // running score for smooth weighted round robin
+	latency   latencyWindow
+	rampStart time.Time // start of the current slow start, zero when done
+	removed   bool      // dropped by discovery, draining until idle
 }
 
-type LB struct {
-	Servers  []Backend
-	LastUsed int
+func (b *Backend) Addr() string {
+	return net.JoinHostPort(b.Host, b.Port)
 }
 
-var mu sync.Mutex
+// available reports whether b may take one more connection.
+func (b *Backend) available() bool {
+	return !b.Down && !b.Draining && (b.MaxConns == 0 || b.Active < b.MaxConns)
+}
+
+func (b *Backend) State() string {
+	switch {
+	case b.Down:
+		return "down"
+	case b.Draining:
+		return "draining"
+	}
+	return "up"
+}
+
+func (b *Backend) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+type LB struct {
+	Mode         string
+	Listen       string
+	Pools        map[string]*Pool
+	Router       *Router
+	Transport    *http.Transport
+	Timeouts     Timeouts
+	DrainTimeout time.Duration
+	Admin        string       // admin API address, empty disables it
+	TLS          *TLS         // nil serves plaintext
+	Limits       *Limits      // nil disables client limits
+	AccessLog    *slog.Logger // nil disables access logs
+	Metrics      *Metrics
+	// AcceptProxyProtocol reads PROXY headers from an upstream balancer;
+	// nil means clients connect directly
+	AcceptProxyProtocol *proxyproto.Listener
+
+	listener   net.Listener
+	packetConn net.PacketConn // udp mode
+	active     sync.WaitGroup
+	connMu     sync.Mutex
+	conns      map[net.Conn]struct{}
+}
 
 func NewLB() *LB {
+	pool := NewPool("default", RoundRobin, []*Backend{
+		{Host: "localhost", Port: "8000"},
+		{Host: "localhost", Port: "9000"},
+	})
 	return &LB{
-		Servers: []Backend{
-			{"localhost", "8000", 0},
-			{"localhost", "9000", 0},
-		},
-		LastUsed: 1,
+		Mode:   "tcp",
+		Listen: ":7878",
+		Pools:  map[string]*Pool{pool.Name: pool},
+		Router: NewRouter(nil, pool.Name),
+
+		Timeouts:     defaultTimeouts,
+		DrainTimeout: 30 * time.Second,
+		Admin:        "localhost:7879",
+		AccessLog:    slog.New(slog.NewJSONHandler(os.Stdout, nil)),
+		Metrics:      NewMetrics(),
 	}
 }
 
 func (lb *LB) Proxy(conn net.Conn, reqId string) {
+	lb.track(conn)
+	defer lb.untrack(conn)
+	defer conn.Close()
 
-	lb.LastUsed = (lb.LastUsed + 1) % len(lb.Servers)
-	var buggy []byte
-	conn.Read(buggy)
-	fmt.Println(conn.RemoteAddr().String(), "\tserver going to be used is ", lb.LastUsed, " request id = ", reqId, "\n", buggy)
-
-	mu.Lock()
-	lb.Servers[lb.LastUsed].Total++
-	backend := lb.Servers[lb.LastUsed]
-	mu.Unlock()
+	pool := lb.Pools[lb.Router.DefaultPool]
+	a := &access{start: time.Now(), mode: "tcp", id: reqId, client: conn.RemoteAddr().String(), pool: pool.Name}
+	defer lb.logAccess(a)
+	if lb.TLS != nil {
+		serverName, clientConn, err := lb.clientTLS(conn)
+		if err != nil {
+			a.err = fmt.Errorf("tls handshake: %w", err)
+			return
+		}
+		conn = clientConn
+		if name := lb.TLS.poolFor(serverName); name != "" {
+			pool = lb.Pools[name]
+			a.pool = name
+		}
+	}
+	key := ""
+	if pool.Sticky != nil {
+		key = pool.Sticky.connKey(conn)
+	}
+	backend, err := pool.Pick(key)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 500 InternalServerError\r\n\r\nbackend server not avialable"))
+		a.err = err
+		return
+	}
+	defer pool.Done(backend)
+	a.backend = backend.Addr()
 
-	backendConn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", backend.Host, backend.Port))
+	dialStart := time.Now()
+	backendConn, err := lb.dialBackend(pool, backend, conn)
 	if err != nil {
+		pool.Observe(backend, 0, 0, 0, true)
 		conn.Write([]byte("HTTP/1.1 500 InternalServerError\r\n\r\nbackend server not avialable"))
-		log.Fatal("err while dailing on host:port ", fmt.Sprintf("%s:%s", backend.Host, backend.Port), " => ", err)
+		a.err = fmt.Errorf("dailing %s: %w", backend.Addr(), err)
+		return
 	}
-	// fmt.Println(reqId, "\t", "going to copy the content from conn to backendConn")
-	go func() {
-		_, err := io.Copy(backendConn, conn)
+	connectTime := time.Since(dialStart)
+	lb.track(backendConn)
+	defer lb.untrack(backendConn)
+	defer backendConn.Close()
+
+	a.bytesIn, a.bytesOut = lb.splice(conn, backendConn)
+	pool.Observe(backend, a.bytesIn, a.bytesOut, connectTime, false)
+}
+
+func main() {
+	configPath := flag.String("config", "", "JSON config file (see lb.json); without it the lb proxies tcp on :7878 to localhost:8000 and localhost:9000")
+	flag.Parse()
+
+	lb := NewLB()
+	if *configPath != "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal("err while loading config => ", err)
+		}
+		lb, err = NewLBFromConfig(cfg)
 		if err != nil {
-			conn.Write([]byte("HTTP/1.1 500 InternalServerError\r\n\r\nbackend server not avialable"))
-			log.Fatal("err while coping ", err)
+			log.Fatal("err in config => ", err)
+		}
+	}
 
+	for _, pool := range lb.Pools {
+		if pool.Discovery != nil {
+			pool.Discover()
+			go pool.RunDiscovery()
 		}
-		// fmt.Println(reqId, "\t", copiedBytes, "going to copy the content from backendConn to conn")
+		go pool.RunHealthChecks()
+	}
 
-	}()
-	go func() {
-		_, err := io.Copy(conn, backendConn)
-		if err != nil {
-			conn.Write([]byte("HTTP/1.1 500 InternalServerError\r\n\r\nbackend server not avialable"))
-			log.Fatal("err while coping ", err)
+	if lb.Admin != "" {
+		go func() {
+			fmt.Println("admin api listening on ", lb.Admin)
+			if err := http.ListenAndServe(lb.Admin, lb.AdminHandler()); err != nil {
+				log.Fatal("err while starting admin api => ", err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	if lb.Mode == "udp" {
+		pc, err := net.ListenPacket("udp", lb.Listen)
+		if err != nil {
+			log.Fatal("err while listening on ", lb.Listen, " => ", err)
 		}
-		// fmt.Printsln(reqId, "\t", copiedBytes, "conn: successfully copied from backendConn")
-	}()
-	// conn.Close()
-}
+		go func() {
+			fmt.Println("udp load balancer listening on ", lb.Listen)
+			if err := lb.ServeUDP(pc); err != nil {
+				log.Fatal("err while reading datagrams on ", lb.Listen, " => ", err)
+			}
+		}()
+		<-stop
+		// replies can no longer reach clients once the socket is closed, so
+		// there is nothing to drain
+		fmt.Println("shutting down")
+		lb.Shutdown(0)
+		return
+	}
 
-func main() {
-	lb := NewLB()
-	listener, err := net.Listen("tcp", ":7878")
+	listener, err := net.Listen("tcp", lb.Listen)
 	if err != nil {
-		log.Fatal("err while listening on port 7878 => ", err)
+		log.Fatal("err while listening on ", lb.Listen, " => ", err)
 	}
-	for {
-		connection, err := listener.Accept()
-		if err != nil {
-			log.Fatal("err while accepting connectiong on port 7878 => ", err)
+	if pl := lb.AcceptProxyProtocol; pl != nil {
+		pl.Listener = listener
+		listener = pl
+	}
+	if lb.Limits != nil {
+		listener = &limitListener{Listener: listener, limits: lb.Limits, http: lb.Mode == "http", tls: lb.TLS != nil}
+	}
+
+	if lb.Mode == "http" {
+		lb.Transport = &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: lb.Timeouts.Connect}).DialContext,
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
 		}
-		go lb.Proxy(connection, time.Now().String())
+		for _, pool := range lb.Pools {
+			pool.Transport = lb.Transport
+			if pool.BackendTLS != nil || pool.SendProxyProtocol > 0 {
+				pool.Transport = lb.Transport.Clone()
+				pool.Transport.TLSClientConfig = pool.BackendTLS
+			}
+			if pool.SendProxyProtocol > 0 {
+				pool.Transport.DisableKeepAlives = true
+				pool.Transport.DialContext = lb.proxyProtocolDialer(pool.SendProxyProtocol)
+			}
+		}
+		server := &http.Server{
+			Handler:           lb,
+			ReadHeaderTimeout: lb.Timeouts.Read,
+			IdleTimeout:       lb.Timeouts.Idle,
+		}
+		go func() {
+			var err error
+			if lb.TLS != nil {
+				server.TLSConfig = lb.TLS.Config
+				fmt.Println("https load balancer listening on ", lb.Listen)
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				fmt.Println("http load balancer listening on ", lb.Listen)
+				err = server.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		<-stop
+		fmt.Println("shutting down, draining for up to ", lb.DrainTimeout)
+		deadline := time.Now().Add(lb.DrainTimeout)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Println("drain deadline reached => ", err)
+			server.Close()
+		}
+		// websocket tunnels were hijacked from the server, wait for them too
+		lb.Shutdown(time.Until(deadline))
+		return
 	}
+
+	go func() {
+		fmt.Println("tcp load balancer listening on ", lb.Listen)
+		if err := lb.ServeTCP(listener); err != nil {
+			log.Fatal("err while accepting connectiong on ", lb.Listen, " => ", err)
+		}
+	}()
+	<-stop
+	fmt.Println("shutting down, draining for up to ", lb.DrainTimeout)
+	lb.Shutdown(lb.DrainTimeout)
 }
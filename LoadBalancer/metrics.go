@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// duration buckets in seconds, the Prometheus client defaults
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets)+1)
+	}
+	i := sort.SearchFloat64s(durationBuckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+type backendKey struct{ pool, backend string }
+
+type backendMetrics struct {
+	requests, errors  uint64
+	bytesIn, bytesOut int64
+	duration          histogram
+}
+
+type routeKey struct{ route, code string }
+
+// Metrics counts traffic per backend and per http route and serves it in
+// the Prometheus text format on the admin listener at /metrics.
+type Metrics struct {
+	mu            sync.Mutex
+	backends      map[backendKey]*backendMetrics
+	routes        map[routeKey]uint64
+	routeDuration map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		backends:      make(map[backendKey]*backendMetrics),
+		routes:        make(map[routeKey]uint64),
+		routeDuration: make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) observe(a *access, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a.backend != "" {
+		k := backendKey{a.pool, a.backend}
+		bm := m.backends[k]
+		if bm == nil {
+			bm = &backendMetrics{}
+			m.backends[k] = bm
+		}
+		bm.requests++
+		if a.err != nil || a.status >= 500 {
+			bm.errors++
+		}
+		bm.bytesIn += a.bytesIn
+		bm.bytesOut += a.bytesOut
+		bm.duration.observe(duration.Seconds())
+	}
+	if a.route != "" {
+		m.routes[routeKey{a.route, strconv.Itoa(a.status)}]++
+		h := m.routeDuration[a.route]
+		if h == nil {
+			h = &histogram{}
+			m.routeDuration[a.route] = h
+		}
+		h.observe(duration.Seconds())
+	}
+}
+
+// labels formats name="value" pairs, escaping values as the text format
+// requires.
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		fmt.Fprintf(&b, "%s=\"%s\"", kv[i], v)
+	}
+	return b.String()
+}
+
+func writeHistogram(w io.Writer, name, lbls string, h *histogram) {
+	var cumulative uint64
+	for i, le := range durationBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, lbls, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, lbls, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, lbls, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, lbls, h.count)
+}
+
+func (m *Metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	backends := make([]backendKey, 0, len(m.backends))
+	for k := range m.backends {
+		backends = append(backends, k)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].pool != backends[j].pool {
+			return backends[i].pool < backends[j].pool
+		}
+		return backends[i].backend < backends[j].backend
+	})
+	counters := []struct {
+		name, help string
+		value      func(*backendMetrics) int64
+	}{
+		{"lb_backend_requests_total", "Requests (http) or connections (tcp) sent to a backend.", func(bm *backendMetrics) int64 { return int64(bm.requests) }},
+		{"lb_backend_errors_total", "Requests or connections to a backend that failed.", func(bm *backendMetrics) int64 { return int64(bm.errors) }},
+		{"lb_backend_bytes_in_total", "Bytes sent from clients to a backend.", func(bm *backendMetrics) int64 { return bm.bytesIn }},
+		{"lb_backend_bytes_out_total", "Bytes sent from a backend to clients.", func(bm *backendMetrics) int64 { return bm.bytesOut }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, k := range backends {
+			fmt.Fprintf(w, "%s{%s} %d\n", c.name, labels("pool", k.pool, "backend", k.backend), c.value(m.backends[k]))
+		}
+	}
+	fmt.Fprintf(w, "# HELP lb_backend_duration_seconds Duration of requests or connections to a backend.\n# TYPE lb_backend_duration_seconds histogram\n")
+	for _, k := range backends {
+		writeHistogram(w, "lb_backend_duration_seconds", labels("pool", k.pool, "backend", k.backend), &m.backends[k].duration)
+	}
+
+	routes := make([]routeKey, 0, len(m.routes))
+	for k := range m.routes {
+		routes = append(routes, k)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].code < routes[j].code
+	})
+	fmt.Fprintf(w, "# HELP lb_route_requests_total HTTP requests per route and response status.\n# TYPE lb_route_requests_total counter\n")
+	for _, k := range routes {
+		fmt.Fprintf(w, "lb_route_requests_total{%s} %d\n", labels("route", k.route, "code", k.code), m.routes[k])
+	}
+	names := make([]string, 0, len(m.routeDuration))
+	for name := range m.routeDuration {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "# HELP lb_route_duration_seconds Duration of HTTP requests per route.\n# TYPE lb_route_duration_seconds histogram\n")
+	for _, name := range names {
+		writeHistogram(w, "lb_route_duration_seconds", labels("route", name), m.routeDuration[name])
+	}
+}
+
+// adminMetrics serves the counters along with gauges read from the pools.
+func (lb *LB) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	names := make([]string, 0, len(lb.Pools))
+	for name := range lb.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]PoolStats, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, lb.Pools[name].Stats())
+	}
+	fmt.Fprintf(w, "# HELP lb_backend_active_connections Open connections per backend.\n# TYPE lb_backend_active_connections gauge\n")
+	for _, ps := range stats {
+		for _, b := range ps.Backends {
+			fmt.Fprintf(w, "lb_backend_active_connections{%s} %d\n", labels("pool", ps.Name, "backend", b.Addr), b.Active)
+		}
+	}
+	fmt.Fprintf(w, "# HELP lb_backend_up Whether a backend takes new connections.\n# TYPE lb_backend_up gauge\n")
+	for _, ps := range stats {
+		for _, b := range ps.Backends {
+			up := 0
+			if b.State == "up" {
+				up = 1
+			}
+			fmt.Fprintf(w, "lb_backend_up{%s} %d\n", labels("pool", ps.Name, "backend", b.Addr), up)
+		}
+	}
+	if lb.Metrics != nil {
+		lb.Metrics.writeTo(w)
+	}
+}
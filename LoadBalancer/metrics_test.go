@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []float64{0.001, 0.005, 0.2, 3, 60} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	writeHistogram(&b, "d", `route="api"`, &h)
+	for _, want := range []string{
+		// a value on a bound counts in that bucket
+		`d_bucket{route="api",le="0.005"} 2`,
+		`d_bucket{route="api",le="0.1"} 2`,
+		`d_bucket{route="api",le="0.25"} 3`,
+		`d_bucket{route="api",le="5"} 4`,
+		`d_bucket{route="api",le="10"} 4`,
+		`d_bucket{route="api",le="+Inf"} 5`,
+		`d_sum{route="api"} 63.206`,
+		`d_count{route="api"} 5`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("no %s in\n%s", want, b.String())
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	got := labels("route", `a"b\c`+"\n", "code", "200")
+	if want := `route="a\"b\\c\n",code="200"`; got != want {
+		t.Errorf("labels = %s, want %s", got, want)
+	}
+}
+
+// meteredLB is an http balancer with metrics and a json access log over an
+// ok and a failing backend, with /api routed to the ok one.
+func meteredLB(t *testing.T) (*LB, *bytes.Buffer, *Backend, *Backend) {
+	ok := httpBackend(t, reply(http.StatusOK, "ok", new(atomic.Int32)))
+	failing := httpBackend(t, reply(http.StatusInternalServerError, "failing", new(atomic.Int32)))
+	lb := testLB(NewPool("web", RoundRobin, []*Backend{failing}), NewPool("api", RoundRobin, []*Backend{ok}))
+	lb.Router = NewRouter([]*Route{{Name: "api", Pool: "api", PathPrefix: "/api"}}, "web")
+	lb.Metrics = NewMetrics()
+	var log bytes.Buffer
+	lb.AccessLog = slog.New(slog.NewJSONHandler(&log, nil))
+	startHTTP(t, lb)
+	return lb, &log, ok, failing
+}
+
+func serve(lb *LB, method, target string) {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	lb.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	lb, _, ok, failing := meteredLB(t)
+	serve(lb, "GET", "/api/a")
+	serve(lb, "GET", "/api/b")
+	serve(lb, "GET", "/")
+	failing.Down = true
+
+	w := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	okLabels := `pool="api",backend="` + ok.Addr() + `"`
+	failingLabels := `pool="web",backend="` + failing.Addr() + `"`
+	for _, want := range []string{
+		"# TYPE lb_backend_requests_total counter",
+		"lb_backend_requests_total{" + okLabels + "} 2",
+		"lb_backend_requests_total{" + failingLabels + "} 1",
+		"lb_backend_errors_total{" + okLabels + "} 0",
+		"lb_backend_errors_total{" + failingLabels + "} 1",
+		"lb_backend_bytes_out_total{" + okLabels + "} 4",
+		"lb_backend_duration_seconds_count{" + okLabels + "} 2",
+		"lb_backend_active_connections{" + okLabels + "} 0",
+		"lb_backend_up{" + okLabels + "} 1",
+		"lb_backend_up{" + failingLabels + "} 0",
+		`lb_route_requests_total{route="api",code="200"} 2`,
+		`lb_route_requests_total{route="default",code="500"} 1`,
+		`lb_route_duration_seconds_count{route="api"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("no %s in\n%s", want, body)
+		}
+	}
+	if ct := w.Header().Get("content-type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content-type %q", ct)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	lb, log, ok, failing := meteredLB(t)
+	start := time.Now()
+	serve(lb, "GET", "/api/a")
+	serve(lb, "POST", "/")
+
+	var entries []map[string]interface{}
+	dec := json.NewDecoder(log)
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(entries))
+	}
+	for i, want := range []map[string]interface{}{
+		{"level": "INFO", "msg": "access", "mode": "http", "id": "req-1", "route": "api", "pool": "api", "backend": ok.Addr(), "method": "GET", "path": "/api/a", "status": 200.0, "bytesOut": 2.0},
+		{"level": "INFO", "mode": "http", "route": "default", "pool": "web", "backend": failing.Addr(), "method": "POST", "path": "/", "status": 500.0, "bytesOut": 7.0},
+	} {
+		for k, v := range want {
+			if entries[i][k] != v {
+				t.Errorf("entry %d: %s = %v, want %v", i+1, k, entries[i][k], v)
+			}
+		}
+		if d, _ := entries[i]["durationMs"].(float64); d <= 0 || d > millis(time.Since(start)) {
+			t.Errorf("entry %d: durationMs %v", i+1, entries[i]["durationMs"])
+		}
+	}
+
+	// a request no backend could take is logged as an error
+	failing.Down = true
+	log.Reset()
+	serve(lb, "GET", "/")
+	var e map[string]interface{}
+	if err := json.Unmarshal(log.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e["level"] != "ERROR" || e["status"] != 503.0 || e["error"] == nil || e["backend"] != "" {
+		t.Errorf("entry for an unavailable pool %v", e)
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	for _, format := range []string{"", "json", "text"} {
+		if _, err := newAccessLog("", format); err != nil {
+			t.Errorf("format %q: %v", format, err)
+		}
+	}
+	if _, err := newAccessLog("", "xml"); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// balancing algorithms understood by a Pool
+const (
+	RoundRobin         = "round_robin"
+	WeightedRoundRobin = "weighted_round_robin"
+	LeastConnections   = "least_connections"
+)
+
+var (
+	errNoBackend      = errors.New("no backend server avialable")
+	errPinnedBusy     = errors.New("pinned backend is draining or at its connection cap")
+	errUnknownBackend = errors.New("unknown backend")
+	// errDiscoveryOwned refuses changes that the next discovery poll would
+	// silently undo
+	errDiscoveryOwned = errors.New("backends of this pool come from discovery")
+)
+
+// Pool is a named group of backends that share one balancing algorithm.
+// Routes point at pools by name.
+type Pool struct {
+	Name        string
+	Algorithm   string
+	Servers     []*Backend
+	LastUsed    int
+	Sticky      *Sticky
+	HealthCheck HealthCheck
+	// BackendTLS re-encrypts traffic to the backends when set
+	BackendTLS *tls.Config
+	Transport  *http.Transport // http mode only
+	// SendProxyProtocol is the PROXY protocol version (1 or 2) announced to
+	// backends, 0 for none
+	SendProxyProtocol int
+	Retry             *RetryPolicy // http mode only, nil disables retries
+	// SlowStart is given to backends added without one
+	SlowStart *SlowStart
+	// Discovery, when set, owns Servers and is polled every
+	// DiscoveryInterval
+	Discovery         Discovery
+	DiscoveryInterval time.Duration
+
+	mu      sync.Mutex
+	latency latencyWindow // all backends, drives hedging
+	// hedgeAt is the hedge delay worked out when latency had
+	// hedgeAtSamples samples added
+	hedgeAt        time.Duration
+	hedgeAtSamples int
+}
+
+func NewPool(name, algorithm string, servers []*Backend) *Pool {
+	if algorithm == "" {
+		algorithm = RoundRobin
+	}
+	return &Pool{
+		Name:        name,
+		Algorithm:   algorithm,
+		Servers:     servers,
+		LastUsed:    len(servers) - 1,
+		HealthCheck: defaultHealthCheck,
+	}
+}
+
+// SetSticky enables session affinity on the pool.
+func (p *Pool) SetSticky(s *Sticky) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Sticky = s
+	s.rebuildRing(p.Servers)
+}
+
+func validAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "", RoundRobin, WeightedRoundRobin, LeastConnections:
+		return true
+	}
+	return false
+}
+
+// Next picks a backend using the pool's algorithm and counts a new
+// connection on it. Every successful Next must be paired with a Done.
+func (p *Pool) Next() (*Backend, error) {
+	return p.Pick("")
+}
+
+// Pick is Next for a client carrying an affinity key (see Sticky). An empty
+// key or a pool without stickiness falls back to the algorithm.
+func (p *Pool) Pick(key string) (*Backend, error) {
+	return p.PickExcept(key, nil)
+}
+
+// PickExcept is Pick that never returns one of skip, used to send a retry
+// or a hedged request somewhere else.
+func (p *Pool) PickExcept(key string, skip []*Backend) (*Backend, error) {
+	return p.pick(key, skip, false)
+}
+
+// PickLongLived is Pick for a connection known to stay open, such as a
+// websocket tunnel; it is counted as long-lived from the start and must be
+// paired with DoneLongLived.
+func (p *Pool) PickLongLived(key string) (*Backend, error) {
+	return p.pick(key, nil, true)
+}
+
+func (p *Pool) pick(key string, skip []*Backend, longLived bool) (*Backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var backend *Backend
+	if p.Sticky != nil {
+		backend = p.Sticky.pick(key, p.Servers)
+		if containsBackend(skip, backend) {
+			backend = nil
+		}
+		if backend != nil && !backend.available() {
+			return nil, errPinnedBusy
+		}
+	}
+	if backend == nil {
+		backend = p.next(skip, longLived)
+	}
+	if backend == nil {
+		return nil, errNoBackend
+	}
+	backend.Total++
+	backend.Active++
+	if longLived {
+		backend.LongLived++
+	}
+	return backend, nil
+}
+
+// next applies the algorithm to the backends that are up, below their
+// connection cap and not in skip. Called with the lock held.
+func (p *Pool) next(skip []*Backend, longLived bool) *Backend {
+	switch p.Algorithm {
+	case WeightedRoundRobin:
+		return p.weightedRoundRobin(skip)
+	case LeastConnections:
+		return p.leastConnections(skip, longLived)
+	}
+	for i := 0; i < len(p.Servers); i++ {
+		p.LastUsed = (p.LastUsed + 1) % len(p.Servers)
+		if b := p.Servers[p.LastUsed]; b.available() && !containsBackend(skip, b) {
+			return p.Servers[p.LastUsed]
+		}
+	}
+	return nil
+}
+
+// Done marks the end of a connection handed out by Next.
+func (p *Pool) Done(backend *Backend) {
+	p.mu.Lock()
+	backend.Active--
+	p.mu.Unlock()
+}
+
+// MarkLongLived moves a connection that turned out to stay open (an event
+// stream) into the long-lived group. It then ends with DoneLongLived.
+func (p *Pool) MarkLongLived(backend *Backend) {
+	p.mu.Lock()
+	backend.LongLived++
+	p.mu.Unlock()
+}
+
+func (p *Pool) DoneLongLived(backend *Backend) {
+	p.mu.Lock()
+	backend.Active--
+	backend.LongLived--
+	p.mu.Unlock()
+}
+
+// weightedRoundRobin is the smooth variant used by nginx: every pick adds
+// each weight to its running score, the highest score wins and pays back
+// the total, so heavy backends are spread out instead of served in bursts.
+func (p *Pool) weightedRoundRobin(skip []*Backend) *Backend {
+	total := 0
+	now := time.Now()
+	var best *Backend
+	for _, b := range p.Servers {
+		if !b.available() || containsBackend(skip, b) {
+			continue
+		}
+		w := b.effectiveWeight(now)
+		b.current += w
+		total += w
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// leastConnections picks the backend with the fewest active connections
+// relative to its weight. Long-lived connections (websockets, event
+// streams) mostly sit idle, so they are counted apart: short requests are
+// balanced on short-lived connections and long-lived ones on long-lived
+// connections, each breaking ties with the other count.
+func (p *Pool) leastConnections(skip []*Backend, longLived bool) *Backend {
+	load := func(b *Backend) (int, int) {
+		short := b.Active - b.LongLived
+		if longLived {
+			return b.LongLived, short
+		}
+		return short, b.LongLived
+	}
+	now := time.Now()
+	var best *Backend
+	bestWeight := 0
+	for _, b := range p.Servers {
+		if !b.available() || containsBackend(skip, b) {
+			continue
+		}
+		w := b.effectiveWeight(now)
+		if best == nil {
+			best, bestWeight = b, w
+			continue
+		}
+		// compare a/wa < b/wb without dividing
+		primary, secondary := load(b)
+		bestPrimary, bestSecondary := load(best)
+		lhs, rhs := primary*bestWeight, bestPrimary*w
+		if lhs < rhs || (lhs == rhs && secondary*bestWeight < bestSecondary*w) {
+			best, bestWeight = b, w
+		}
+	}
+	return best
+}
+
+// Add puts a new backend into rotation.
+func (p *Pool) Add(backend *Backend) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Discovery != nil {
+		return fmt.Errorf("%w, cannot add %s to pool %s", errDiscoveryOwned, backend.Addr(), p.Name)
+	}
+	for _, b := range p.Servers {
+		if b.Addr() == backend.Addr() {
+			return fmt.Errorf("backend %s already in pool %s", backend.Addr(), p.Name)
+		}
+	}
+	if backend.SlowStart == nil {
+		backend.SlowStart = p.SlowStart
+	}
+	backend.startRamp(time.Now())
+	p.Servers = append(p.Servers, backend)
+	p.serversChanged()
+	return nil
+}
+
+// Remove takes a backend out of rotation. Connections already on it are
+// left to finish.
+func (p *Pool) Remove(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Discovery != nil {
+		return fmt.Errorf("%w, cannot remove %s from pool %s", errDiscoveryOwned, addr, p.Name)
+	}
+	for i, b := range p.Servers {
+		if b.Addr() == addr {
+			p.Servers = append(p.Servers[:i:i], p.Servers[i+1:]...)
+			p.serversChanged()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s in pool %s", errUnknownBackend, addr, p.Name)
+}
+
+// SetWeight changes the weight of a backend. Discovery sets the weights of
+// its pools itself.
+func (p *Pool) SetWeight(addr string, weight int) error {
+	return p.update(addr, func(b *Backend) error {
+		if p.Discovery != nil {
+			return fmt.Errorf("%w, cannot set the weight of %s in pool %s", errDiscoveryOwned, addr, p.Name)
+		}
+		b.Weight = weight
+		return nil
+	})
+}
+
+// SetDraining stops (or resumes) new connections to a backend while
+// leaving its open ones alone. A backend discovery dropped stays drained
+// until it is found again.
+func (p *Pool) SetDraining(addr string, draining bool) error {
+	return p.update(addr, func(b *Backend) error {
+		if b.removed && !draining {
+			return fmt.Errorf("%w, %s is no longer found in pool %s", errDiscoveryOwned, addr, p.Name)
+		}
+		if b.Draining && !draining {
+			b.startRamp(time.Now())
+		}
+		b.Draining = draining
+		return nil
+	})
+}
+
+func (p *Pool) update(addr string, f func(*Backend) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.Servers {
+		if b.Addr() == addr {
+			if err := f(b); err != nil {
+				return err
+			}
+			p.serversChanged()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s in pool %s", errUnknownBackend, addr, p.Name)
+}
+
+// serversChanged resets per-pool bookkeeping after a membership or weight
+// change. Called with the lock held.
+func (p *Pool) serversChanged() {
+	if len(p.Servers) > 0 {
+		p.LastUsed %= len(p.Servers)
+	} else {
+		p.LastUsed = -1
+	}
+	for _, b := range p.Servers {
+		b.current = 0
+	}
+	if p.Sticky != nil {
+		p.Sticky.rebuildRing(p.Servers)
+	}
+}
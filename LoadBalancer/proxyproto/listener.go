@@ -0,0 +1,161 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener strips PROXY headers from accepted connections and reports the
+// client address they carry as the connection's RemoteAddr. Headers are
+// read in the background, so a slow client never holds up Accept.
+type Listener struct {
+	net.Listener
+	// Required drops connections without a header; otherwise they are
+	// passed on untouched, including those that send nothing within
+	// HeaderTimeout (protocols where the server speaks first).
+	Required bool
+	// Trusted lists the peers allowed to send a header, e.g. the
+	// balancer's address. Connections from anyone else are passed on
+	// untouched. Empty trusts nobody; 0.0.0.0/0 and ::/0 trust everyone.
+	Trusted []*net.IPNet
+	// HeaderTimeout bounds the wait for the header, 5s when zero.
+	HeaderTimeout time.Duration
+
+	once      sync.Once
+	closeOnce sync.Once
+	ready     chan net.Conn
+	errc      chan error
+	done      chan struct{}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	l.once.Do(l.start)
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case err := <-l.errc:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(l.start)
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *Listener) start() {
+	l.ready = make(chan net.Conn)
+	l.errc = make(chan error)
+	l.done = make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Listener.Accept()
+			if err != nil {
+				select {
+				case l.errc <- err:
+				case <-l.done:
+					return
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					continue
+				}
+				return
+			}
+			go l.handshake(conn)
+		}
+	}()
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	if !l.trusted(conn.RemoteAddr()) {
+		l.deliver(conn)
+		return
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	if _, err := r.Peek(1); err != nil {
+		conn.SetReadDeadline(time.Time{})
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() && !l.Required {
+			// nothing was read, the peer waits for us to speak
+			l.deliver(&Conn{Conn: conn, r: r})
+			return
+		}
+		conn.Close()
+		return
+	}
+	h, err := Read(r)
+	conn.SetReadDeadline(time.Time{})
+	if err == ErrNoHeader && !l.Required {
+		l.deliver(&Conn{Conn: conn, r: r})
+		return
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	l.deliver(&Conn{Conn: conn, r: r, Header: h})
+}
+
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.ready <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *Listener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose PROXY header has been consumed.
+type Conn struct {
+	net.Conn
+	Header *Header // nil when the peer sent none
+	r      *bufio.Reader
+}
+
+func (c *Conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header != nil && c.Header.Source != nil {
+		return c.Header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header != nil && c.Header.Destination != nil {
+		return c.Header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying tcp connection.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
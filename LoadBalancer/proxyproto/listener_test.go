@@ -0,0 +1,137 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve wraps a loopback listener in l and returns its address and the
+// accepted connections.
+func serve(t *testing.T, l *Listener) (string, <-chan net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Listener = inner
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	return inner.Addr().String(), accepted
+}
+
+func accept(t *testing.T, accepted <-chan net.Conn) net.Conn {
+	t.Helper()
+	select {
+	case c := <-accepted:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func loopback(t *testing.T) []*net.IPNet {
+	_, n, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*net.IPNet{n}
+}
+
+const forged = "PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\n"
+
+func TestListenerTrustsNobodyByDefault(t *testing.T) {
+	addr, accepted := serve(t, &Listener{})
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte(forged + "hello\n"))
+
+	c := accept(t, accepted)
+	if strings.HasPrefix(c.RemoteAddr().String(), "203.0.113.7") {
+		t.Fatalf("untrusted peer forged its address as %s", c.RemoteAddr())
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != forged {
+		t.Errorf("the header of an untrusted peer was not passed on untouched, read %q, %v", line, err)
+	}
+}
+
+func TestListenerReadsTrustedHeader(t *testing.T) {
+	addr, accepted := serve(t, &Listener{Trusted: loopback(t), Required: true})
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte(forged + "hello\n"))
+
+	c := accept(t, accepted)
+	if got := c.RemoteAddr().String(); got != "203.0.113.7:4000" {
+		t.Errorf("RemoteAddr is %s, want the client from the header", got)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("read %q, %v after the header, want hello", line, err)
+	}
+}
+
+func TestListenerPassesSilentPeerThrough(t *testing.T) {
+	addr, accepted := serve(t, &Listener{Trusted: loopback(t), HeaderTimeout: 50 * time.Millisecond})
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the server speaks first, the client only answers
+	c := accept(t, accepted)
+	if _, err := c.Write([]byte("220 ready\n")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	greeting, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || greeting != "220 ready\n" {
+		t.Fatalf("client read %q, %v", greeting, err)
+	}
+	client.Write([]byte("HELO\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "HELO\n" {
+		t.Errorf("server read %q, %v, want HELO", line, err)
+	}
+}
+
+func TestListenerRequiredDropsSilentPeer(t *testing.T) {
+	addr, accepted := serve(t, &Listener{Trusted: loopback(t), Required: true, HeaderTimeout: 50 * time.Millisecond})
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("a peer without a header stayed connected")
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Error("a peer without a header was accepted")
+	default:
+	}
+}
@@ -0,0 +1,204 @@
+// Package proxyproto reads and writes HAProxy PROXY protocol headers
+// (versions 1 and 2) so a server behind a tcp balancer can see the address
+// of the real client instead of the balancer's.
+//
+// Backends wrap their listener:
+//
+//	l, _ := net.Listen("tcp", ":8000")
+//	_, balancer, _ := net.ParseCIDR("10.0.0.5/32")
+//	http.Serve(&proxyproto.Listener{Listener: l, Trusted: []*net.IPNet{balancer}}, nil)
+//
+// and r.RemoteAddr becomes the client address sent by the balancer. Only
+// Trusted peers are believed, anyone else could forge their address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// v2 signature, the first 12 bytes of every version 2 header
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrNoHeader is returned by Read when the stream does not start with a
+	// PROXY header.
+	ErrNoHeader = errors.New("proxyproto: no PROXY header")
+	ErrInvalid  = errors.New("proxyproto: invalid PROXY header")
+)
+
+// Header is one PROXY protocol header. Source and Destination are nil for
+// LOCAL (health check) connections and for v1 UNKNOWN.
+type Header struct {
+	Version     int // 1 or 2
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// HeaderFor describes a proxied connection from client to the balancer
+// address local.
+func HeaderFor(version int, client, local net.Addr) *Header {
+	h := &Header{Version: version}
+	src, ok1 := client.(*net.TCPAddr)
+	dst, ok2 := local.(*net.TCPAddr)
+	if ok1 && ok2 {
+		h.Source, h.Destination = src, dst
+	}
+	return h
+}
+
+// WriteTo writes h in its version's wire format.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	if h.Version == 2 {
+		buf = h.v2()
+	} else {
+		buf = []byte(h.v1())
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (h *Header) v1() string {
+	if h.Local || h.Source == nil || h.Destination == nil {
+		return "PROXY UNKNOWN\r\n"
+	}
+	proto := "TCP4"
+	if h.Source.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, h.Source.IP, h.Destination.IP, h.Source.Port, h.Destination.Port)
+}
+
+func (h *Header) v2() []byte {
+	buf := append([]byte(nil), signature...)
+	if h.Local || h.Source == nil || h.Destination == nil {
+		// LOCAL command, unspecified family, no addresses
+		return append(buf, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x11) // TCP over IPv4
+	if src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4(); src4 != nil && dst4 != nil {
+		addrs = append(append(addrs, src4...), dst4...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addrs = append(append(addrs, h.Source.IP.To16()...), h.Destination.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Source.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Destination.Port))
+
+	buf = append(buf, 0x21, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+	return append(buf, addrs...)
+}
+
+// Read parses a v1 or v2 header from the start of r. It only consumes
+// bytes when a header is present, so on ErrNoHeader the stream is intact.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case '\r':
+		prefix, err := r.Peek(len(signature))
+		if err != nil || !bytes.Equal(prefix, signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// a v1 line is at most 107 bytes including CRLF
+const v1MaxLen = 107
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalid
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalid
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalid
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalid
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch verCmd & 0x0f {
+	case 0x0:
+		h.Local = true
+		return h, nil
+	case 0x1:
+	default:
+		return nil, ErrInvalid
+	}
+	// only the address block matters; trailing TLVs are skipped
+	switch family >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, ErrInvalid
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+	case 0x2:
+		if len(body) < 36 {
+			return nil, ErrInvalid
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+	}
+	return h, nil
+}
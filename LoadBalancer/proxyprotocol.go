@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"loadBalancer/proxyproto"
+)
+
+// clientAddrsKey carries the client and balancer addresses of an http
+// request down to the transport's dialer.
+type clientAddrsKey struct{}
+
+type clientAddrs struct {
+	client, local net.Addr
+}
+
+// writeProxyHeader tells the backend on conn who the client of clientConn
+// is. Must run before anything else is sent, including a TLS handshake.
+func writeProxyHeader(conn net.Conn, version int, clientConn net.Conn) error {
+	_, err := proxyproto.HeaderFor(version, clientConn.RemoteAddr(), clientConn.LocalAddr()).WriteTo(conn)
+	return err
+}
+
+// withClientAddrs stores the addresses of r for proxyProtocolDialer.
+func withClientAddrs(r *http.Request, out *http.Request) *http.Request {
+	client, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return out
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return out.WithContext(context.WithValue(out.Context(), clientAddrsKey{}, clientAddrs{client, local}))
+}
+
+// proxyProtocolDialer opens backend connections that start with a PROXY
+// header for the request's client. The header belongs to one client, so
+// transports using it must not reuse connections.
+func (lb *LB) proxyProtocolDialer(version int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return proxyHeaderDialer(&net.Dialer{Timeout: lb.Timeouts.Connect}, version)
+}
+
+// proxyHeaderDialer dials with dialer and writes the header of the client
+// found in the context, or a LOCAL header (a health check) without one.
+func proxyHeaderDialer(dialer *net.Dialer, version int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		h := &proxyproto.Header{Version: version, Local: true}
+		if addrs, ok := ctx.Value(clientAddrsKey{}).(clientAddrs); ok {
+			h = proxyproto.HeaderFor(version, addrs.client, addrs.local)
+		}
+		if _, err := h.WriteTo(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("writing proxy header: %w", err)
+		}
+		return conn, nil
+	}
+}
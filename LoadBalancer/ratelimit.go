@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits protects the backends from a single client. Rate and Burst set a
+// token bucket per key (every http request or, in tcp mode, every new
+// connection takes a token); MaxConnsPerIP caps concurrent connections from
+// one source address. Clients over a limit get Status/Body with Retry-After
+// in http mode and an immediate close in tcp mode, or when a connection
+// over the cap would still have to finish its tls handshake.
+type Limits struct {
+	Rate          float64 // tokens per second, 0 disables the bucket
+	Burst         int
+	Key           string // "ip" or "header:<name>"; tcp mode always uses ip
+	MaxConnsPerIP int    // 0 disables the cap
+	Status        int
+	Body          string
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	conns     map[string]int
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLimits() *Limits {
+	return &Limits{
+		Status:  http.StatusTooManyRequests,
+		Body:    "too many requests",
+		buckets: make(map[string]*bucket),
+		conns:   make(map[string]int),
+	}
+}
+
+// take spends one token for key and, when none is left, reports how long
+// until the next one.
+func (l *Limits) take(key string) (bool, time.Duration) {
+	if l.Rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely; they behave exactly
+// like new ones. Called with the lock held.
+func (l *Limits) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *Limits) requestKey(r *http.Request) string {
+	if strings.HasPrefix(l.Key, "header:") {
+		if v := r.Header.Get(strings.TrimPrefix(l.Key, "header:")); v != "" {
+			return v
+		}
+	}
+	return clientIP(r.RemoteAddr)
+}
+
+// AllowRequest applies the token bucket to an http request and writes the
+// over-limit response when it is refused.
+func (l *Limits) AllowRequest(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := l.take(l.requestKey(r))
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", retryAfter(wait))
+	http.Error(w, l.Body, l.Status)
+	return false
+}
+
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+func (l *Limits) openConn(ip string) bool {
+	if l.MaxConnsPerIP <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.MaxConnsPerIP {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *Limits) closeConn(ip string) {
+	if l.MaxConnsPerIP <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// limitListener enforces the per-ip connection cap (and in tcp mode the
+// token bucket) before a connection reaches the proxy.
+type limitListener struct {
+	net.Listener
+	limits *Limits
+	http   bool
+	// tls is set when the connections are tls to be terminated: a plaintext
+	// response would only land in the client's handshake
+	tls bool
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := clientIP(conn.RemoteAddr().String())
+		if !l.http {
+			if ok, _ := l.limits.take(ip); !ok {
+				fmt.Println(conn.RemoteAddr().String(), "\trate limited, closing")
+				conn.Close()
+				continue
+			}
+		}
+		if !l.limits.openConn(ip) {
+			fmt.Println(conn.RemoteAddr().String(), "\ttoo many connections from ", ip, ", closing")
+			if l.http && !l.tls {
+				conn.SetWriteDeadline(time.Now().Add(time.Second))
+				fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nRetry-After: 1\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s",
+					l.limits.Status, http.StatusText(l.limits.Status), len(l.limits.Body), l.limits.Body)
+			}
+			conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, limits: l.limits, ip: ip}, nil
+	}
+}
+
+// limitedConn gives its slot back exactly once when closed.
+type limitedConn struct {
+	net.Conn
+	limits *Limits
+	ip     string
+	once   sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limits.closeConn(c.ip) })
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	l := NewLimits()
+	l.Rate, l.Burst = 10, 3
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a"); !ok {
+			t.Fatalf("token %d of a burst of 3 refused", i+1)
+		}
+	}
+	ok, wait := l.take("a")
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("past the burst take = %v, %v, want a refusal and a wait up to 100ms", ok, wait)
+	}
+	if ok, _ := l.take("b"); !ok {
+		t.Error("another key shared the bucket")
+	}
+
+	// 200ms at 10/s gives two tokens back
+	l.buckets["a"].last = l.buckets["a"].last.Add(-200 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("a"); !ok {
+			t.Fatalf("refill token %d refused", i+1)
+		}
+	}
+	if ok, _ := l.take("a"); ok {
+		t.Error("took more than refilled")
+	}
+
+	// full buckets are forgotten
+	l.lastSweep = time.Time{}
+	l.buckets["b"].last = time.Now().Add(-time.Second)
+	l.take("a")
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("a refilled bucket was not swept")
+	}
+
+	l.Rate = 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.take("a"); !ok {
+			t.Fatal("rate 0 refused a token")
+		}
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	l := NewLimits()
+	l.Rate, l.Burst, l.Key = 1, 1, "header:X-Api-Key"
+	request := func(key, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		w := httptest.NewRecorder()
+		if l.AllowRequest(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+		return w
+	}
+	for i, tc := range []struct {
+		key, remote string
+		want        int
+	}{
+		{"k1", "10.0.0.1:1000", 200},
+		{"k1", "10.0.0.2:1000", 429},
+		{"k2", "10.0.0.1:1000", 200},
+		// without the header the client address is the key
+		{"", "10.0.0.1:1001", 200},
+		{"", "10.0.0.1:1002", 429},
+	} {
+		w := request(tc.key, tc.remote)
+		if w.Code != tc.want {
+			t.Errorf("request %d: %d, want %d", i+1, w.Code, tc.want)
+		}
+		if w.Code == 429 && (w.Header().Get("Retry-After") != "1" || !strings.Contains(w.Body.String(), l.Body)) {
+			t.Errorf("request %d: refused with Retry-After %q and %q", i+1, w.Header().Get("Retry-After"), w.Body.String())
+		}
+	}
+}
+
+// limitedListener accepts through a limitListener on a free port and hands
+// the connections it lets through to accepted.
+func limitedListener(t *testing.T, l *limitListener) (string, chan net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inner.Close() })
+	l.Listener = inner
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return inner.Addr().String(), accepted
+}
+
+// refusal dials addr and returns what the listener wrote before closing.
+func refusal(t *testing.T, addr string, accepted chan net.Conn) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("the refused connection was not closed: %v", err)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a connection over the limit was accepted")
+	default:
+	}
+	return string(b)
+}
+
+func accept(t *testing.T, addr string, accepted chan net.Conn) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	select {
+	case c := <-accepted:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection under the limit was not accepted")
+		return nil
+	}
+}
+
+func TestConnectionCap(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		http, tls bool
+		want      string
+	}{
+		{name: "http", http: true, want: "HTTP/1.1 429 Too Many Requests"},
+		// a 429 in plaintext would land in the client's handshake
+		{name: "https", http: true, tls: true, want: ""},
+		{name: "tcp", want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			limits := NewLimits()
+			limits.MaxConnsPerIP = 1
+			addr, accepted := limitedListener(t, &limitListener{limits: limits, http: tc.http, tls: tc.tls})
+
+			first := accept(t, addr, accepted)
+			got := refusal(t, addr, accepted)
+			if tc.want == "" && got != "" || !strings.HasPrefix(got, tc.want) {
+				t.Errorf("refused with %q, want %q", got, tc.want)
+			}
+
+			// the slot is given back once, however often the proxy closes
+			first.Close()
+			first.Close()
+			accept(t, addr, accepted)
+			refusal(t, addr, accepted)
+		})
+	}
+}
+
+func TestTCPConnectionRate(t *testing.T) {
+	limits := NewLimits()
+	limits.Rate, limits.Burst = 0.001, 2
+	addr, accepted := limitedListener(t, &limitListener{limits: limits})
+	accept(t, addr, accepted)
+	accept(t, addr, accepted)
+	if got := refusal(t, addr, accepted); got != "" {
+		t.Errorf("tcp mode wrote %q to a rate limited connection", got)
+	}
+
+	// in http mode the bucket is per request, not per connection
+	limits = NewLimits()
+	limits.Rate, limits.Burst = 0.001, 1
+	addr, accepted = limitedListener(t, &limitListener{limits: limits, http: true})
+	accept(t, addr, accepted)
+	accept(t, addr, accepted)
+}
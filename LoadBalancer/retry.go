@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy lets a pool in http mode try another backend when one fails.
+// Requests are only retried when repeating them is safe: idempotent methods
+// (or an Idempotency-Key header), or any request whose connection to the
+// backend could not even be opened.
+type RetryPolicy struct {
+	Attempts     int   // total tries including the first
+	Statuses     []int // backend responses treated as failures, e.g. 502, 503, 504
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	MaxBodyBytes int64 // larger request bodies are streamed and never retried
+	Budget       *RetryBudget
+
+	// Hedge sends a second copy of a slow idempotent request to another
+	// backend once it has been pending longer than the pool's
+	// HedgePercentile latency, and uses whichever answers first.
+	Hedge           bool
+	HedgePercentile float64
+	HedgeMinDelay   time.Duration
+}
+
+// RetryBudget keeps retries (and hedges) to a fraction of real traffic so a
+// struggling pool is not buried under extra load: every request earns Ratio
+// tokens, every retry spends one, and MinPerSecond tokens trickle in on
+// their own so quiet pools can still retry.
+type RetryBudget struct {
+	Ratio        float64
+	MinPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// budget cap, so a long quiet period cannot bank an unlimited burst
+const maxBudgetTokens = 100
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	b.refill()
+	b.tokens = math.Min(maxBudgetTokens, b.tokens+b.Ratio)
+	b.mu.Unlock()
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *RetryBudget) refill() {
+	now := time.Now()
+	if b.last.IsZero() {
+		// start with one second's worth
+		b.tokens = math.Min(maxBudgetTokens, b.MinPerSecond)
+	} else {
+		b.tokens = math.Min(maxBudgetTokens, b.tokens+now.Sub(b.last).Seconds()*b.MinPerSecond)
+	}
+	b.last = now
+}
+
+func (rp *RetryPolicy) retryableStatus(status int) bool {
+	for _, s := range rp.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is exponential with full jitter.
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := rp.BaseBackoff << attempt
+	if ceiling <= 0 || ceiling > rp.MaxBackoff {
+		ceiling = rp.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+const (
+	// minHedgeSamples is how many latencies a pool needs before it hedges
+	minHedgeSamples = 20
+	// hedgeRefresh is how many new latencies a pool takes before its hedge
+	// delay is worked out again: sorting the window on every request would
+	// hold the pool lock for each of them
+	hedgeRefresh = 64
+)
+
+// hedgeDelay is how long to wait before hedging, or false while the pool
+// has too few samples to know what slow means.
+func (p *Pool) hedgeDelay() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.latency.samples) < minHedgeSamples {
+		return 0, false
+	}
+	if p.hedgeAtSamples == 0 || p.latency.added-p.hedgeAtSamples >= hedgeRefresh {
+		p.hedgeAt = p.latency.percentiles(p.Retry.HedgePercentile)[0]
+		p.hedgeAtSamples = p.latency.added
+	}
+	delay := p.hedgeAt
+	if delay < p.Retry.HedgeMinDelay {
+		delay = p.Retry.HedgeMinDelay
+	}
+	return delay, true
+}
+
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// notSent reports whether err happened before the request left the
+// balancer, which makes any method safe to retry.
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
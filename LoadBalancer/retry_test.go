@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// httpBackend serves h and returns itself as a Backend.
+func httpBackend(t *testing.T, h http.HandlerFunc) *Backend {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	return &Backend{Host: host, Port: port}
+}
+
+// reply is a backend handler answering status and name, counting its hits.
+func reply(status int, name string, hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, name)
+	}
+}
+
+// startHTTP runs lb in http mode on a free port and returns its url.
+func startHTTP(t *testing.T, lb *LB) string {
+	t.Helper()
+	lb.Mode = "http"
+	lb.Transport = &http.Transport{}
+	for _, p := range lb.Pools {
+		if p.Transport == nil {
+			p.Transport = lb.Transport
+		}
+	}
+	srv := httptest.NewServer(lb)
+	t.Cleanup(srv.Close)
+	t.Cleanup(lb.Transport.CloseIdleConnections)
+	return srv.URL
+}
+
+func get(t *testing.T, req *http.Request) (int, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// closedPort is an address nothing listens on.
+func closedPort(t *testing.T) *Backend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	return &Backend{Host: host, Port: port}
+}
+
+func TestRetryOnlyWhenSafe(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		key       string
+		body      string
+		refused   bool // the first backend is not listening
+		want      string
+		wantFirst int32
+	}{
+		{name: "GET", method: "GET", want: "good"},
+		{name: "PUT", method: "PUT", body: "x", want: "good"},
+		{name: "POST", method: "POST", body: "x", want: "bad"},
+		{name: "POST with an idempotency key", method: "POST", key: "k1", body: "x", want: "good"},
+		{name: "POST never sent", method: "POST", body: "x", refused: true, want: "good"},
+		{name: "body too big to replay", method: "PUT", body: strings.Repeat("x", 100), want: "bad"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var badHits, goodHits atomic.Int32
+			first := httpBackend(t, reply(http.StatusServiceUnavailable, "bad", &badHits))
+			if tc.refused {
+				first = closedPort(t)
+			}
+			pool := NewPool("web", RoundRobin, []*Backend{first, httpBackend(t, reply(http.StatusOK, "good", &goodHits))})
+			pool.Retry = &RetryPolicy{Attempts: 2, Statuses: []int{503}, MaxBodyBytes: 10, Budget: &RetryBudget{MinPerSecond: 100}}
+			addr := startHTTP(t, testLB(pool))
+
+			req, _ := http.NewRequest(tc.method, addr+"/", strings.NewReader(tc.body))
+			if tc.key != "" {
+				req.Header.Set("Idempotency-Key", tc.key)
+			}
+			if _, body := get(t, req); body != tc.want {
+				t.Errorf("got %q, want %q", body, tc.want)
+			}
+			if !tc.refused && badHits.Load() != 1 {
+				t.Errorf("the failing backend got %d requests", badHits.Load())
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &RetryBudget{Ratio: 0.5}
+	if b.withdraw() {
+		t.Fatal("an empty budget paid for a retry")
+	}
+	b.deposit()
+	b.deposit()
+	if !b.withdraw() || b.withdraw() {
+		t.Fatal("two requests at 0.5 did not pay for exactly one retry")
+	}
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+	}
+	if b.tokens > maxBudgetTokens {
+		t.Errorf("the budget banked %v tokens", b.tokens)
+	}
+
+	// one retry a second and none earned by requests: the second failing
+	// request in a row is not retried
+	var badHits atomic.Int32
+	bad := httpBackend(t, reply(http.StatusServiceUnavailable, "bad", &badHits))
+	good := httpBackend(t, reply(http.StatusOK, "good", new(atomic.Int32)))
+	pool := NewPool("web", RoundRobin, []*Backend{bad, good})
+	pool.Retry = &RetryPolicy{Attempts: 2, Statuses: []int{503}, Budget: &RetryBudget{MinPerSecond: 1}}
+	addr := startHTTP(t, testLB(pool))
+	for i, want := range []string{"good", "bad"} {
+		req, _ := http.NewRequest("GET", addr+"/", nil)
+		if _, body := get(t, req); body != want {
+			t.Errorf("request %d: got %q, want %q", i+1, body, want)
+		}
+	}
+}
+
+func TestHedgeDelayIsCached(t *testing.T) {
+	pool := NewPool("web", RoundRobin, nil)
+	pool.Retry = &RetryPolicy{Hedge: true, HedgePercentile: 95, HedgeMinDelay: time.Millisecond}
+	for i := 0; i < minHedgeSamples-1; i++ {
+		pool.latency.add(5 * time.Millisecond)
+	}
+	if _, ok := pool.hedgeDelay(); ok {
+		t.Fatal("hedging without enough samples")
+	}
+	pool.latency.add(5 * time.Millisecond)
+	if d, ok := pool.hedgeDelay(); !ok || d != 5*time.Millisecond {
+		t.Fatalf("hedgeDelay = %v, %v, want 5ms", d, ok)
+	}
+	for i := 0; i < hedgeRefresh-1; i++ {
+		pool.latency.add(50 * time.Millisecond)
+	}
+	if d, _ := pool.hedgeDelay(); d != 5*time.Millisecond {
+		t.Errorf("hedgeDelay = %v, want the cached 5ms", d)
+	}
+	pool.latency.add(50 * time.Millisecond)
+	if d, _ := pool.hedgeDelay(); d != 50*time.Millisecond {
+		t.Errorf("hedgeDelay = %v, want 50ms once refreshed", d)
+	}
+
+	pool.Retry.HedgeMinDelay = time.Second
+	if d, _ := pool.hedgeDelay(); d != time.Second {
+		t.Errorf("hedgeDelay = %v, want the 1s minimum", d)
+	}
+}
+
+// slowBackend answers name after delay, or reports on cancelled that the
+// balancer gave up on it first.
+func slowBackend(t *testing.T, status int, name string, delay time.Duration, cancelled chan<- struct{}) *Backend {
+	return httpBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.WriteHeader(status)
+			io.WriteString(w, name)
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	})
+}
+
+// hedgingPool has seen enough 1ms requests to hedge after 1ms.
+func hedgingPool(budget *RetryBudget, servers ...*Backend) *Pool {
+	pool := NewPool("web", LeastConnections, servers)
+	pool.Retry = &RetryPolicy{Attempts: 2, Statuses: []int{503}, Hedge: true, HedgePercentile: 95, Budget: budget}
+	for i := 0; i < minHedgeSamples; i++ {
+		pool.latency.add(time.Millisecond)
+	}
+	return pool
+}
+
+func TestHedging(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		budget *RetryBudget
+		want   string
+	}{
+		{name: "GET", method: "GET", budget: &RetryBudget{MinPerSecond: 100}, want: "fast"},
+		{name: "POST", method: "POST", budget: &RetryBudget{MinPerSecond: 100}, want: "slow"},
+		{name: "no budget", method: "GET", budget: &RetryBudget{}, want: "slow"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cancelled := make(chan struct{}, 1)
+			var fastHits atomic.Int32
+			slow := slowBackend(t, http.StatusOK, "slow", 300*time.Millisecond, cancelled)
+			fast := httpBackend(t, reply(http.StatusOK, "fast", &fastHits))
+			addr := startHTTP(t, testLB(hedgingPool(tc.budget, slow, fast)))
+
+			req, _ := http.NewRequest(tc.method, addr+"/", nil)
+			if _, body := get(t, req); body != tc.want {
+				t.Fatalf("got %q, want %q", body, tc.want)
+			}
+			if tc.want == "slow" {
+				if fastHits.Load() != 0 {
+					t.Error("the request was hedged")
+				}
+				return
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Error("the slow copy was not cancelled once the hedge answered")
+			}
+		})
+	}
+}
+
+func TestRetrySkipsTheHedgedBackend(t *testing.T) {
+	// the first copy is slow and fails, the hedge fails at once: the retry
+	// must go to the third backend and not back to the hedge's
+	var hedgeHits, goodHits atomic.Int32
+	slow := slowBackend(t, http.StatusServiceUnavailable, "slow", 100*time.Millisecond, make(chan struct{}, 1))
+	hedge := httpBackend(t, reply(http.StatusServiceUnavailable, "hedge", &hedgeHits))
+	good := httpBackend(t, reply(http.StatusOK, "good", &goodHits))
+	addr := startHTTP(t, testLB(hedgingPool(&RetryBudget{MinPerSecond: 100}, slow, hedge, good)))
+
+	req, _ := http.NewRequest("GET", addr+"/", nil)
+	if _, body := get(t, req); body != "good" {
+		t.Errorf("got %q, want good", body)
+	}
+	if hedgeHits.Load() != 1 || goodHits.Load() != 1 {
+		t.Errorf("the hedge's backend got %d requests and the third %d", hedgeHits.Load(), goodHits.Load())
+	}
+}
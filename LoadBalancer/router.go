@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route sends matching HTTP requests to a named pool. Every condition that
+// is set has to match; a route with no conditions matches everything.
+type Route struct {
+	Name     string
+	Priority int
+	Pool     string
+
+	Host       string // exact host or "*.example.com"
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Methods    []string
+	Headers    map[string]string // empty value only requires the header to be present
+
+	// StripPrefix removes PathPrefix before forwarding. Rewrite replaces the
+	// PathRegex match (regexp expansion syntax) or, without a regex, the
+	// PathPrefix.
+	StripPrefix bool
+	Rewrite     string
+}
+
+// Router holds routes ordered by priority, highest first. Routes with the
+// same priority keep the order they were declared in.
+type Router struct {
+	Routes      []*Route
+	DefaultPool string
+}
+
+func NewRouter(routes []*Route, defaultPool string) *Router {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
+	return &Router{Routes: routes, DefaultPool: defaultPool}
+}
+
+// Match returns the first route accepting r, or a catch-all route on the
+// default pool.
+func (rt *Router) Match(r *http.Request) *Route {
+	for _, route := range rt.Routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return &Route{Name: "default", Pool: rt.DefaultPool}
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.Host != "" && !matchHost(route.Host, r.Host) {
+		return false
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+		return false
+	}
+	if route.PathRegex != nil && !route.PathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(route.Methods) > 0 {
+		found := false
+		for _, m := range route.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, want := range route.Headers {
+		values, present := r.Header[http.CanonicalHeaderKey(name)]
+		if !present {
+			return false
+		}
+		if want != "" && !containsString(values, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// RewritePath returns the path the backend should see.
+func (route *Route) RewritePath(path string) string {
+	switch {
+	case route.PathRegex != nil && route.Rewrite != "":
+		path = route.PathRegex.ReplaceAllString(path, route.Rewrite)
+	case route.PathPrefix != "" && route.Rewrite != "":
+		path = route.Rewrite + strings.TrimPrefix(path, route.PathPrefix)
+	case route.PathPrefix != "" && route.StripPrefix:
+		path = strings.TrimPrefix(path, route.PathPrefix)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func testRouter() *Router {
+	return NewRouter([]*Route{
+		{Name: "api", Pool: "api", PathPrefix: "/api/"},
+		{Name: "api-writes", Priority: 10, Pool: "writes", PathPrefix: "/api/", Methods: []string{"post", "PUT"}},
+		{Name: "admin", Pool: "admin", Host: "admin.example.com"},
+		{Name: "tenants", Pool: "tenants", Host: "*.example.com"},
+		{Name: "canary", Priority: 5, Pool: "canary", Headers: map[string]string{"X-Canary": "1"}},
+		{Name: "debug", Priority: 5, Pool: "debug", Headers: map[string]string{"X-Debug": ""}},
+		{Name: "users", Pool: "users", PathRegex: regexp.MustCompile(`^/users/[0-9]+$`)},
+		// declared after api with the same priority: never reached for /api/
+		{Name: "api-shadowed", Pool: "shadowed", PathPrefix: "/api/v2/"},
+	}, "web")
+}
+
+func TestRouterMatch(t *testing.T) {
+	rt := testRouter()
+	for _, tc := range []struct {
+		method, target, host string
+		header               http.Header
+		want                 string
+	}{
+		{method: "GET", target: "/", want: "default"},
+		{method: "GET", target: "/api/items", want: "api"},
+		{method: "GET", target: "/api/v2/items", want: "api"},
+		{method: "POST", target: "/api/items", want: "api-writes"},
+		{method: "DELETE", target: "/api/items", want: "api"},
+		{method: "GET", target: "/apix", want: "default"},
+		{method: "GET", target: "/", host: "admin.example.com", want: "admin"},
+		{method: "GET", target: "/", host: "ADMIN.example.com:8080", want: "admin"},
+		{method: "GET", target: "/", host: "acme.example.com", want: "tenants"},
+		{method: "GET", target: "/", host: "example.com", want: "default"},
+		{method: "GET", target: "/", header: http.Header{"X-Canary": {"1"}}, want: "canary"},
+		{method: "GET", target: "/", header: http.Header{"X-Canary": {"0"}}, want: "default"},
+		{method: "GET", target: "/", header: http.Header{"X-Debug": {"anything"}}, want: "debug"},
+		// priority beats the host route
+		{method: "GET", target: "/", host: "admin.example.com", header: http.Header{"X-Canary": {"1"}}, want: "canary"},
+		{method: "GET", target: "/users/42", want: "users"},
+		{method: "GET", target: "/users/me", want: "default"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.host != "" {
+			r.Host = tc.host
+		}
+		for name, values := range tc.header {
+			r.Header[name] = values
+		}
+		route := rt.Match(r)
+		if route.Name != tc.want {
+			t.Errorf("%s %s host %q %v matched %s, want %s", tc.method, tc.target, tc.host, tc.header, route.Name, tc.want)
+		}
+		if tc.want == "default" && route.Pool != "web" {
+			t.Errorf("the default route goes to %s", route.Pool)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	for _, tc := range []struct {
+		route Route
+		path  string
+		want  string
+	}{
+		{Route{}, "/a/b", "/a/b"},
+		{Route{PathPrefix: "/api"}, "/api/items", "/api/items"},
+		{Route{PathPrefix: "/api", StripPrefix: true}, "/api/items", "/items"},
+		{Route{PathPrefix: "/api", StripPrefix: true}, "/api", "/"},
+		{Route{PathPrefix: "/api/", StripPrefix: true}, "/api/items", "/items"},
+		{Route{PathPrefix: "/v1/", Rewrite: "/v2/"}, "/v1/items", "/v2/items"},
+		{Route{PathRegex: regexp.MustCompile(`^/users/([0-9]+)$`), Rewrite: "/profile?id=$1"}, "/users/42", "/profile?id=42"},
+		{Route{PathRegex: regexp.MustCompile(`^/old/(.*)`), Rewrite: "$1"}, "/old/page", "/page"},
+	} {
+		if got := tc.route.RewritePath(tc.path); got != tc.want {
+			t.Errorf("%+v rewrote %s to %s, want %s", tc.route, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestRoutingThroughTheBalancer(t *testing.T) {
+	// each backend answers its name and the path it saw
+	named := func(name string) *Backend {
+		return httpBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		})
+	}
+	lb := testLB(NewPool("web", RoundRobin, []*Backend{named("web")}), NewPool("api", RoundRobin, []*Backend{named("api")}))
+	lb.Router = NewRouter([]*Route{{Name: "api", Pool: "api", PathPrefix: "/api", StripPrefix: true}}, "web")
+	addr := startHTTP(t, lb)
+
+	for path, want := range map[string]string{"/api/items": "api /items", "/index.html": "web /index.html"} {
+		req, _ := http.NewRequest("GET", addr+path, nil)
+		if _, body := get(t, req); body != want {
+			t.Errorf("%s answered %q, want %q", path, body, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// slow start ramps
+const (
+	RampLinear      = "linear"
+	RampExponential = "exponential"
+)
+
+// SlowStart eases a backend back in after it recovers from a failed health
+// check, is added to its pool or stops draining: its effective weight grows
+// from MinFraction of its weight to the full weight over Window, so the
+// weighted algorithms do not flood a cold backend.
+type SlowStart struct {
+	Window      time.Duration
+	Ramp        string  // linear (default) or exponential
+	MinFraction float64 // starting share of the weight, default 0.1
+}
+
+func validSlowStart(s *SlowStart) error {
+	if s.Window <= 0 {
+		return fmt.Errorf("slow start window must be positive")
+	}
+	if s.Ramp != RampLinear && s.Ramp != RampExponential {
+		return fmt.Errorf("unknown slow start ramp %q", s.Ramp)
+	}
+	if s.MinFraction <= 0 || s.MinFraction > 1 {
+		return fmt.Errorf("slow start minFraction must be in (0, 1]")
+	}
+	return nil
+}
+
+// fraction is the share of the full weight elapsed into the window.
+func (s *SlowStart) fraction(elapsed time.Duration) float64 {
+	if elapsed >= s.Window {
+		return 1
+	}
+	progress := float64(elapsed) / float64(s.Window)
+	if s.Ramp == RampExponential {
+		// doubles at a steady rate from MinFraction up to 1
+		return s.MinFraction * math.Pow(1/s.MinFraction, progress)
+	}
+	return s.MinFraction + (1-s.MinFraction)*progress
+}
+
+// weights are scaled up so a ramping backend of weight 1 still gets a
+// fraction of its share instead of rounding to all or nothing
+const weightScale = 100
+
+// effectiveWeight is the scaled weight the weighted algorithms use, reduced
+// while b is in its slow start window.
+func (b *Backend) effectiveWeight(now time.Time) int {
+	w := b.weight() * weightScale
+	if b.SlowStart == nil || b.rampStart.IsZero() {
+		return w
+	}
+	f := b.SlowStart.fraction(now.Sub(b.rampStart))
+	if f >= 1 {
+		b.rampStart = time.Time{}
+		return w
+	}
+	return max(1, int(float64(w)*f))
+}
+
+// startRamp puts b back at the bottom of its slow start.
+func (b *Backend) startRamp(now time.Time) {
+	if b.SlowStart != nil {
+		b.rampStart = now
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlowStartFraction(t *testing.T) {
+	linear := &SlowStart{Window: 10 * time.Second, Ramp: RampLinear, MinFraction: 0.1}
+	exponential := &SlowStart{Window: 10 * time.Second, Ramp: RampExponential, MinFraction: 0.1}
+	for _, tc := range []struct {
+		s       *SlowStart
+		elapsed time.Duration
+		want    float64
+	}{
+		{linear, 0, 0.1},
+		{linear, 5 * time.Second, 0.55},
+		{linear, 10 * time.Second, 1},
+		{linear, time.Minute, 1},
+		{exponential, 0, 0.1},
+		{exponential, 5 * time.Second, 0.1 * math.Sqrt(10)},
+		{exponential, 10 * time.Second, 1},
+	} {
+		if got := tc.s.fraction(tc.elapsed); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s ramp after %v = %v, want %v", tc.s.Ramp, tc.elapsed, got, tc.want)
+		}
+	}
+}
+
+func TestEffectiveWeight(t *testing.T) {
+	now := time.Now()
+	ramp := &SlowStart{Window: 10 * time.Second, Ramp: RampLinear, MinFraction: 0.1}
+	b := &Backend{Weight: 2, SlowStart: ramp}
+	if w := b.effectiveWeight(now); w != 2*weightScale {
+		t.Errorf("before any ramp: %d", w)
+	}
+	b.startRamp(now)
+	for _, tc := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 20},
+		{5 * time.Second, 110},
+		{10 * time.Second, 200},
+	} {
+		if w := b.effectiveWeight(now.Add(tc.at)); w != tc.want {
+			t.Errorf("%v into the ramp: %d, want %d", tc.at, w, tc.want)
+		}
+	}
+	if !b.rampStart.IsZero() {
+		t.Error("the ramp was not marked done at the end of the window")
+	}
+
+	// never rounds down to nothing
+	tiny := &Backend{Weight: 1, SlowStart: &SlowStart{Window: time.Hour, Ramp: RampLinear, MinFraction: 0.001}}
+	tiny.startRamp(now)
+	if w := tiny.effectiveWeight(now); w != 1 {
+		t.Errorf("a ramping weight of 1 at 0.1%% is %d, want 1", w)
+	}
+	// without slow start there is nothing to ramp
+	plain := &Backend{Weight: 3}
+	plain.startRamp(now)
+	if w := plain.effectiveWeight(now); w != 3*weightScale {
+		t.Errorf("without slow start: %d", w)
+	}
+}
+
+func TestSlowStartShiftsTraffic(t *testing.T) {
+	ramp := &SlowStart{Window: time.Hour, Ramp: RampLinear, MinFraction: 0.1}
+	for _, tc := range []struct {
+		name    string
+		started time.Duration // how long ago the cold backend started ramping
+		cold    int           // picks it gets out of 110
+	}{
+		{"ramping", 0, 10},
+		{"ramped", 2 * time.Hour, 55},
+	} {
+		warm, cold := &Backend{Host: "10.0.0.1", Port: "80"}, &Backend{Host: "10.0.0.2", Port: "80", SlowStart: ramp}
+		cold.startRamp(time.Now().Add(-tc.started))
+		pool := NewPool("p", WeightedRoundRobin, []*Backend{warm, cold})
+		picks := 0
+		for i := 0; i < 110; i++ {
+			b, err := pool.Pick("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b == cold {
+				picks++
+			}
+			pool.Done(b)
+		}
+		if picks < tc.cold-1 || picks > tc.cold+1 {
+			t.Errorf("%s: the cold backend got %d of 110 picks, want about %d", tc.name, picks, tc.cold)
+		}
+	}
+}
+
+func TestRampRestarts(t *testing.T) {
+	ramp := &SlowStart{Window: time.Hour, Ramp: RampLinear, MinFraction: 0.1}
+	pool := NewPool("p", WeightedRoundRobin, nil)
+	pool.SlowStart = ramp
+
+	added := &Backend{Host: "10.0.0.1", Port: "80"}
+	if err := pool.Add(added); err != nil {
+		t.Fatal(err)
+	}
+	if added.SlowStart != ramp || added.rampStart.IsZero() {
+		t.Error("an added backend does not start ramping")
+	}
+
+	added.rampStart = time.Time{}
+	pool.SetDraining(added.Addr(), true)
+	if !added.rampStart.IsZero() {
+		t.Error("draining started a ramp")
+	}
+	pool.SetDraining(added.Addr(), false)
+	if added.rampStart.IsZero() {
+		t.Error("a backend back from draining does not ramp")
+	}
+
+	// recovering from a failed health check
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	recovered := &Backend{Host: host, Port: port, Down: true, SlowStart: ramp}
+	checked := NewPool("checked", WeightedRoundRobin, []*Backend{recovered})
+	checked.HealthCheck = HealthCheck{Interval: time.Hour, Timeout: time.Second}
+	go checked.RunHealthChecks()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		checked.mu.Lock()
+		down, rampStart := recovered.Down, recovered.rampStart
+		checked.mu.Unlock()
+		if !down {
+			if rampStart.IsZero() {
+				t.Error("a recovered backend does not ramp")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the backend never passed its health check")
+		}
+	}
+}
+
+func TestValidSlowStart(t *testing.T) {
+	for _, tc := range []struct {
+		s  SlowStart
+		ok bool
+	}{
+		{SlowStart{Window: time.Second, Ramp: RampLinear, MinFraction: 0.1}, true},
+		{SlowStart{Window: time.Second, Ramp: RampExponential, MinFraction: 1}, true},
+		{SlowStart{Window: 0, Ramp: RampLinear, MinFraction: 0.1}, false},
+		{SlowStart{Window: time.Second, Ramp: "cubic", MinFraction: 0.1}, false},
+		{SlowStart{Window: time.Second, Ramp: RampLinear, MinFraction: 0}, false},
+		{SlowStart{Window: time.Second, Ramp: RampLinear, MinFraction: 1.5}, false},
+	} {
+		if err := validSlowStart(&tc.s); (err == nil) != tc.ok {
+			t.Errorf("%+v: %v", tc.s, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// latencySamples keeps the most recent samples of a backend so percentiles
+// follow current behaviour instead of the whole lifetime.
+const latencySamples = 1024
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	added   int // samples ever added, to tell when a cached percentile is stale
+}
+
+func (lw *latencyWindow) add(d time.Duration) {
+	lw.added++
+	if len(lw.samples) < latencySamples {
+		lw.samples = append(lw.samples, d)
+		return
+	}
+	lw.samples[lw.next] = d
+	lw.next = (lw.next + 1) % latencySamples
+}
+
+// percentiles returns the requested quantiles (0-100) in the same order.
+func (lw *latencyWindow) percentiles(ps ...float64) []time.Duration {
+	out := make([]time.Duration, len(ps))
+	if len(lw.samples) == 0 {
+		return out
+	}
+	sorted := append([]time.Duration(nil), lw.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, p := range ps {
+		idx := int(p / 100 * float64(len(sorted)-1))
+		out[i] = sorted[idx]
+	}
+	return out
+}
+
+// Observe records the outcome of one connection or request on backend.
+// latency is the time to connect in tcp mode and the time to response
+// headers in http mode.
+func (p *Pool) Observe(backend *Backend, in, out int64, latency time.Duration, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backend.BytesIn += in
+	backend.BytesOut += out
+	if failed {
+		backend.Errors++
+	}
+	if latency > 0 {
+		backend.latency.add(latency)
+		p.latency.add(latency)
+	}
+}
+
+type BackendStats struct {
+	Addr   string `json:"addr"`
+	State  string `json:"state"` // up, down or draining
+	Weight int    `json:"weight"`
+	// EffectiveWeight is Weight reduced during slow start
+	EffectiveWeight float64 `json:"effectiveWeight"`
+	MaxConns        int     `json:"maxConns"`
+	Active          int     `json:"active"`
+	LongLived       int     `json:"longLived"`
+	Total           int     `json:"total"`
+	BytesIn         int64   `json:"bytesIn"`
+	BytesOut        int64   `json:"bytesOut"`
+	Errors          int     `json:"errors"`
+	P50Ms           float64 `json:"latencyP50Ms"`
+	P90Ms           float64 `json:"latencyP90Ms"`
+	P99Ms           float64 `json:"latencyP99Ms"`
+}
+
+type PoolStats struct {
+	Name      string         `json:"name"`
+	Algorithm string         `json:"algorithm"`
+	Backends  []BackendStats `json:"backends"`
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ps := PoolStats{Name: p.Name, Algorithm: p.Algorithm, Backends: make([]BackendStats, 0, len(p.Servers))}
+	for _, b := range p.Servers {
+		pct := b.latency.percentiles(50, 90, 99)
+		ps.Backends = append(ps.Backends, BackendStats{
+			Addr:            b.Addr(),
+			State:           b.State(),
+			Weight:          b.weight(),
+			EffectiveWeight: float64(b.effectiveWeight(now)) / weightScale,
+			MaxConns:        b.MaxConns,
+			Active:          b.Active,
+			LongLived:       b.LongLived,
+			Total:           b.Total,
+			BytesIn:         b.BytesIn,
+			BytesOut:        b.BytesOut,
+			Errors:          b.Errors,
+			P50Ms:           millis(pct[0]),
+			P90Ms:           millis(pct[1]),
+			P99Ms:           millis(pct[2]),
+		})
+	}
+	return ps
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// session affinity modes
+const (
+	StickyCookie = "cookie"
+	StickyHash   = "hash"
+)
+
+// Sticky pins clients to a backend. In cookie mode the balancer injects a
+// cookie naming the backend; in hash mode a key taken from the request is
+// placed on a consistent hash ring with bounded loads. Either way a client
+// only moves when its backend goes down.
+type Sticky struct {
+	Mode       string
+	CookieName string
+	// Key is "ip", "header:<name>" or "cookie:<name>"; only "ip" is
+	// available in tcp mode.
+	Key string
+	// LoadFactor bounds a backend at LoadFactor times its fair share of
+	// active connections when placing a new key.
+	LoadFactor float64
+	// TTL forgets a hash key that has not been seen for this long.
+	TTL time.Duration
+
+	ring      []ringPoint
+	pinned    map[string]*pin
+	lastSweep time.Time
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+type pin struct {
+	backend  *Backend
+	lastSeen time.Time
+}
+
+// virtual nodes per unit of weight on the hash ring
+const ringReplicas = 100
+
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// ID is the opaque backend name stored in affinity cookies.
+func (b *Backend) ID() string {
+	return strconv.FormatUint(hashKey(b.Addr()), 36)
+}
+
+// rebuildRing must be called with the pool lock held whenever Servers
+// changes.
+func (s *Sticky) rebuildRing(servers []*Backend) {
+	s.ring = s.ring[:0]
+	for _, b := range servers {
+		for i := 0; i < ringReplicas*b.weight(); i++ {
+			s.ring = append(s.ring, ringPoint{hashKey(b.Addr() + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	if s.pinned == nil {
+		s.pinned = make(map[string]*pin)
+	}
+	for key, p := range s.pinned {
+		if !containsBackend(servers, p.backend) {
+			delete(s.pinned, key)
+		}
+	}
+}
+
+func containsBackend(servers []*Backend, b *Backend) bool {
+	for _, s := range servers {
+		if s == b {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the backend key is pinned to, or nil when the pool's normal
+// algorithm should choose. A pin only moves when its backend is down: a
+// draining or full backend is still returned and the pool turns the client
+// away instead. Called with the pool lock held.
+func (s *Sticky) pick(key string, servers []*Backend) *Backend {
+	if key == "" {
+		return nil
+	}
+	if s.Mode == StickyCookie {
+		for _, b := range servers {
+			if b.ID() == key && !b.Down {
+				return b
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.TTL {
+		for k, p := range s.pinned {
+			if now.Sub(p.lastSeen) > s.TTL {
+				delete(s.pinned, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if p, ok := s.pinned[key]; ok && !p.backend.Down {
+		p.lastSeen = now
+		return p.backend
+	}
+	b := s.boundedLookup(key, servers)
+	if b != nil {
+		s.pinned[key] = &pin{backend: b, lastSeen: now}
+	}
+	return b
+}
+
+// boundedLookup walks the ring clockwise from key's hash and takes the
+// first healthy backend still under its capacity, as in "Consistent
+// Hashing with Bounded Loads" (Mirrokni et al.).
+func (s *Sticky) boundedLookup(key string, servers []*Backend) *Backend {
+	if len(s.ring) == 0 {
+		return nil
+	}
+	now := time.Now()
+	active, weights := 0, 0
+	for _, b := range servers {
+		if !b.Down {
+			active += b.Active
+			weights += b.effectiveWeight(now)
+		}
+	}
+	if weights == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	for i := 0; i < len(s.ring); i++ {
+		b := s.ring[(start+i)%len(s.ring)].backend
+		if !b.available() {
+			continue
+		}
+		capacity := math.Ceil(s.LoadFactor * float64(active+1) * float64(b.effectiveWeight(now)) / float64(weights))
+		if float64(b.Active+1) <= capacity {
+			return b
+		}
+	}
+	return nil
+}
+
+// requestKey extracts the affinity key from an HTTP request.
+func (s *Sticky) requestKey(r *http.Request) string {
+	if s.Mode == StickyCookie {
+		if c, err := r.Cookie(s.CookieName); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(s.Key, "header:"):
+		return r.Header.Get(strings.TrimPrefix(s.Key, "header:"))
+	case strings.HasPrefix(s.Key, "cookie:"):
+		if c, err := r.Cookie(strings.TrimPrefix(s.Key, "cookie:")); err == nil {
+			return c.Value
+		}
+		return ""
+	default:
+		return clientIP(r.RemoteAddr)
+	}
+}
+
+// connKey extracts the affinity key for a raw tcp connection.
+func (s *Sticky) connKey(conn net.Conn) string {
+	if s.Mode == StickyHash && (s.Key == "" || s.Key == "ip") {
+		return clientIP(conn.RemoteAddr().String())
+	}
+	return ""
+}
+
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func validSticky(s *Sticky) error {
+	switch s.Mode {
+	case StickyCookie:
+		if s.CookieName == "" {
+			return fmt.Errorf("cookie stickiness needs a cookie name")
+		}
+	case StickyHash:
+		if s.Key != "" && s.Key != "ip" && !strings.HasPrefix(s.Key, "header:") && !strings.HasPrefix(s.Key, "cookie:") {
+			return fmt.Errorf("unknown sticky key %q", s.Key)
+		}
+		if s.LoadFactor < 1 {
+			return fmt.Errorf("sticky load factor must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown sticky mode %q", s.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStickyCookie(t *testing.T) {
+	a := httpBackend(t, reply(http.StatusOK, "a", new(atomic.Int32)))
+	b := httpBackend(t, reply(http.StatusOK, "b", new(atomic.Int32)))
+	pool := NewPool("web", RoundRobin, []*Backend{a, b})
+	pool.SetSticky(&Sticky{Mode: StickyCookie, CookieName: "lb"})
+	addr := startHTTP(t, testLB(pool))
+
+	// request sends cookie (when set) and returns the backend that answered
+	// and the cookie it was given, if any
+	request := func(cookie string) (string, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", addr+"/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "lb", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body [1]byte
+		resp.Body.Read(body[:])
+		for _, c := range resp.Cookies() {
+			if c.Name == "lb" {
+				return string(body[:]), c.Value
+			}
+		}
+		return string(body[:]), ""
+	}
+
+	first, cookie := request("")
+	if cookie == "" {
+		t.Fatal("no affinity cookie on the first response")
+	}
+	for i := 0; i < 5; i++ {
+		if got, again := request(cookie); got != first || again != "" {
+			t.Fatalf("request %d with the cookie went to %s (cookie %q), want %s and no new cookie", i+1, got, again, first)
+		}
+	}
+	if _, fresh := request("garbage"); fresh == "" {
+		t.Error("an unknown cookie was not replaced")
+	}
+
+	// the pinned backend goes down: the client moves and is told so
+	pinned := a
+	if first == "b" {
+		pinned = b
+	}
+	pool.mu.Lock()
+	pinned.Down = true
+	pool.mu.Unlock()
+	got, moved := request(cookie)
+	if got == first || moved == "" || moved == cookie {
+		t.Errorf("with its backend down the client got %s and cookie %q", got, moved)
+	}
+}
+
+// hashPool is a pool of n equal backends with ip hash stickiness.
+func hashPool(n int) *Pool {
+	servers := make([]*Backend, n)
+	for i := range servers {
+		servers[i] = &Backend{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: "80"}
+	}
+	pool := NewPool("web", RoundRobin, servers)
+	pool.SetSticky(&Sticky{Mode: StickyHash, LoadFactor: 1.25, TTL: time.Hour})
+	return pool
+}
+
+func TestStickyHashIsStable(t *testing.T) {
+	pool := hashPool(3)
+	s := pool.Sticky
+	placed := make(map[string]*Backend)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("client-", i)
+		placed[key] = s.pick(key, pool.Servers)
+		if again := s.pick(key, pool.Servers); again != placed[key] {
+			t.Fatalf("%s moved from %s to %s", key, placed[key].Addr(), again.Addr())
+		}
+	}
+
+	// dropping a backend only moves the keys that were on it
+	gone := pool.Servers[2]
+	pool.Servers = pool.Servers[:2]
+	s.rebuildRing(pool.Servers)
+	for key, was := range placed {
+		now := s.pick(key, pool.Servers)
+		if was != gone && now != was {
+			t.Errorf("%s moved from %s to %s though its backend stayed", key, was.Addr(), now.Addr())
+		}
+		if now == gone {
+			t.Errorf("%s still on the removed backend", key)
+		}
+	}
+
+	// nor does a backend going down move anyone else
+	down := pool.Servers[0]
+	down.Down = true
+	for key := range placed {
+		was := s.pinned[key].backend
+		if now := s.pick(key, pool.Servers); now == down || (was != down && now != was) {
+			t.Errorf("%s went from %s to %s with %s down", key, was.Addr(), now.Addr(), down.Addr())
+		}
+	}
+}
+
+func TestStickyHashBoundsLoad(t *testing.T) {
+	const clients = 300
+	for _, factor := range []float64{1, 1.25} {
+		pool := hashPool(3)
+		pool.Sticky.LoadFactor = factor
+		// every client keeps its connection open, as the pool would count it
+		for i := 0; i < clients; i++ {
+			b := pool.Sticky.pick(fmt.Sprint("client-", i), pool.Servers)
+			if b == nil {
+				t.Fatalf("client %d got no backend", i)
+			}
+			b.Active++
+		}
+		bound := int(math.Ceil(factor * clients / 3))
+		for _, b := range pool.Servers {
+			if b.Active > bound {
+				t.Errorf("load factor %v: %s holds %d of %d clients, over the bound of %d", factor, b.Addr(), b.Active, clients, bound)
+			}
+		}
+	}
+}
+
+func TestStickyHashForgetsIdleKeys(t *testing.T) {
+	pool := hashPool(3)
+	s := pool.Sticky
+	s.pick("old", pool.Servers)
+	s.pick("recent", pool.Servers)
+	s.pinned["old"].lastSeen = time.Now().Add(-2 * time.Hour)
+	s.lastSweep = time.Now().Add(-2 * time.Hour)
+	s.pick("recent", pool.Servers)
+	if _, ok := s.pinned["old"]; ok {
+		t.Error("a key idle for longer than the ttl is still pinned")
+	}
+	if _, ok := s.pinned["recent"]; !ok {
+		t.Error("a key in use was forgotten")
+	}
+}
+
+func TestStickyRequestKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	r.Header.Set("X-User", "u1")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	r.AddCookie(&http.Cookie{Name: "lb", Value: "b1"})
+	for _, tc := range []struct {
+		s    Sticky
+		want string
+	}{
+		{Sticky{Mode: StickyCookie, CookieName: "lb"}, "b1"},
+		{Sticky{Mode: StickyCookie, CookieName: "missing"}, ""},
+		{Sticky{Mode: StickyHash}, "192.0.2.7"},
+		{Sticky{Mode: StickyHash, Key: "ip"}, "192.0.2.7"},
+		{Sticky{Mode: StickyHash, Key: "header:X-User"}, "u1"},
+		{Sticky{Mode: StickyHash, Key: "cookie:session"}, "s1"},
+		{Sticky{Mode: StickyHash, Key: "cookie:missing"}, ""},
+	} {
+		if got := tc.s.requestKey(r); got != tc.want {
+			t.Errorf("%s %q key = %q, want %q", tc.s.Mode, tc.s.Key+tc.s.CookieName, got, tc.want)
+		}
+	}
+}
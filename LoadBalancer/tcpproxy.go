@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts for proxied connections. Zero disables a timeout.
+type Timeouts struct {
+	Connect time.Duration // dialing a backend
+	Idle    time.Duration // no bytes moved in either direction
+	Read    time.Duration // a single read on either side, even if the other side is busy
+	Write   time.Duration // a single write on either side
+}
+
+var defaultTimeouts = Timeouts{
+	Connect: 5 * time.Second,
+	Idle:    5 * time.Minute,
+	Write:   30 * time.Second,
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies in both directions until both sides are done. EOF on one
+// side is passed on as a half-close (FIN) to the other, so the remaining
+// direction can keep flowing; any other error tears the whole connection
+// down.
+func (lb *LB) splice(client, backend net.Conn) (in, out int64) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var err error
+		in, err = lb.pipe(backend, client, &lastActive)
+		if err != nil {
+			client.Close()
+			backend.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		var err error
+		out, err = lb.pipe(client, backend, &lastActive)
+		if err != nil {
+			client.Close()
+			backend.Close()
+		}
+	}()
+	wg.Wait()
+	return in, out
+}
+
+func (lb *LB) pipe(dst, src net.Conn, lastActive *atomic.Int64) (int64, error) {
+	t := lb.Timeouts
+	buf := make([]byte, 32*1024)
+	var copied int64
+	for {
+		wait := t.Idle
+		if t.Read > 0 && (wait == 0 || t.Read < wait) {
+			wait = t.Read
+		}
+		if wait > 0 {
+			src.SetReadDeadline(time.Now().Add(wait))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if t.Write > 0 {
+				dst.SetWriteDeadline(time.Now().Add(t.Write))
+			}
+			written, werr := dst.Write(buf[:n])
+			copied += int64(written)
+			if werr != nil {
+				return copied, werr
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+			return copied, nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && t.Read == 0 {
+			// only this direction is quiet; keep going while the other
+			// one still moves bytes
+			idle := time.Since(time.Unix(0, lastActive.Load()))
+			if idle < t.Idle {
+				continue
+			}
+			return copied, fmt.Errorf("idle for %s", idle.Round(time.Second))
+		}
+		return copied, err
+	}
+}
+
+// track registers a live connection so Shutdown can wait for it and, past
+// the drain deadline, close it.
+func (lb *LB) track(conns ...net.Conn) {
+	lb.connMu.Lock()
+	defer lb.connMu.Unlock()
+	if lb.conns == nil {
+		lb.conns = make(map[net.Conn]struct{})
+	}
+	for _, c := range conns {
+		lb.conns[c] = struct{}{}
+	}
+}
+
+func (lb *LB) untrack(conns ...net.Conn) {
+	lb.connMu.Lock()
+	defer lb.connMu.Unlock()
+	for _, c := range conns {
+		delete(lb.conns, c)
+	}
+}
+
+// ServeTCP accepts connections until the listener is closed by Shutdown.
+func (lb *LB) ServeTCP(listener net.Listener) error {
+	lb.connMu.Lock()
+	lb.listener = listener
+	lb.connMu.Unlock()
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				fmt.Println("temporary err while accepting connection => ", err)
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		lb.active.Add(1)
+		go func() {
+			defer lb.active.Done()
+			lb.Proxy(connection, time.Now().String())
+		}()
+	}
+}
+
+// Shutdown stops accepting, lets existing connections finish for up to
+// timeout and then closes whatever is left.
+func (lb *LB) Shutdown(timeout time.Duration) {
+	lb.connMu.Lock()
+	if lb.listener != nil {
+		lb.listener.Close()
+	}
+	if lb.packetConn != nil {
+		lb.packetConn.Close()
+	}
+	lb.connMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		lb.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		fmt.Println("all connections drained")
+		return
+	case <-time.After(timeout):
+	}
+
+	lb.connMu.Lock()
+	fmt.Println("drain deadline reached, closing ", len(lb.conns), " connections")
+	for c := range lb.conns {
+		c.Close()
+	}
+	lb.connMu.Unlock()
+	<-done
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpBackend runs handle on every connection and returns itself as a
+// Backend.
+func tcpBackend(t *testing.T, handle func(net.Conn)) *Backend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &Backend{Host: host, Port: port}
+}
+
+func dial(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+func TestHalfClose(t *testing.T) {
+	// the backend only answers once the client has finished sending
+	counter := tcpBackend(t, func(conn net.Conn) {
+		n, _ := io.Copy(io.Discard, conn)
+		fmt.Fprintf(conn, "got %d bytes", n)
+	})
+	addr := startTCP(t, testLB(NewPool("p", RoundRobin, []*Backend{counter})))
+
+	conn := dial(t, addr)
+	conn.Write([]byte("hello world"))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "got 11 bytes" {
+		t.Errorf("got %q after the half-close", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	silent := tcpBackend(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	// sends a byte every 50ms for half a second, reading nothing
+	talker := tcpBackend(t, func(conn net.Conn) {
+		for i := 0; i < 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			conn.Write([]byte{'x'})
+		}
+	})
+	for _, tc := range []struct {
+		name    string
+		backend *Backend
+		want    int
+	}{
+		{"nothing moves", silent, 0},
+		// the client direction is idle the whole time, the other is not
+		{"one direction moves", talker, 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lb := testLB(NewPool("p", RoundRobin, []*Backend{tc.backend}))
+			lb.Timeouts.Idle = 200 * time.Millisecond
+			conn := dial(t, startTCP(t, lb))
+			start := time.Now()
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("the balancer did not close the connection: %v", err)
+			}
+			if len(got) != tc.want {
+				t.Errorf("read %d bytes, want %d", len(got), tc.want)
+			}
+			if tc.want == 0 && time.Since(start) > 2*time.Second {
+				t.Errorf("closed after %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	echo := tcpBackend(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	lb := testLB(NewPool("p", RoundRobin, []*Backend{echo}))
+	addr := startTCP(t, lb)
+	conn := dial(t, addr)
+	conn.Write([]byte("a"))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lb.Shutdown(300 * time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Error("a new connection was accepted while draining")
+	}
+	// the open one keeps working until the deadline
+	conn.Write([]byte("b"))
+	if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != 'b' {
+		t.Fatalf("the draining connection stopped working: %q, %v", buf, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after its deadline")
+	}
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("the connection survived the drain deadline")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// TLS configures the client side of the balancer. With Passthrough the
+// ClientHello is only peeked at to read the SNI name and the encrypted
+// stream goes to the backend untouched; otherwise TLS is terminated with
+// the certificate matching the SNI name. SNIRoutes pick the pool in tcp
+// mode; in http mode routes can match on Host instead.
+type TLS struct {
+	Passthrough bool
+	Config      *tls.Config // termination only
+	SNIRoutes   []SNIRoute
+}
+
+type SNIRoute struct {
+	ServerName string // exact name or "*.example.com"
+	Pool       string
+}
+
+// poolFor returns the pool for an SNI name, or "" for the default pool.
+func (t *TLS) poolFor(serverName string) string {
+	for _, route := range t.SNIRoutes {
+		if matchHost(route.ServerName, serverName) {
+			return route.Pool
+		}
+	}
+	return ""
+}
+
+// terminationConfig loads every certificate pair; crypto/tls then serves
+// the first one whose names cover the client's SNI.
+func terminationConfig(pairs []CertConfig) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load %s: %w", pair.Cert, err)
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+	if len(cfg.Certificates) == 0 {
+		return nil, errors.New("tls termination needs at least one certificate")
+	}
+	return cfg, nil
+}
+
+// backendTLSConfig is used to re-encrypt traffic towards a pool.
+func backendTLSConfig(bc *BackendTLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         bc.ServerName,
+		InsecureSkipVerify: bc.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if bc.CA != "" {
+		pem, err := os.ReadFile(bc.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", bc.CA)
+		}
+	}
+	return cfg, nil
+}
+
+// clientTLS handles the TLS side of a freshly accepted tcp connection and
+// returns the SNI name together with the connection to proxy from.
+func (lb *LB) clientTLS(conn net.Conn) (string, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if lb.TLS.Passthrough {
+		serverName, hello, err := peekClientHello(conn)
+		if err != nil {
+			return "", nil, err
+		}
+		return serverName, &prefixConn{Conn: conn, r: io.MultiReader(hello, conn)}, nil
+	}
+
+	tlsConn := tls.Server(conn, lb.TLS.Config)
+	if err := tlsConn.Handshake(); err != nil {
+		return "", nil, err
+	}
+	return tlsConn.ConnectionState().ServerName, tlsConn, nil
+}
+
+// dialBackend connects to backend on behalf of clientConn, sending a PROXY
+// header and wrapping the connection in TLS when the pool asks for it.
+func (lb *LB) dialBackend(pool *Pool, backend *Backend, clientConn net.Conn) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", backend.Addr(), lb.Timeouts.Connect)
+	if err != nil {
+		return nil, err
+	}
+	if pool.SendProxyProtocol > 0 {
+		if err := writeProxyHeader(conn, pool.SendProxyProtocol, clientConn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if pool.BackendTLS == nil {
+		return conn, nil
+	}
+	cfg := pool.BackendTLS
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = backend.Host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekClientHello reads the ClientHello off conn and returns the SNI name
+// plus the bytes consumed so they can be replayed to the backend. It lets
+// crypto/tls do the parsing by starting a server handshake on a read-only
+// view of the connection and aborting it as soon as the hello is parsed.
+func peekClientHello(conn net.Conn) (string, io.Reader, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("reading client hello: %w", err)
+	}
+	return serverName, &peeked, nil
+}
+
+// readOnlyConn feeds a tls.Server from a reader and refuses every write so
+// nothing reaches the real client while peeking.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)      { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// prefixConn replays already consumed bytes before reading from the
+// underlying connection again.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a self-signed certificate for names (DNS names or IPs),
+// written to a temp dir so it can also go through terminationConfig.
+type testCert struct {
+	cert     tls.Certificate
+	roots    *x509.CertPool
+	certFile string
+	keyFile  string
+}
+
+func newTestCert(t *testing.T, names ...string) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tc := testCert{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(tc.certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if tc.cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	tc.roots = x509.NewCertPool()
+	tc.roots.AppendCertsFromPEM(certPEM)
+	return tc
+}
+
+// nameServer answers every connection with its name and a newline, over
+// TLS when cfg is set, and returns itself as a Backend.
+func nameServer(t *testing.T, name string, cfg *tls.Config) *Backend {
+	t.Helper()
+	var l net.Listener
+	var err error
+	if cfg != nil {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", cfg)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name + "\n"))
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &Backend{Host: host, Port: port}
+}
+
+// startTCP runs lb in tcp mode on a free port and returns its address.
+func startTCP(t *testing.T, lb *LB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.ServeTCP(l)
+	t.Cleanup(func() { lb.Shutdown(time.Second) })
+	return l.Addr().String()
+}
+
+// testLB is a tcp balancer over pools, the first one being the default.
+func testLB(pools ...*Pool) *LB {
+	lb := &LB{
+		Mode:     "tcp",
+		Pools:    make(map[string]*Pool),
+		Router:   NewRouter(nil, pools[0].Name),
+		Timeouts: defaultTimeouts,
+	}
+	for _, p := range pools {
+		lb.Pools[p.Name] = p
+	}
+	return lb
+}
+
+func readLine(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading from the balancer: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestTLSTermination(t *testing.T) {
+	a := newTestCert(t, "a.test")
+	b := newTestCert(t, "b.test")
+	cfg, err := terminationConfig([]CertConfig{{Cert: a.certFile, Key: a.keyFile}, {Cert: b.certFile, Key: b.keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := testLB(
+		NewPool("a", RoundRobin, []*Backend{nameServer(t, "a", nil)}),
+		NewPool("b", RoundRobin, []*Backend{nameServer(t, "b", nil)}),
+	)
+	lb.TLS = &TLS{Config: cfg, SNIRoutes: []SNIRoute{{ServerName: "b.test", Pool: "b"}}}
+	addr := startTCP(t, lb)
+
+	for _, tc := range []struct {
+		serverName string
+		roots      *x509.CertPool
+		want       string
+	}{
+		{"a.test", a.roots, "a"},
+		{"b.test", b.roots, "b"},
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: tc.serverName, RootCAs: tc.roots})
+		if err != nil {
+			t.Fatalf("%s: handshake with the balancer: %v", tc.serverName, err)
+		}
+		if got := readLine(t, conn); got != tc.want {
+			t.Errorf("%s: routed to %q, want %q", tc.serverName, got, tc.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestTLSPassthroughRoutesOnSNI(t *testing.T) {
+	a := newTestCert(t, "a.test")
+	b := newTestCert(t, "b.test")
+	lb := testLB(
+		NewPool("a", RoundRobin, []*Backend{nameServer(t, "a", &tls.Config{Certificates: []tls.Certificate{a.cert}})}),
+		NewPool("b", RoundRobin, []*Backend{nameServer(t, "b", &tls.Config{Certificates: []tls.Certificate{b.cert}})}),
+	)
+	lb.TLS = &TLS{Passthrough: true, SNIRoutes: []SNIRoute{{ServerName: "*.test", Pool: "b"}}}
+	addr := startTCP(t, lb)
+
+	// the balancer holds no certificate: verifying b's proves the stream
+	// reached b untouched
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "b.test", RootCAs: b.roots})
+	if err != nil {
+		t.Fatalf("handshake through the balancer: %v", err)
+	}
+	defer conn.Close()
+	if got := readLine(t, conn); got != "b" {
+		t.Errorf("routed to %q, want b", got)
+	}
+}
+
+func TestBackendReencryption(t *testing.T) {
+	backendCert := newTestCert(t, "127.0.0.1")
+	backend := nameServer(t, "secure", &tls.Config{Certificates: []tls.Certificate{backendCert.cert}})
+	dial := func(roots *x509.CertPool) net.Conn {
+		t.Helper()
+		pool := NewPool("secure", RoundRobin, []*Backend{{Host: backend.Host, Port: backend.Port}})
+		var err error
+		if pool.BackendTLS, err = backendTLSConfig(&BackendTLSConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		pool.BackendTLS.RootCAs = roots
+		conn, err := net.Dial("tcp", startTCP(t, testLB(pool)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	if got := readLine(t, dial(backendCert.roots)); got != "secure" {
+		t.Errorf("got %q through the re-encrypted hop, want secure", got)
+	}
+
+	// a backend whose certificate does not verify is not proxied to
+	conn := dial(x509.NewCertPool())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if !strings.Contains(string(got), "500") || strings.Contains(string(got), "secure") {
+		t.Errorf("got %q from a backend that failed verification, want a 500", got)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// largest possible UDP payload
+const maxDatagram = 64 * 1024
+
+// udpSession pins one client address to one backend. Datagrams from the
+// client go out on conn, a socket of its own connected to the backend, and
+// whatever comes back on conn is relayed to the client. A session ends
+// after Timeouts.Idle (defaultUDPIdle when unset) without traffic either
+// way.
+type udpSession struct {
+	client     net.Addr
+	pool       *Pool
+	backend    *Backend
+	conn       net.Conn
+	lastActive atomic.Int64
+	in, out    atomic.Int64
+	access     *access
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// defaultUDPIdle ends a session when Timeouts.Idle is not set: unlike a
+// tcp connection a udp session has no close, idling out is its only end.
+// udp sessions are usually one query and its answer.
+const defaultUDPIdle = 30 * time.Second
+
+func (lb *LB) udpIdle() time.Duration {
+	if lb.Timeouts.Idle <= 0 {
+		return defaultUDPIdle
+	}
+	return lb.Timeouts.Idle
+}
+
+// udpSessions is the session table, by client address. A session is in it
+// exactly as long as datagrams may be written to it.
+type udpSessions struct {
+	mu sync.Mutex
+	m  map[string]*udpSession
+}
+
+// end removes s from the table unless it was used within idle (0 removes
+// it regardless), reporting whether it did. Once removed nobody writes to
+// s any more and it can be closed.
+func (t *udpSessions) end(s *udpSession, idle time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if idle > 0 && s.idleFor() < idle {
+		return false
+	}
+	if t.m[s.client.String()] == s {
+		delete(t.m, s.client.String())
+	}
+	return true
+}
+
+// ServeUDP balances datagrams arriving on pc across the default pool until
+// pc is closed.
+func (lb *LB) ServeUDP(pc net.PacketConn) error {
+	lb.connMu.Lock()
+	lb.packetConn = pc
+	lb.connMu.Unlock()
+
+	sessions := &udpSessions{m: make(map[string]*udpSession)}
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		// the datagram is sent with the table locked so that a session
+		// cannot idle out between being looked up and being written to
+		sessions.mu.Lock()
+		s, ok := sessions.m[addr.String()]
+		if !ok {
+			s, err = lb.openUDPSession(addr)
+			if err != nil {
+				sessions.mu.Unlock()
+				fmt.Println("dropping datagram from ", addr, " => ", err)
+				continue
+			}
+			sessions.m[addr.String()] = s
+			go func() {
+				lb.relayReplies(pc, s, sessions)
+				lb.closeUDPSession(s)
+			}()
+		}
+		s.touch()
+		_, err = s.conn.Write(buf[:n])
+		sessions.mu.Unlock()
+		if err != nil {
+			fmt.Println("err while sending datagram to ", s.backend.Addr(), " => ", err)
+			continue
+		}
+		s.in.Add(int64(n))
+	}
+}
+
+func (lb *LB) openUDPSession(client net.Addr) (*udpSession, error) {
+	pool := lb.Pools[lb.Router.DefaultPool]
+	key := ""
+	if pool.Sticky != nil && pool.Sticky.Mode == StickyHash {
+		key = clientIP(client.String())
+	}
+	backend, err := pool.Pick(key)
+	if err != nil {
+		return nil, err
+	}
+	a := &access{start: time.Now(), mode: "udp", id: time.Now().String(), client: client.String(), pool: pool.Name, backend: backend.Addr()}
+	conn, err := net.DialTimeout("udp", backend.Addr(), lb.Timeouts.Connect)
+	if err != nil {
+		pool.Observe(backend, 0, 0, 0, true)
+		pool.Done(backend)
+		a.err = err
+		lb.logAccess(a)
+		return nil, err
+	}
+	lb.active.Add(1)
+	lb.track(conn)
+	s := &udpSession{client: client, pool: pool, backend: backend, conn: conn, access: a}
+	s.touch()
+	return s, nil
+}
+
+// relayReplies copies backend replies to the client until the session
+// idles out or the backend socket fails, and takes it out of sessions.
+func (lb *LB) relayReplies(pc net.PacketConn, s *udpSession, sessions *udpSessions) {
+	idle := lb.udpIdle()
+	buf := make([]byte, maxDatagram)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if !sessions.end(s, idle) {
+					// the client kept the session alive
+					continue
+				}
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				// typically ICMP port unreachable: nothing listens there
+				s.access.err = err
+			}
+			sessions.end(s, 0)
+			return
+		}
+		s.touch()
+		if _, err := pc.WriteTo(buf[:n], s.client); err != nil {
+			fmt.Println("err while relaying datagram to ", s.client, " => ", err)
+			continue
+		}
+		s.out.Add(int64(n))
+	}
+}
+
+func (lb *LB) closeUDPSession(s *udpSession) {
+	s.conn.Close()
+	lb.untrack(s.conn)
+	s.access.bytesIn, s.access.bytesOut = s.in.Load(), s.out.Load()
+	s.pool.Observe(s.backend, s.access.bytesIn, s.access.bytesOut, 0, s.access.err != nil)
+	s.pool.Done(s.backend)
+	lb.logAccess(s.access)
+	lb.active.Done()
+}
+
+// probeUDP sends hc.Payload and waits for a reply. Without a payload to
+// expect an answer to, only a refused port counts as down: silence is all
+// a UDP server owes us.
+func probeUDP(hc HealthCheck, b *Backend) error {
+	conn, err := net.DialTimeout("udp", b.Addr(), hc.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if _, err := conn.Write([]byte(hc.Payload)); err != nil {
+		return err
+	}
+	_, err = conn.Read(make([]byte, maxDatagram))
+	var ne net.Error
+	if hc.Payload == "" && errors.As(err, &ne) && ne.Timeout() {
+		return nil
+	}
+	return err
+}
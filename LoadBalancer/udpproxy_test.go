@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// udpEcho answers every datagram with itself.
+func udpEcho(t *testing.T) *Backend {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	return &Backend{Host: host, Port: port}
+}
+
+// TestUDPSessionsIdleOutWithoutDroppingDatagrams sends at about the idle
+// timeout, so sessions keep expiring just as the next datagram comes in.
+func TestUDPSessionsIdleOutWithoutDroppingDatagrams(t *testing.T) {
+	lb := testLB(NewPool("udp", RoundRobin, []*Backend{udpEcho(t)}))
+	lb.Mode = "udp"
+	lb.Timeouts.Idle = 20 * time.Millisecond
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go lb.ServeUDP(pc)
+	t.Cleanup(func() { lb.Shutdown(time.Second) })
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf := make([]byte, 64)
+	for i := 0; i < 30; i++ {
+		time.Sleep(lb.Timeouts.Idle + time.Duration(i%5-2)*time.Millisecond)
+		msg := fmt.Sprint("ping ", i)
+		client.Write([]byte(msg))
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("datagram %d: got %q, %v", i, buf[:n], err)
+		}
+	}
+}
+
+func TestUDPNeedsAnIdleTimeout(t *testing.T) {
+	_, err := NewLBFromConfig(&Config{
+		Mode:      "udp",
+		Pools:     []PoolConfig{{Name: "dns"}},
+		Timeouts:  TimeoutConfig{Idle: "0s"},
+		AccessLog: &AccessLogConfig{Disabled: true},
+	})
+	if err == nil || !strings.Contains(err.Error(), "must be positive") {
+		t.Errorf("err = %v, want a zero idle timeout rejected in udp mode", err)
+	}
+
+	lb := &LB{}
+	if lb.udpIdle() != defaultUDPIdle {
+		t.Errorf("an LB built without a timeout idles udp sessions after %s", lb.udpIdle())
+	}
+}
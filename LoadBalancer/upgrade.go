@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headerHasToken reports whether a comma separated header such as
+// Connection contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// isEventStream reports a server-sent events response, which must reach
+// the client event by event instead of being buffered.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// serveWebSocket takes over the client connection and, once the backend
+// accepts the upgrade, turns it into a plain bidirectional tunnel.
+func (lb *LB) serveWebSocket(w http.ResponseWriter, r *http.Request, route *Route, pool *Pool, key string, a *access) {
+	a.mode = "websocket"
+	backend, err := pool.PickLongLived(key)
+	if err != nil {
+		a.err = err
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	a.backend = backend.Addr()
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		pool.DoneLongLived(backend)
+		a.err = err
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	lb.active.Add(1)
+	defer lb.active.Done()
+	lb.track(clientConn)
+	defer lb.untrack(clientConn)
+	defer clientConn.Close()
+
+	dialStart := time.Now()
+	backendConn, err := lb.dialBackend(pool, backend, clientConn)
+	if err != nil {
+		a.status, a.err = http.StatusBadGateway, fmt.Errorf("dailing %s: %w", backend.Addr(), err)
+		io.WriteString(clientConn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\nContent-Length: 28\r\n\r\nbackend server not avialable")
+		pool.Observe(backend, 0, 0, 0, true)
+		pool.DoneLongLived(backend)
+		return
+	}
+	connectTime := time.Since(dialStart)
+	lb.track(backendConn)
+	defer lb.untrack(backendConn)
+	defer backendConn.Close()
+
+	out := r.Clone(r.Context())
+	out.URL.Path = route.RewritePath(r.URL.Path)
+	out.URL.RawPath = ""
+	removeHopHeaders(out.Header)
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	out.Header.Set("X-Forwarded-For", forwardedFor(r))
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if err := out.Write(backendConn); err != nil {
+		a.status, a.err = http.StatusBadGateway, fmt.Errorf("sending upgrade: %w", err)
+		pool.Observe(backend, 0, 0, 0, true)
+		pool.DoneLongLived(backend)
+		return
+	}
+
+	backendBuf := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendBuf, out)
+	if err != nil {
+		a.status, a.err = http.StatusBadGateway, fmt.Errorf("reading upgrade response: %w", err)
+		pool.Observe(backend, 0, 0, 0, true)
+		pool.DoneLongLived(backend)
+		return
+	}
+	resp.Header.Set("X-Backend-Server", backend.Addr())
+	resp.Write(clientConn)
+	a.status = resp.StatusCode
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// backend refused the upgrade; its answer has been passed on
+		pool.Observe(backend, 0, 0, connectTime, resp.StatusCode >= 500)
+		pool.DoneLongLived(backend)
+		return
+	}
+
+	// bytes either side sent right behind the handshake are already buffered
+	a.bytesIn, a.bytesOut = lb.splice(
+		&prefixConn{Conn: clientConn, r: io.MultiReader(clientBuf.Reader, clientConn)},
+		&prefixConn{Conn: backendConn, r: backendBuf},
+	)
+	pool.Observe(backend, a.bytesIn, a.bytesOut, connectTime, false)
+	pool.DoneLongLived(backend)
+}
+
+// copyFlushing streams an event-stream body, flushing after every read so
+// each event reaches the client as soon as the backend sends it.
+func copyFlushing(w http.ResponseWriter, body io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 4*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return written, ferr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// forwardedFor appends the client of r to any X-Forwarded-For it came with.
+func forwardedFor(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.Header.Get("X-Forwarded-For")
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		return prior + ", " + ip
+	}
+	return ip
+}
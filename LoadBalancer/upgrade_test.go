@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// wsBackend accepts websocket upgrades with status and, after a 101,
+// echoes whatever comes through the tunnel.
+func wsBackend(t *testing.T, status int) *Backend {
+	return tcpBackend(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		r, err := http.ReadRequest(br)
+		if err != nil || !isWebSocket(r) {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		if status != http.StatusSwitchingProtocols {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		io.Copy(conn, br)
+	})
+}
+
+// longLived waits for the long-lived count of the pool's first backend to
+// settle on want.
+func longLived(t *testing.T, pool *Pool, want int) {
+	t.Helper()
+	var got int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = pool.Stats().Backends[0].LongLived; got == want {
+			return
+		}
+	}
+	t.Errorf("%d long-lived connections, want %d", got, want)
+}
+
+// upgrade sends a websocket handshake to the balancer at addr and returns
+// the connection and the response.
+func upgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	u, _ := url.Parse(addr)
+	conn := dial(t, u.Host)
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: "+u.Host+"\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestWebSocketTunnel(t *testing.T) {
+	pool := NewPool("ws", RoundRobin, []*Backend{wsBackend(t, http.StatusSwitchingProtocols)})
+	addr := startHTTP(t, testLB(pool))
+
+	conn, br, resp := upgrade(t, addr)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade answered %s", resp.Status)
+	}
+	longLived(t, pool, 1)
+	for _, msg := range []string{"ping", "pong"} {
+		io.WriteString(conn, msg)
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != msg {
+			t.Fatalf("tunnel echoed %q, %v, want %q", buf, err, msg)
+		}
+	}
+	conn.Close()
+	longLived(t, pool, 0)
+	if active := pool.Stats().Backends[0].Active; active != 0 {
+		t.Errorf("%d connections still active after the tunnel closed", active)
+	}
+}
+
+func TestWebSocketRefused(t *testing.T) {
+	pool := NewPool("ws", RoundRobin, []*Backend{wsBackend(t, http.StatusForbidden)})
+	addr := startHTTP(t, testLB(pool))
+
+	if _, _, resp := upgrade(t, addr); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a refused upgrade answered %s", resp.Status)
+	}
+	longLived(t, pool, 0)
+}
+
+func TestEventStreamIsFlushed(t *testing.T) {
+	release := make(chan struct{})
+	events := httpBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: two\n\n")
+	})
+	pool := NewPool("events", RoundRobin, []*Backend{events})
+	addr := startHTTP(t, testLB(pool))
+
+	resp, err := http.Get(addr + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	// the first event arrives while the backend still holds the second
+	line, err := br.ReadString('\n')
+	if err != nil || line != "data: one\n" {
+		t.Fatalf("first event %q, %v", line, err)
+	}
+	longLived(t, pool, 1)
+	close(release)
+	rest, _ := io.ReadAll(br)
+	if string(rest) != "\ndata: two\n\n" {
+		t.Errorf("rest of the stream %q", rest)
+	}
+	longLived(t, pool, 0)
+}
+
+func TestIsWebSocket(t *testing.T) {
+	for _, tc := range []struct {
+		connection, upgrade string
+		want                bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "WebSocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "h2c", false},
+		{"", "", false},
+	} {
+		h := http.Header{}
+		h.Set("Connection", tc.connection)
+		h.Set("Upgrade", tc.upgrade)
+		if got := isWebSocket(&http.Request{Header: h}); got != tc.want {
+			t.Errorf("Connection %q Upgrade %q: %v, want %v", tc.connection, tc.upgrade, got, tc.want)
+		}
+	}
+}
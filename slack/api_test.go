@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestServer runs the api on a fresh memStore.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store = newMemStore()
+	searchIdx = newTextIndex()
+	sockets = newConnRegistry()
+	tokenSecret = []byte("test secret")
+	// never served: broadcasts go to rooms nobody is in
+	socketServer = connectToWebsocket("")
+	mux := http.NewServeMux()
+	routes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// session is a signed in user talking to the test server.
+type session struct {
+	t     *testing.T
+	base  string
+	id    int64
+	name  string
+	token string
+}
+
+// do sends body as json and decodes the answer into out unless it is nil.
+// It returns the status code.
+func (s *session) do(method, path string, body, out interface{}) int {
+	s.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	req, err := http.NewRequest(method, s.base+path, &payload)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			s.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func signupAs(t *testing.T, srv *httptest.Server, name string) *session {
+	t.Helper()
+	s := &session{t: t, base: srv.URL, name: name}
+	var resp LoginResponse
+	if code := s.do("POST", "/signup", LoginRequest{UserName: name, Password: name + " password"}, &resp); code != http.StatusCreated {
+		t.Fatalf("signup of %s answered %d", name, code)
+	}
+	s.id, s.token = resp.Id, resp.Token
+	return s
+}
+
+func (s *session) post(channelId int64, msg string) Message {
+	s.t.Helper()
+	var m Message
+	if code := s.do("POST", fmt.Sprintf("/message/%d/%d", s.id, channelId), MessageRequest{Msg: msg}, &m); code != http.StatusOK {
+		s.t.Fatalf("posting %q answered %d", msg, code)
+	}
+	return m
+}
+
+func (s *session) unread(channelId int64) int {
+	s.t.Helper()
+	var channels []UserChannel
+	if code := s.do("GET", fmt.Sprintf("/users/%d/channels", s.id), nil, &channels); code != http.StatusOK {
+		s.t.Fatalf("listing channels answered %d", code)
+	}
+	for _, ch := range channels {
+		if ch.ChannelID == channelId {
+			return ch.Unread
+		}
+	}
+	s.t.Fatalf("%s is not in channel %d", s.name, channelId)
+	return 0
+}
+
+func (s *session) page(channelId int64, query string) MessagePage {
+	s.t.Helper()
+	var page MessagePage
+	if code := s.do("GET", fmt.Sprintf("/channels/%d/messages?%s", channelId, query), nil, &page); code != http.StatusOK {
+		s.t.Fatalf("listing messages with %q answered %d", query, code)
+	}
+	return page
+}
+
+func texts(messages []Message) []string {
+	out := make([]string, len(messages))
+	for i, m := range messages {
+		out[i] = m.Msg
+	}
+	return out
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	srv := newTestServer(t)
+	anon := &session{t: t, base: srv.URL}
+
+	if code := anon.do("POST", "/login", LoginRequest{UserName: "ann", Password: "ann password"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login of an unknown user answered %d, want 401", code)
+	}
+	if _, err := store.UserByName("ann"); err != errNotFound {
+		t.Errorf("a failed login created the user, err = %v", err)
+	}
+	ann := signupAs(t, srv, "ann")
+	if code := anon.do("POST", "/signup", LoginRequest{UserName: "ann", Password: "other password"}, nil); code != http.StatusConflict {
+		t.Errorf("signing up a taken name answered %d, want 409", code)
+	}
+	if code := anon.do("POST", "/login", LoginRequest{UserName: "ann", Password: "wrong password"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password answered %d, want 401", code)
+	}
+	var resp LoginResponse
+	if code := anon.do("POST", "/login", LoginRequest{UserName: "ann", Password: "ann password"}, &resp); code != http.StatusOK || resp.Id != ann.id {
+		t.Errorf("login answered %d for user %d, want 200 for %d", code, resp.Id, ann.id)
+	}
+
+	// an account from before passwords cannot be claimed through login
+	if _, err := store.CreateUser("legacy", "", resp.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if code := anon.do("POST", "/login", LoginRequest{UserName: "legacy", Password: "any password"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login to a legacy account answered %d, want 401", code)
+	}
+	if u, _ := store.UserByName("legacy"); u.PasswordHash != "" {
+		t.Error("login set the password of a legacy account")
+	}
+
+	if code := anon.do("GET", fmt.Sprintf("/users/%d/channels", ann.id), nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("an api call without a token answered %d, want 401", code)
+	}
+}
+
+func TestChannelMessagesEndToEnd(t *testing.T) {
+	srv := newTestServer(t)
+	ann := signupAs(t, srv, "ann")
+	bob := signupAs(t, srv, "bob")
+
+	if code := ann.do("GET", "/channel/ann/nobody", nil, nil); code != http.StatusNotFound {
+		t.Errorf("a DM with an unknown user answered %d, want 404", code)
+	}
+	var created []Message
+	if code := ann.do("GET", "/channel/ann/bob", nil, &created); code != http.StatusOK || len(created) != 1 {
+		t.Fatalf("creating the DM answered %d with %v", code, created)
+	}
+	dm := created[0].ChannelID
+	if code := bob.do("POST", fmt.Sprintf("/message/%d/%d", ann.id, dm), MessageRequest{Msg: "forged"}, nil); code != http.StatusForbidden {
+		t.Errorf("posting as somebody else answered %d, want 403", code)
+	}
+
+	var posted []Message
+	for i := 1; i <= 5; i++ {
+		posted = append(posted, ann.post(dm, fmt.Sprintf("msg %d", i)))
+	}
+
+	// the latest two, then back to the start
+	latest := ann.page(dm, "limit=2")
+	if got := texts(latest.Messages); fmt.Sprint(got) != "[msg 4 msg 5]" || latest.Before == "" {
+		t.Fatalf("latest page %v before %q", got, latest.Before)
+	}
+	older := ann.page(dm, "limit=2&before="+url.QueryEscape(latest.Before))
+	if got := texts(older.Messages); fmt.Sprint(got) != "[msg 2 msg 3]" {
+		t.Errorf("older page %v", got)
+	}
+	oldest := ann.page(dm, "limit=2&before="+url.QueryEscape(older.Before))
+	if got := texts(oldest.Messages); len(got) != 2 || got[1] != "msg 1" || oldest.Before != "" {
+		t.Errorf("oldest page %v before %q, want the start of the channel", got, oldest.Before)
+	}
+	// forward from msg 3, then caught up
+	newer := ann.page(dm, "limit=2&after="+url.QueryEscape(older.After))
+	if got := texts(newer.Messages); fmt.Sprint(got) != "[msg 4 msg 5]" {
+		t.Errorf("newer page %v", got)
+	}
+	caughtUp := ann.page(dm, "after="+url.QueryEscape(newer.After))
+	if len(caughtUp.Messages) != 0 || caughtUp.After != newer.After {
+		t.Errorf("caught up page %v after %q, want none and the same cursor back", texts(caughtUp.Messages), caughtUp.After)
+	}
+
+	if n := bob.unread(dm); n != 6 {
+		t.Errorf("bob has %d unread, want 6", n)
+	}
+
+	// edit keeps the old text, delete leaves a tombstone
+	edit := fmt.Sprintf("/message/%d/%d/%d", ann.id, dm, posted[0].MessageID)
+	if code := bob.do("PUT", fmt.Sprintf("/message/%d/%d/%d", bob.id, dm, posted[0].MessageID), MessageRequest{Msg: "bob was here"}, nil); code != http.StatusForbidden {
+		t.Errorf("editing somebody else's message answered %d, want 403", code)
+	}
+	var edited Message
+	if code := ann.do("PUT", edit, MessageRequest{Msg: "msg 1, fixed"}, &edited); code != http.StatusOK || edited.EditedAt == nil {
+		t.Fatalf("edit answered %d with %+v", code, edited)
+	}
+	var history []MessageEdit
+	bob.do("GET", fmt.Sprintf("/channels/%d/messages/%d/edits", dm, posted[0].MessageID), nil, &history)
+	if len(history) != 1 || history[0].OldMsg != "msg 1" {
+		t.Errorf("edit history %+v", history)
+	}
+	if code := ann.do("DELETE", fmt.Sprintf("/message/%d/%d/%d", ann.id, dm, posted[4].MessageID), nil, nil); code != http.StatusNoContent {
+		t.Fatalf("delete answered %d", code)
+	}
+	last := bob.page(dm, "limit=1").Messages
+	if len(last) != 1 || last[0].MessageID != posted[4].MessageID || last[0].DeletedAt == nil {
+		t.Errorf("latest message %+v, want the tombstone of msg 5", last)
+	}
+
+	// neither the deleted message nor a thread reply counts as unread
+	var reply Message
+	if code := ann.do("POST", fmt.Sprintf("/message/%d/%d", ann.id, dm), MessageRequest{Msg: "in the thread", ParentID: posted[1].MessageID}, &reply); code != http.StatusOK {
+		t.Fatalf("replying answered %d", code)
+	}
+	if n := bob.unread(dm); n != 5 {
+		t.Errorf("bob has %d unread after a delete and a reply, want 5", n)
+	}
+	if code := bob.do("POST", fmt.Sprintf("/channels/%d/read/%d", dm, bob.id), nil, nil); code != http.StatusOK {
+		t.Fatalf("marking read answered %d", code)
+	}
+	if n := bob.unread(dm); n != 0 {
+		t.Errorf("bob has %d unread after reading, want 0", n)
+	}
+	if n := ann.unread(dm); n != 0 {
+		t.Errorf("ann has %d unread in a channel only she wrote to", n)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Session tokens are JWTs signed with HS256. Every instance behind the load
+// balancer must run with the same secret to accept each other's tokens.
+const tokenTTL = 24 * time.Hour
+
+var tokenSecret []byte
+
+// Claims is what a session token says about its holder.
+type Claims struct {
+	UserID    int64  `json:"sub,string"`
+	UserName  string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type LoginRequest struct {
+	UserName string `json:"userName"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	User
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var (
+	errBadToken     = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func signToken(c Claims) string {
+	payload, _ := json.Marshal(c)
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + tokenSignature(unsigned)
+}
+
+func tokenSignature(unsigned string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks the signature and expiry of token. Only the header
+// this server issues is accepted, which rules out "alg":"none" tricks.
+func verifyToken(token string) (Claims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return Claims{}, errBadToken
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(tokenSignature(header+"."+payload))) {
+		return Claims{}, errBadToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Claims{}, errBadToken
+	}
+	var c Claims
+	if err := json.Unmarshal(raw, &c); err != nil || c.UserID == 0 {
+		return Claims{}, errBadToken
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return Claims{}, errTokenExpired
+	}
+	return c, nil
+}
+
+// Passwords are stored as pbkdf2-sha256$iterations$salt$key.
+const passwordIterations = 600000
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err1 := strconv.Atoi(parts[1])
+	salt, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err3 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// readCredentials decodes {"userName","password"}, answering the request
+// itself when they are missing.
+func readCredentials(w http.ResponseWriter, r *http.Request) (LoginRequest, bool) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return req, false
+	}
+	if req.UserName == "" || len(req.Password) < 8 {
+		http.Error(w, "userName and a password of at least 8 characters are required", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// writeSession answers with user and a fresh session token for them.
+func writeSession(w http.ResponseWriter, status int, user User) {
+	now := time.Now()
+	claims := Claims{UserID: user.Id, UserName: user.UserName, IssuedAt: now.Unix(), ExpiresAt: now.Add(tokenTTL).Unix()}
+	writeJSON(w, status, LoginResponse{User: user, Token: signToken(claims), ExpiresAt: time.Unix(claims.ExpiresAt, 0)})
+}
+
+// signup serves POST /signup with {"userName","password"}: it creates the
+// account, which /createUser used to do without a password, and signs it
+// in.
+func signup(w http.ResponseWriter, r *http.Request) {
+	req, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		fmt.Println("failed to hash password, err =  ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("creating a new user")
+	user, err := store.CreateUser(req.UserName, hash, time.Now())
+	if errors.Is(err, errNameTaken) {
+		http.Error(w, "user name is taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Println("insert error = ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	writeSession(w, http.StatusCreated, user)
+}
+
+// login serves POST /login with {"userName","password"} and answers with
+// the user and a session token. It never creates or changes an account:
+// new users go through /signup, and accounts from before passwords
+// existed stay locked until an admin sets one with slack passwd.
+func login(w http.ResponseWriter, r *http.Request) {
+	req, ok := readCredentials(w, r)
+	if !ok {
+		return
+	}
+	user, err := store.UserByName(req.UserName)
+	if err != nil && !errors.Is(err, errNotFound) {
+		fmt.Println("error while fetch user, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	if user.PasswordHash == "" || !checkPassword(user.PasswordHash, req.Password) {
+		http.Error(w, "wrong user name or password", http.StatusUnauthorized)
+		return
+	}
+	writeSession(w, http.StatusOK, user)
+}
+
+type claimsKey struct{}
+
+// bearerToken takes the token from the Authorization header, or from the
+// token query parameter where headers cannot be set (socket.io clients).
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authed wraps h so it only runs for a valid session token. actor names the
+// path value that identifies the acting user, which has to be the caller:
+// a user id, or for a ...Name value a user name. An empty actor only
+// requires a signed in caller.
+func authed(actor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := verifyToken(bearerToken(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="slack"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if actor != "" {
+			v := r.PathValue(actor)
+			self := v == strconv.FormatInt(claims.UserID, 10)
+			if strings.HasSuffix(actor, "Name") {
+				self = v == claims.UserName
+			}
+			if !self {
+				http.Error(w, "cannot act for another user", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+// caller returns the claims authed put on the request.
+func caller(r *http.Request) Claims {
+	c, _ := r.Context().Value(claimsKey{}).(Claims)
+	return c
+}
+
+// canRead lets the caller read channelId: members always, and anyone signed
+// in for public and broadcast channels. It answers the request itself
+// when not.
+func canRead(w http.ResponseWriter, r *http.Request, channelId int64) bool {
+	ch, err := store.Channel(channelId)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		fmt.Println("error while fetch channel, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return false
+	}
+	if ch.ChannelType == ChannelPublic || ch.ChannelType == ChannelBroadcast {
+		return true
+	}
+	_, err = store.Membership(channelId, caller(r).UserID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, errNotMember.Error(), http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		fmt.Println("error while fetch membership, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// socketClaims verifies the token a socket.io client connects with, given
+// as the token query parameter or an Authorization header.
+func socketClaims(c socketio.Conn) (Claims, error) {
+	u := c.URL()
+	token := u.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(c.RemoteHeader().Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	return verifyToken(token)
+}
+
+// socketUser is the user a connection authenticated as on connect.
+func socketUser(c socketio.Conn) int64 {
+	claims, _ := c.Context().(Claims)
+	return claims.UserID
+}
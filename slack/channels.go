@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// channel types, see brainstroming.md
+const (
+	ChannelDM        = "DM"
+	ChannelGroup     = "group"     // private, members join by invite
+	ChannelPublic    = "public"    // anyone can join
+	ChannelBroadcast = "broadcast" // anyone can join, only admins post
+)
+
+// membership roles
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// UserChannel is a channel as seen by one of its members.
+type UserChannel struct {
+	Channel
+	Role       string     `json:"role"`
+	LastReadAt *time.Time `json:"last_read_at,omitempty"`
+	Unread     int        `json:"unread"`
+}
+
+type CreateChannelRequest struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	CreatorID int64  `json:"creator_id"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	outputBytes, _ := json.Marshal(v)
+	_, err := w.Write(outputBytes)
+	if err != nil {
+		fmt.Println("error while writing response to client, err =  ", err.Error())
+	}
+}
+
+// pathID reads a numeric id from the request path.
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, r.PathValue(name))
+	}
+	return id, nil
+}
+
+// addMember inserts a membership unless the user already has one. The
+// delivery cursor starts at now: history from before joining is not
+// something the new member missed.
+func addMember(channelId, userId int64, role string) (bool, error) {
+	if _, err := store.Membership(channelId, userId); err == nil {
+		return false, nil
+	} else if !errors.Is(err, errNotFound) {
+		return false, err
+	}
+	now := time.Now()
+	if err := store.AddMember(channelId, userId, role, &now); err != nil {
+		return false, err
+	}
+	followChannel(userId, channelId, true)
+	return true, nil
+}
+
+// loadChannelFor fetches the channel in the path and the membership of
+// userId in it, answering the request itself when either is missing.
+func loadChannelFor(w http.ResponseWriter, r *http.Request, userId int64) (Channel, Membership, bool) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Channel{}, Membership{}, false
+	}
+	ch, err := store.Channel(channelId)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return Channel{}, Membership{}, false
+	}
+	if err != nil {
+		fmt.Println("error while fetch channel, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return Channel{}, Membership{}, false
+	}
+	m, err := store.Membership(channelId, userId)
+	if err != nil && !errors.Is(err, errNotFound) {
+		fmt.Println("error while fetch membership, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return Channel{}, Membership{}, false
+	}
+	return ch, m, true
+}
+
+// createGroupChannel creates a named group, public or broadcast channel
+// with its creator as the admin.
+func createGroupChannel(w http.ResponseWriter, r *http.Request) {
+	var req CreateChannelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if req.Type != ChannelGroup && req.Type != ChannelPublic && req.Type != ChannelBroadcast {
+		http.Error(w, "type must be group, public or broadcast", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Name) > 25 {
+		http.Error(w, "name must be 1 to 25 characters", http.StatusBadRequest)
+		return
+	}
+	// the creator is whoever is signed in
+	if req.CreatorID != 0 && req.CreatorID != caller(r).UserID {
+		http.Error(w, "cannot act for another user", http.StatusForbidden)
+		return
+	}
+	req.CreatorID = caller(r).UserID
+	creator, err := store.User(req.CreatorID)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "creator not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch user, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+
+	ch, err := store.CreateChannel(req.Type, req.Name)
+	if err != nil {
+		fmt.Println("failed to create channel err =  ", req.Name, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	if _, err := addMember(ch.ChannelID, req.CreatorID, RoleAdmin); err != nil {
+		fmt.Println("failed to insert creator membership err =  ", req.Name, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	created := Message{SenderID: req.CreatorID, ChannelID: ch.ChannelID, Msg: creator.UserName + " created #" + ch.ChannelName, CreatedAt: time.Now()}
+	if err := store.InsertMessage(&created); err != nil {
+		fmt.Println("failed to insert channel created message err =  ", err)
+	} else {
+		indexMessage(created)
+	}
+	fmt.Println("channel created = ", ch)
+	writeJSON(w, http.StatusCreated, UserChannel{Channel: ch, Role: RoleAdmin})
+}
+
+// joinChannel adds a user to a public or broadcast channel. Group channels
+// are joined through an invite.
+func joinChannel(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathID(r, "userId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch, m, ok := loadChannelFor(w, r, userId)
+	if !ok {
+		return
+	}
+	if m.MembershipID != 0 {
+		writeJSON(w, http.StatusOK, UserChannel{Channel: ch, Role: m.Role})
+		return
+	}
+	if ch.ChannelType != ChannelPublic && ch.ChannelType != ChannelBroadcast {
+		http.Error(w, "channel is invite only", http.StatusForbidden)
+		return
+	}
+	user, err := store.User(userId)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch user, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	if _, err := addMember(ch.ChannelID, userId, RoleMember); err != nil {
+		fmt.Println("failed to join channel err =  ", ch.ChannelID, userId, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	notifyChannel(ch, userId, user.UserName+" joined #"+ch.ChannelName)
+	writeJSON(w, http.StatusOK, UserChannel{Channel: ch, Role: RoleMember})
+}
+
+// leaveChannel removes a user from a channel. When the last admin leaves,
+// the longest standing member is promoted so the channel stays managed.
+func leaveChannel(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathID(r, "userId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch, m, ok := loadChannelFor(w, r, userId)
+	if !ok {
+		return
+	}
+	if ch.ChannelType == ChannelDM {
+		http.Error(w, "cannot leave a DM", http.StatusBadRequest)
+		return
+	}
+	if m.MembershipID == 0 {
+		http.Error(w, "not a member", http.StatusNotFound)
+		return
+	}
+	if err := removeMembership(ch, m); err != nil {
+		fmt.Println("failed to leave channel err =  ", ch.ChannelID, userId, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	user, _ := store.User(userId)
+	notifyChannel(ch, userId, user.UserName+" left #"+ch.ChannelName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func removeMembership(ch Channel, m Membership) error {
+	if err := store.RemoveMembership(m.MembershipID); err != nil {
+		return err
+	}
+	typing.stop(typingKey{channelId: ch.ChannelID, userId: m.UserID})
+	followChannel(m.UserID, ch.ChannelID, false)
+	if m.Role != RoleAdmin {
+		return nil
+	}
+	members, err := store.Members(ch.ChannelID)
+	if err != nil {
+		return err
+	}
+	for _, other := range members {
+		if other.Role == RoleAdmin {
+			return nil
+		}
+	}
+	if len(members) > 0 {
+		err = store.SetRole(members[0].MembershipID, RoleAdmin)
+	}
+	return err
+}
+
+// inviteToChannel lets a member add someone to a group or public channel;
+// on a broadcast channel only admins may invite.
+func inviteToChannel(w http.ResponseWriter, r *http.Request) {
+	inviterId, err := pathID(r, "inviterId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch, inviter, ok := loadChannelFor(w, r, inviterId)
+	if !ok {
+		return
+	}
+	if ch.ChannelType == ChannelDM {
+		http.Error(w, "cannot invite to a DM", http.StatusBadRequest)
+		return
+	}
+	if inviter.MembershipID == 0 || (ch.ChannelType == ChannelBroadcast && inviter.Role != RoleAdmin) {
+		http.Error(w, "not allowed to invite to this channel", http.StatusForbidden)
+		return
+	}
+	userName := r.PathValue("userName")
+	invitee, err := store.UserByName(userName)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch user, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	added, err := addMember(ch.ChannelID, invitee.Id, RoleMember)
+	if err != nil {
+		fmt.Println("failed to invite to channel err =  ", ch.ChannelID, userName, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	if added {
+		inviter, _ := store.User(inviterId)
+		notifyChannel(ch, inviterId, inviter.UserName+" added "+invitee.UserName+" to #"+ch.ChannelName)
+	}
+	writeJSON(w, http.StatusOK, invitee)
+}
+
+// removeMember lets a channel admin remove another member.
+func removeMember(w http.ResponseWriter, r *http.Request) {
+	adminId, err := pathID(r, "adminId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userId, err := pathID(r, "userId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ch, admin, ok := loadChannelFor(w, r, adminId)
+	if !ok {
+		return
+	}
+	if ch.ChannelType == ChannelDM {
+		http.Error(w, "cannot remove from a DM", http.StatusBadRequest)
+		return
+	}
+	if admin.Role != RoleAdmin {
+		http.Error(w, "only admins can remove members", http.StatusForbidden)
+		return
+	}
+	m, err := store.Membership(ch.ChannelID, userId)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "not a member", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = removeMembership(ch, m)
+	}
+	if err != nil {
+		fmt.Println("failed to remove member err =  ", ch.ChannelID, userId, err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	user, _ := store.User(userId)
+	notifyChannel(ch, 0, user.UserName+" was removed from #"+ch.ChannelName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listChannelMembers(w http.ResponseWriter, r *http.Request) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canRead(w, r, channelId) {
+		return
+	}
+	members, err := store.Members(channelId)
+	if err != nil {
+		fmt.Println("error while fetch members, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func listUserChannels(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathID(r, "userId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output, err := store.UserChannels(userId)
+	if err != nil {
+		fmt.Println("error while fetch user channels, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, output)
+}
+
+// notifyChannel tells every member but skipUserId about a membership change.
+func notifyChannel(ch Channel, skipUserId int64, msg string) {
+	members, err := store.Members(ch.ChannelID)
+	if err != nil {
+		fmt.Println("error while fetch members, err =  ", err)
+		return
+	}
+	var others []Membership
+	for _, m := range members {
+		if m.UserID != skipUserId {
+			others = append(others, m)
+		}
+	}
+	sendMessageOverWebSocket(others, msg, "#"+ch.ChannelName, nil)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// replayLimit caps the messages replayed per channel on connect; a client
+// that was away longer catches up through the history API.
+const replayLimit = 200
+
+// Delivery states of a message for one recipient, see listReceipts.
+const (
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+// DeliveryAck is what a client sends as "ack" for every "realtime" message
+// it received, with the ids from the ThreadContext argument.
+type DeliveryAck struct {
+	UserID    int64 `json:"user_id"`
+	ChannelID int64 `json:"channel_id"`
+	MessageID int64 `json:"message_id"`
+}
+
+// DeliveryReceipt is emitted as "delivered" to the sender of a DM message
+// once the other side acked it.
+type DeliveryReceipt struct {
+	ChannelID int64  `json:"channel_id"`
+	MessageID int64  `json:"message_id"`
+	UserID    int64  `json:"user_id"`
+	UserName  string `json:"user_name"`
+}
+
+// RecipientStatus is the delivery state of a message for one member.
+type RecipientStatus struct {
+	UserID   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+	Status   string `json:"status"`
+}
+
+// markDelivered moves the delivery cursor of the acking member up to the
+// acked message. Messages are emitted in order, so an ack covers all the
+// earlier ones too. Like the read marker the cursor only moves forward,
+// also under concurrent acks from several devices.
+func markDelivered(ack DeliveryAck) error {
+	if _, err := store.Membership(ack.ChannelID, ack.UserID); errors.Is(err, errNotFound) {
+		return errNotMember
+	} else if err != nil {
+		return err
+	}
+	m, err := store.Message(ack.ChannelID, ack.MessageID)
+	if err != nil {
+		return err
+	}
+	moved, err := store.AdvanceDelivered(ack.ChannelID, ack.UserID, cursor{createdAt: m.CreatedAt, messageId: m.MessageID})
+	if err != nil {
+		return err
+	}
+	if moved && m.SenderID != ack.UserID {
+		go sendDeliveryReceipt(ack, m.SenderID)
+	}
+	return nil
+}
+
+func sendDeliveryReceipt(ack DeliveryAck, senderId int64) {
+	ch, err := store.Channel(ack.ChannelID)
+	if err != nil || ch.ChannelType != ChannelDM {
+		return
+	}
+	user, _ := store.User(ack.UserID)
+	emitToUser(senderId, "delivered", DeliveryReceipt{ChannelID: ack.ChannelID, MessageID: ack.MessageID, UserID: ack.UserID, UserName: user.UserName})
+}
+
+// onAck handles the "ack" socket.io event.
+func onAck(conn socketio.Conn, ack DeliveryAck) string {
+	ack.UserID = socketUser(conn)
+	if err := markDelivered(ack); err != nil {
+		fmt.Println("ack from ", conn.ID(), " failed, err =  ", err)
+		return "error: " + err.Error()
+	}
+	return "ok"
+}
+
+// replayPending emits to conn, in order, the messages userId has not acked
+// yet in each of their channels: whatever arrived while they were offline
+// or reconnecting. Delivery is at least once: a message can come both live
+// and replayed, or again after a connect without ack, so clients drop the
+// message ids they already have.
+func replayPending(conn socketio.Conn, userId int64) {
+	channels, err := store.DeliveryCursors(userId)
+	if err != nil {
+		fmt.Println("error while fetch delivery cursors of ", userId, " err =  ", err)
+		return
+	}
+
+	senders := make(map[int64]string)
+	replayed := 0
+	for _, p := range channels {
+		messages, err := store.Undelivered(p.Channel.ChannelID, userId, p.From, replayLimit)
+		if err != nil {
+			fmt.Println("error while fetch undelivered messages of ", userId, " err =  ", err)
+			continue
+		}
+		for _, m := range messages {
+			name, ok := senders[m.SenderID]
+			if !ok {
+				sender, _ := store.User(m.SenderID)
+				name = sender.UserName
+				senders[m.SenderID] = name
+			}
+			if p.Channel.ChannelType != ChannelDM {
+				name += " in #" + p.Channel.ChannelName
+			}
+			thread := &ThreadContext{ChannelID: m.ChannelID, MessageID: m.MessageID}
+			if m.ParentID != nil {
+				thread.ParentID = *m.ParentID
+			}
+			conn.Emit("realtime", name+":"+m.Msg, thread)
+		}
+		replayed += len(messages)
+	}
+	if replayed > 0 {
+		fmt.Println("replayed ", replayed, " pending messages to ", userId, " on ", conn.ID())
+	}
+}
+
+// listReceipts serves GET /channels/{channelId}/messages/{messageId}/receipts:
+// for every member but the sender whether the message was only sent,
+// delivered to one of their devices, or read.
+func listReceipts(w http.ResponseWriter, r *http.Request) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messageId, err := pathID(r, "messageId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canRead(w, r, channelId) {
+		return
+	}
+	m, err := store.Message(channelId, messageId)
+	if errors.Is(err, errNotFound) || (err == nil && m.DeletedAt != nil) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch message, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	recipients, err := store.Recipients(channelId, m.SenderID)
+	if err != nil {
+		fmt.Println("error while fetch receipts, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	statuses := make([]RecipientStatus, 0, len(recipients))
+	for _, rc := range recipients {
+		s := RecipientStatus{UserID: rc.UserID, UserName: rc.UserName}
+		switch {
+		case rc.LastReadAt != nil && !m.CreatedAt.After(*rc.LastReadAt):
+			s.Status = StatusRead
+		case rc.Delivered != nil && rc.Delivered.covers(m):
+			s.Status = StatusDelivered
+		default:
+			s.Status = StatusSent
+		}
+		statuses = append(statuses, s)
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MessageEdit is one earlier version of an edited message.
+type MessageEdit struct {
+	EditID    int64     `json:"edit_id" db:"edit_id"`
+	MessageID int64     `json:"message_id" db:"message_id"`
+	OldMsg    string    `json:"old_msg" db:"old_msg"`
+	EditedAt  time.Time `json:"edited_at" db:"edited_at"`
+}
+
+// Reaction is the aggregate of one emoji on a message.
+type Reaction struct {
+	Emoji   string  `json:"emoji"`
+	Count   int     `json:"count"`
+	UserIDs []int64 `json:"user_ids"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+// typed socket.io events pushed to every member of the channel
+type MessageEditedEvent struct {
+	ChannelID int64     `json:"channel_id"`
+	MessageID int64     `json:"message_id"`
+	Msg       string    `json:"msg"`
+	EditedAt  time.Time `json:"edited_at"`
+}
+
+type MessageDeletedEvent struct {
+	ChannelID int64     `json:"channel_id"`
+	MessageID int64     `json:"message_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type ReactionsChangedEvent struct {
+	ChannelID int64      `json:"channel_id"`
+	MessageID int64      `json:"message_id"`
+	Reactions []Reaction `json:"reactions"`
+}
+
+// loadOwnMessage resolves /message/{senderId}/{channelId}/{messageId}: the
+// acting user's membership and the message, which must belong to the
+// channel and not be deleted. It answers the request itself on failure.
+func loadOwnMessage(w http.ResponseWriter, r *http.Request) (Channel, Membership, Message, bool) {
+	senderId, err := pathID(r, "senderId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Channel{}, Membership{}, Message{}, false
+	}
+	messageId, err := pathID(r, "messageId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Channel{}, Membership{}, Message{}, false
+	}
+	ch, member, ok := loadChannelFor(w, r, senderId)
+	if !ok {
+		return Channel{}, Membership{}, Message{}, false
+	}
+	if member.MembershipID == 0 {
+		http.Error(w, "not a member of this channel", http.StatusForbidden)
+		return Channel{}, Membership{}, Message{}, false
+	}
+	m, err := store.Message(ch.ChannelID, messageId)
+	if errors.Is(err, errNotFound) || (err == nil && m.DeletedAt != nil) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return Channel{}, Membership{}, Message{}, false
+	}
+	if err != nil {
+		fmt.Println("error while fetch message, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return Channel{}, Membership{}, Message{}, false
+	}
+	return ch, member, m, true
+}
+
+// editMessage serves PUT /message/{senderId}/{channelId}/{messageId}. Only
+// the author may edit; the previous text goes to the edit history.
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Msg == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	ch, member, m, ok := loadOwnMessage(w, r)
+	if !ok {
+		return
+	}
+	if m.SenderID != member.UserID {
+		http.Error(w, "only the author can edit a message", http.StatusForbidden)
+		return
+	}
+	if m.Msg == req.Msg {
+		writeJSON(w, http.StatusOK, m)
+		return
+	}
+	editedAt := time.Now()
+	if err := store.EditMessage(ch.ChannelID, m.MessageID, req.Msg, editedAt); err != nil {
+		fmt.Println("failed to edit message ", m.MessageID, " err =  ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	m.Msg, m.EditedAt = req.Msg, &editedAt
+	indexMessage(m)
+	emitToChannel(ch.ChannelID, "messageEdited", MessageEditedEvent{ChannelID: ch.ChannelID, MessageID: m.MessageID, Msg: m.Msg, EditedAt: editedAt})
+	writeJSON(w, http.StatusOK, m)
+}
+
+// deleteMessage serves DELETE /message/{senderId}/{channelId}/{messageId}.
+// The author or a channel admin may delete. The row stays behind as a
+// tombstone so threads and paging keep their shape.
+func deleteMessage(w http.ResponseWriter, r *http.Request) {
+	ch, member, m, ok := loadOwnMessage(w, r)
+	if !ok {
+		return
+	}
+	if m.SenderID != member.UserID && member.Role != RoleAdmin {
+		http.Error(w, "only the author or an admin can delete a message", http.StatusForbidden)
+		return
+	}
+	deletedAt := time.Now()
+	if err := store.DeleteMessage(ch.ChannelID, m.MessageID, deletedAt); err != nil {
+		fmt.Println("failed to delete message ", m.MessageID, " err =  ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	unindexMessage(m.MessageID)
+	emitToChannel(ch.ChannelID, "messageDeleted", MessageDeletedEvent{ChannelID: ch.ChannelID, MessageID: m.MessageID, DeletedAt: deletedAt})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toggleReaction serves POST /message/{senderId}/{channelId}/{messageId}/reactions
+// with {"emoji"}: the user's reaction is added, or removed when already
+// there. It answers with the new aggregate.
+func toggleReaction(w http.ResponseWriter, r *http.Request) {
+	var req ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Emoji = strings.TrimSpace(req.Emoji)
+	if req.Emoji == "" || len(req.Emoji) > 32 {
+		http.Error(w, "emoji must be 1 to 32 bytes", http.StatusBadRequest)
+		return
+	}
+	ch, member, m, ok := loadOwnMessage(w, r)
+	if !ok {
+		return
+	}
+	if err := store.ToggleReaction(ch.ChannelID, m.MessageID, member.UserID, req.Emoji, time.Now()); err != nil {
+		fmt.Println("failed to toggle reaction on ", m.MessageID, " err =  ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	reactions, err := store.Reactions(ch.ChannelID, []int64{m.MessageID})
+	if err != nil {
+		fmt.Println("error while fetch reactions, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	event := ReactionsChangedEvent{ChannelID: ch.ChannelID, MessageID: m.MessageID, Reactions: reactions[m.MessageID]}
+	if event.Reactions == nil {
+		event.Reactions = make([]Reaction, 0)
+	}
+	emitToChannel(ch.ChannelID, "reactionsChanged", event)
+	writeJSON(w, http.StatusOK, event)
+}
+
+// listEdits serves GET /channels/{channelId}/messages/{messageId}/edits,
+// oldest version first.
+func listEdits(w http.ResponseWriter, r *http.Request) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messageId, err := pathID(r, "messageId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canRead(w, r, channelId) {
+		return
+	}
+	m, err := store.Message(channelId, messageId)
+	if errors.Is(err, errNotFound) || (err == nil && m.DeletedAt != nil) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch message, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	edits, err := store.Edits(channelId, messageId)
+	if err != nil {
+		fmt.Println("error while fetch edits, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, edits)
+}
+
+// attachReactions fills in Reactions on messages of channelId.
+func attachReactions(channelId int64, messages []Message) error {
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.MessageID
+	}
+	reactions, err := store.Reactions(channelId, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].MessageID]
+	}
+	return nil
+}
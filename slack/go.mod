@@ -1,15 +1,15 @@
 module slack
 
-go 1.22.2
+go 1.24
 
 require (
 	github.com/go-sql-driver/mysql v1.9.3
+	github.com/gomodule/redigo v1.8.4
 	github.com/googollee/go-socket.io v1.7.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/gofrs/uuid v4.0.0+incompatible // indirect
-	github.com/gomodule/redigo v1.8.4 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
 )
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"os"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -15,13 +17,11 @@ import (
 	"github.com/googollee/go-socket.io/engineio"
 )
 
-var Db *sql.DB
-var wsMap map[int64]*socketio.Conn
-
 type User struct {
 	Id            int64     `json:"id"`
 	UserName      string    `json:"userName"`
 	LastTimestamp time.Time `json:"lastTimestamp"`
+	PasswordHash  string    `json:"-"` // empty until the user first logs in
 }
 
 // Channel represents a chat channel or group
@@ -33,10 +33,13 @@ type Channel struct {
 
 // Membership represents the link between users and channels
 type Membership struct {
-	MembershipID int64 `json:"membership_id" db:"membership_id"`
-	ChannelID    int64 `json:"channel_id" db:"channel_id"`
-	UserID       int64 `json:"user_id" db:"user_id"`
-	// LastReadAt   time.Time `json:"last_read_at" db:"last_read_at"` // to store the unread messages
+	MembershipID int64  `json:"membership_id" db:"membership_id"`
+	ChannelID    int64  `json:"channel_id" db:"channel_id"`
+	UserID       int64  `json:"user_id" db:"user_id"`
+	Role         string `json:"role" db:"role"` // admin or member
+	// LastReadAt is the read marker, messages after it are unread. nil
+	// until the member first reads the channel.
+	LastReadAt *time.Time `json:"last_read_at" db:"last_read_at"`
 }
 
 // Message represents an individual message sent in a channel
@@ -46,53 +49,17 @@ type Message struct {
 	ChannelID int64     `json:"channel_id" db:"channel_id"`
 	Msg       string    `json:"msg" db:"msg"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
-}
-
-func createUser(w http.ResponseWriter, r *http.Request) {
-	userName := r.PathValue("userName")
-	row := Db.QueryRow("select id, userName from user where userName = ?", userName)
-	if row.Err() != nil {
-		fmt.Println("error while fetch user, err =  ", row.Err())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(string("fetch try again")))
-		return
-	}
-	var user User
-	row.Err()
-	err := row.Scan(&user.Id, &user.UserName)
-	if err != nil {
-		if err.Error() != sql.ErrNoRows.Error() {
-			fmt.Println("error while scan into variable, err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("scan try again")))
-			return
-		}
-	}
-	if user.UserName == "" {
-		// create user
-		fmt.Println("creating a new user")
-		currTime := time.Now()
-		res, err := Db.Exec("insert into user (userName,last_timestamp) values (?,?)", userName, currTime)
-		if err != nil {
-			fmt.Println("insert error = ", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("try again")))
-			return
-		}
-		user.Id, _ = res.LastInsertId()
-		user.UserName = userName
-	}
-	fmt.Println("user(id, userName, last_timestamp) = ", user)
-	// time.Sleep(5 * time.Second)
-	w.Header().Add("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	userBytes, _ := json.Marshal(user)
-	_, err = w.Write(userBytes)
-	if err != nil {
-		fmt.Println("error while writing response to client, err =  ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(string("try again")))
-	}
+	// ParentID is set on thread replies; the parent keeps the reply count
+	// and the time of the last reply
+	ParentID    *int64     `json:"parent_id,omitempty" db:"parent_id"`
+	ReplyCount  int        `json:"reply_count" db:"reply_count"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty" db:"last_reply_at"`
+	// EditedAt marks an edited message, the earlier texts are kept in
+	// message_edit. A deleted message stays as a tombstone with its text
+	// blanked out.
+	EditedAt  *time.Time `json:"edited_at,omitempty" db:"edited_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	Reactions []Reaction `json:"reactions,omitempty"`
 }
 
 func createChannel(w http.ResponseWriter, r *http.Request) {
@@ -100,136 +67,92 @@ func createChannel(w http.ResponseWriter, r *http.Request) {
 	receiverName := r.PathValue("receiverName")
 
 	// check whether sender and. receiver already have a channel or not
-	row := Db.QueryRow("select id from user where userName = ?", senderName)
-	if row.Err() != nil {
-		fmt.Println("name sender fetch error while fetch user, err =  ", row.Err())
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(string("fetch try again")))
+	sender, err := store.UserByName(senderName)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "sender not found", http.StatusNotFound)
 		return
 	}
-	var sender User
-	err := row.Scan(&sender.Id)
 	if err != nil {
-		if err.Error() != sql.ErrNoRows.Error() {
-			fmt.Println("sender error while scan into variable, err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("scan try again")))
-			return
-		}
-	}
-
-	row = Db.QueryRow("select id from user where userName = ?", receiverName)
-	if row.Err() != nil {
-		fmt.Println("name receiver fetch error while fetch user, err =  ", row.Err())
+		fmt.Println("name sender fetch error while fetch user, err =  ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string("fetch try again")))
 		return
 	}
-	var receiver User
-	err = row.Scan(&receiver.Id)
-	if err != nil {
-		if err.Error() != sql.ErrNoRows.Error() {
-			fmt.Println("receiver error while scan into variable, err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("scan try again")))
-			return
-		}
+	receiver, err := store.UserByName(receiverName)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "receiver not found", http.StatusNotFound)
+		return
 	}
-	query := `SELECT c.channel_id, c.channel_type, c.channel_name
-	FROM channel c
-	JOIN membership m1 ON c.channel_id = m1.channel_id
-	JOIN membership m2 ON c.channel_id = m2.channel_id
-	WHERE m1.user_id = ?
-	  AND m2.user_id = ?;`
-	rows, err := Db.Query(query, sender.Id, receiver.Id)
 	if err != nil {
+		fmt.Println("name receiver fetch error while fetch user, err =  ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(string("fetch try again")))
+		return
+	}
+	ch, err := store.DM(sender.Id, receiver.Id)
+	if err != nil && !errors.Is(err, errNotFound) {
 		fmt.Println("membership check error err =  ", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string("try again")))
 		return
 	}
-	var ch Channel
-	for rows.Next() {
-		err = rows.Scan(&ch.ChannelID, &ch.ChannelType, &ch.ChannelName)
-		if err != nil {
-			fmt.Println("channel extract error err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("try again")))
-			return
-		}
-	}
-	rows.Close()
 
 	output := make([]Message, 0)
 	if ch.ChannelID == 0 {
 		// create a channel b/w them
-		result, err := Db.Exec("insert into channel (channel_type,channel_name) values (?,?)", "DM", senderName+"_"+receiverName)
+		ch, err = store.CreateChannel(ChannelDM, senderName+"_"+receiverName)
 		if err != nil {
 			fmt.Println("failed to create channel b/w err =  ", senderName, receiverName, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(string("fetch try again")))
 			return
 		}
-		channelId, err := result.LastInsertId()
-		if err != nil {
-			fmt.Println("failed to created channelId b/w err =  ", senderName, receiverName, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("fetch try again")))
-			return
-		}
+		channelId := ch.ChannelID
 		var channelCreate Message
 		channelCreate.ChannelID = channelId
 		channelCreate.Msg = "channel created b/w you and " + receiverName
+		channelCreate.SenderID, channelCreate.CreatedAt = sender.Id, time.Now()
 
 		// create membership for them
-		result, err = Db.Exec("insert into message (sender_id ,channel_id,msg,created_at) values (?,?,?,?)", sender.Id, channelId, channelCreate.Msg, time.Now())
+		err = store.InsertMessage(&channelCreate)
 		if err != nil {
 			fmt.Println("failed to insert sender membership channel b/w err =  ", senderName, receiverName, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(string("fetch try again")))
 			return
 		}
-		channelCreate.MessageID, _ = result.LastInsertId()
+		indexMessage(channelCreate)
 		output = append(output, channelCreate)
 		go sendMessageOverWebSocket([]Membership{{ChannelID: channelId,
-			UserID: receiver.Id}}, channelCreate.Msg, senderName)
+			UserID: receiver.Id}}, channelCreate.Msg, senderName, &ThreadContext{ChannelID: channelId, MessageID: channelCreate.MessageID})
 		// create membership for them
-		_, err = Db.Exec("insert into membership (channel_id,user_id) values (?,?)", channelId, sender.Id)
+		err = store.AddMember(channelId, sender.Id, RoleMember, nil)
 		if err != nil {
 			fmt.Println("failed to insert sender membership channel b/w err =  ", senderName, receiverName, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(string("fetch try again")))
 			return
 		}
-		_, err = Db.Exec("insert into membership (channel_id,user_id) values (?,?)", channelId, receiver.Id)
+		err = store.AddMember(channelId, receiver.Id, RoleMember, nil)
 		if err != nil {
 			fmt.Println("failed to insert receiver membership channel b/w err =  ", senderName, receiverName, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(string("fetch try again")))
 			return
 		}
+		followChannel(sender.Id, channelId, true)
+		followChannel(receiver.Id, channelId, true)
 	} else {
-		// read last 10 message and send them
-		query := `SELECT * from message where channel_id = ? order by created_at desc limit 10`
-		rows, err := Db.Query(query, ch.ChannelID)
+		// send the last 10 messages, older ones are paged through
+		// GET /channels/{channelId}/messages
+		page, err := fetchMessagePage(ch.ChannelID, 0, nil, nil, 10)
 		if err != nil {
-			fmt.Println("membership check error err =  ", err.Error())
+			fmt.Println("channel extract error err =  ", err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(string("try again")))
 			return
 		}
-		for rows.Next() {
-			var chMsg Message
-			err = rows.Scan(&chMsg.MessageID, &chMsg.SenderID, &chMsg.ChannelID, &chMsg.Msg, &chMsg.CreatedAt)
-			if err != nil {
-				fmt.Println("channel extract error err =  ", err.Error())
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(string("try again")))
-				return
-			}
-			output = append(output, chMsg)
-		}
-		rows.Close()
+		output = page.Messages
 	}
 	sender.UserName = senderName
 	receiver.UserName = receiverName
@@ -247,85 +170,109 @@ func createChannel(w http.ResponseWriter, r *http.Request) {
 }
 
 type MessageRequest struct {
-	Msg string `json:"msg"`
+	Msg      string `json:"msg"`
+	ParentID int64  `json:"parent_id,omitempty"` // reply in this message's thread
 }
 
 func sendMessage(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("ip address", r.RemoteAddr)
 	fmt.Println("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
-	senderId := r.PathValue("senderId")
-	channelId := r.PathValue("channelId")
+	senderId, err := pathID(r, "senderId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	currentTime := time.Now()
 
 	var req MessageRequest
 
 	// Decode JSON body into struct
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
+	ch, sender, ok := loadChannelFor(w, r, senderId)
+	if !ok {
+		return
+	}
+	if sender.MembershipID == 0 {
+		http.Error(w, "not a member of this channel", http.StatusForbidden)
+		return
+	}
+	if ch.ChannelType == ChannelBroadcast && sender.Role != RoleAdmin {
+		http.Error(w, "only admins can post in a broadcast channel", http.StatusForbidden)
+		return
+	}
+	channelId := ch.ChannelID
+
 	fmt.Printf("Received message: %s\n", req.Msg)
 
+	message := Message{SenderID: senderId, ChannelID: channelId, Msg: req.Msg, CreatedAt: currentTime}
+	if req.ParentID != 0 {
+		if err := checkThreadParent(req.ParentID, channelId); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message.ParentID = &req.ParentID
+	}
+
 	// since it is a enterprise application first persit the chat
-	_, err = Db.Exec("insert into message (sender_id,channel_id,msg,created_at) values (?,?,?,?)", senderId, channelId, req.Msg, currentTime)
+	err = store.InsertMessage(&message)
 	if err != nil {
 		fmt.Println("failed to insert message into DB, err =  ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string("fetch try again")))
 		return
 	}
+	indexMessage(message)
+	// the message is what they were typing
+	typing.stop(typingKey{channelId: channelId, userId: senderId})
+	thread := &ThreadContext{ChannelID: channelId, MessageID: message.MessageID}
+	if message.ParentID != nil {
+		if thread, err = addReply(channelId, req.ParentID, message.MessageID, currentTime); err != nil {
+			fmt.Println("failed to update thread of ", req.ParentID, " err =  ", err)
+		}
+	}
+	// whoever posts has read the channel up to their own message
+	err = store.SetLastRead(sender.MembershipID, currentTime)
+	if err != nil {
+		fmt.Println("failed to move read marker of sender, err =  ", err)
+	}
 
-	// check whether sender and. receiver already have a channel or not
-	rows, err := Db.Query("select * from membership where channel_id = ?", channelId)
+	// fan out to everyone currently in the channel
+	channelMembers, err := store.Members(channelId)
 	if err != nil {
 		fmt.Println("fetch user in the given channel, err =  ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string("fetch try again")))
 		return
 	}
-
-	senderIdInt, _ := strconv.Atoi(senderId)
 	var members []Membership
-	for rows.Next() {
-		var member Membership
-		err = rows.Scan(&member.MembershipID, &member.ChannelID, &member.UserID)
-		if err != nil {
-			fmt.Println("member extract for a channel error err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("try again")))
-			return
-		}
-		if int(member.UserID) != senderIdInt {
+	for _, member := range channelMembers {
+		if member.UserID != senderId {
 			members = append(members, member)
 		}
 	}
 
-	row := Db.QueryRow("select userName from user where id = ?", senderId)
-	if row.Err() != nil {
-		fmt.Println("error while fetch user, err =  ", row.Err())
+	user, err := store.User(senderId)
+	if err != nil && !errors.Is(err, errNotFound) {
+		fmt.Println("error while fetch user, err =  ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(string("fetch try again")))
 		return
 	}
-	var userName string
-	row.Err()
-	err = row.Scan(&userName)
-	if err != nil {
-		if err.Error() != sql.ErrNoRows.Error() {
-			fmt.Println("error while scan into variable, err =  ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(string("scan try again")))
-			return
-		}
-	}
+	userName := user.UserName
 
 	fmt.Println("members = ", members)
-	sendMessageOverWebSocket(members, req.Msg, userName)
+	if ch.ChannelType != ChannelDM {
+		userName += " in #" + ch.ChannelName
+	}
+	sendMessageOverWebSocket(members, req.Msg, userName, thread)
 	w.Header().Add("content-type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	outputBytes, _ := json.Marshal(req)
+	outputBytes, _ := json.Marshal(message)
 	_, err = w.Write(outputBytes)
 	if err != nil {
 		fmt.Println("create channel error while writing response to client, err =  ", err.Error())
@@ -334,23 +281,59 @@ func sendMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func sendMessageOverWebSocket(members []Membership, msg string, userName string) {
+// sendMessageOverWebSocket emits "realtime" to members. The first argument
+// stays the "userName:msg" text; thread, when given, follows as a second
+// argument so clients can place the message, update reply counters and
+// ack it. Members who are offline get it from replayPending on connect.
+func sendMessageOverWebSocket(members []Membership, msg string, userName string, thread *ThreadContext) {
 	for _, member := range members {
-		wsServer, present := wsMap[member.UserID]
-		if present {
-			(*wsServer).Emit("realtime", userName+":"+msg)
+		if thread != nil {
+			emitToUser(member.UserID, "realtime", userName+":"+msg, thread)
+		} else {
+			emitToUser(member.UserID, "realtime", userName+":"+msg)
 		}
 	}
 }
-func connectToDb() {
-	db, err := sql.Open("mysql", "root:localhost@tcp(localhost:3306)/slack?parseTime=true")
+
+// emitToChannel pushes a typed event to every connected member of channelId.
+func emitToChannel(channelId int64, event string, v interface{}) {
+	members, err := store.Members(channelId)
 	if err != nil {
-		log.Fatal("error while connecting to mysql DB | ", err)
+		fmt.Println("error while fetch members for ", event, ", err =  ", err)
+		return
+	}
+	for _, member := range members {
+		emitToUser(member.UserID, event, v)
 	}
-	Db = db
 }
 
-func connectToWebsocket() *socketio.Server {
+// openStore picks where users, channels and messages live: "mysql", or
+// "memory" to run without a database. shardSpec spreads the mysql messages
+// over shards, see openShards.
+func openStore(kind, shardSpec string) Store {
+	switch kind {
+	case "memory":
+		fmt.Println("using the in-memory store, nothing is kept across restarts")
+		return newMemStore()
+	case "mysql":
+		db, err := sql.Open("mysql", mysqlDSN)
+		if err != nil {
+			log.Fatal("error while connecting to mysql DB | ", err)
+		}
+		shards, err := openShards(shardSpec)
+		if err != nil {
+			log.Fatal("error while connecting to the shards | ", err)
+		}
+		return newMySQLStore(db, newShardRouter(db, shards))
+	}
+	log.Fatalf("unknown -store %q, want mysql or memory", kind)
+	return nil
+}
+
+// connectToWebsocket sets up the socket.io server. With redisAddr the
+// instances share broadcasts through redis, so several slack servers can
+// run behind a load balancer.
+func connectToWebsocket(redisAddr string) *socketio.Server {
 	serverEngineOptions := engineio.Options{
 		PingTimeout:  20 * time.Second, // 20000 ms (20 seconds)
 		PingInterval: 10 * time.Second, // 10000 ms (10 seconds)
@@ -358,13 +341,30 @@ func connectToWebsocket() *socketio.Server {
 
 	// Initialize the Socket.IO Server with EngineIO Options
 	server := socketio.NewServer(&serverEngineOptions)
-	timeTaken := make(map[string]time.Time)
+	if redisAddr != "" {
+		// before any handler: namespaces pick their adapter when created
+		if _, err := server.Adapter(&socketio.RedisAdapterOptions{Addr: redisAddr, Prefix: "slack"}); err != nil {
+			log.Fatal("error while connecting to redis | ", err)
+		}
+		sharedPresence = newRedisPresence(redisAddr)
+		presence = sharedPresence
+		go sharedPresence.listen()
+	}
 	// OnConnect handler for the default namespace "/"
 	server.OnConnect("/", func(c socketio.Conn) error {
 		fmt.Println("connected successfully:", c.ID())
 		// Log the transport type and the namespace
 		fmt.Println("Transport:", c.RemoteHeader().Get("transport"), "Namespace:", c.Namespace())
-		timeTaken[c.ID()] = time.Now()
+		claims, err := socketClaims(c)
+		if err != nil {
+			fmt.Println("rejecting socket ", c.ID(), " => ", err)
+			c.Close()
+			return err
+		}
+		c.SetContext(claims)
+		sockets.connect(c, claims.UserID)
+		go comeOnline(c, claims)
+		go replayPending(c, claims.UserID)
 		return nil
 	})
 
@@ -375,39 +375,49 @@ func connectToWebsocket() *socketio.Server {
 
 	// OnDisconnect handler
 	server.OnDisconnect("/", func(c socketio.Conn, reason string) {
-		fmt.Println("Client disconnected:", c.ID(), "Reason:", reason, "\tTime Taken to disconnect: ", time.Since(timeTaken[c.ID()]).String())
+		sc, ok := sockets.disconnect(c)
+		c.LeaveAll()
+		if !ok {
+			// rejected on connect
+			fmt.Println("Client disconnected:", c.ID(), "Reason:", reason)
+			return
+		}
+		fmt.Println("Client disconnected:", c.ID(), "Reason:", reason, "\tTime Taken to disconnect: ", time.Since(sc.connectedAt).String())
+		fmt.Println("user ", sc.userId, " still has ", len(sockets.userConns(sc.userId)), " connections here")
+		claims, _ := c.Context().(Claims)
+		go goOffline(sc, claims)
 	})
 
+	server.OnEvent("/", "markRead", onMarkRead)
+	server.OnEvent("/", "ack", onAck)
+	server.OnEvent("/", "typing:start", onTypingStart)
+	server.OnEvent("/", "typing:stop", onTypingStop)
+
+	// the heartbeat payload is whatever the client says it is, the user
+	// comes from the token the connection was opened with
 	server.OnEvent("/", "hearbeat", func(conn socketio.Conn, msg interface{}) {
 		fmt.Println("received heartbeat from ", msg)
-		fmt.Println(msg)
 		currentTime := time.Now()
-		if msg != nil {
-			userIdPlusUsername := msg.(string)
-			splitArr := strings.Split(userIdPlusUsername, ",")
-			userId, _ := strconv.Atoi(splitArr[0])
-			wsMap[int64(userId)] = &conn
-			fmt.Println("inserting for id, currTime => ", splitArr[0], currentTime)
-			stmt, err := Db.Prepare("insert into user (id,userName,last_timestamp) values (?,?,?) on duplicate key update last_timestamp = ?")
-			if err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-			_, err = stmt.Exec(splitArr[0], splitArr[1], currentTime, currentTime)
-			if err != nil {
-				fmt.Println(err.Error())
-				return
-			}
+		userId := socketUser(conn)
+		if userId == 0 {
+			return
+		}
+		fmt.Println("updating for id, currTime => ", userId, currentTime)
+		if err := presence.refresh(userId, conn.ID()); err != nil {
+			fmt.Println("failed to refresh presence, err =  ", err)
+		}
+		err := store.Touch(userId, currentTime)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
 		}
-
 	})
 
 	return server
 }
 
 func fetchOnlineOfflineStatus(w http.ResponseWriter, r *http.Request) {
-	query := "select * from user"
-	rows, err := Db.Query(query)
+	users, err := store.Users()
 	if err != nil {
 		fmt.Println(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -416,16 +426,8 @@ func fetchOnlineOfflineStatus(w http.ResponseWriter, r *http.Request) {
 	}
 	currentTime := time.Now()
 
-	var us User
 	output := make(map[string]bool, 0)
-	for rows.Next() {
-		err = rows.Scan(&us.Id, &us.UserName, &us.LastTimestamp)
-		if err != nil {
-			fmt.Println(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("error from db"))
-			return
-		}
+	for _, us := range users {
 		fmt.Println("last usertimestamp : ", us.LastTimestamp, "\tcurrentTime : ", currentTime, "\t currentTime.Sub(us.LastTimestamp) = ", currentTime.Sub(us.LastTimestamp))
 
 		if currentTime.Sub(us.LastTimestamp) <= time.Second*10 {
@@ -439,15 +441,63 @@ func fetchOnlineOfflineStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write(outputByte)
 }
 
+// routes registers the http api and the pages in asset on mux, all but
+// socket.io which needs the running server.
+func routes(mux *http.ServeMux) {
+	mux.Handle("/", http.FileServer(http.Dir("./asset")))
+	mux.HandleFunc("POST /signup", signup)
+	mux.HandleFunc("POST /login", login)
+	mux.HandleFunc("/channel/{senderName}/{receiverName}", authed("senderName", createChannel))
+	mux.HandleFunc("/message/{senderId}/{channelId}", authed("senderId", sendMessage))
+	mux.HandleFunc("POST /channels", authed("", createGroupChannel))
+	mux.HandleFunc("GET /channels/{channelId}/members", authed("", listChannelMembers))
+	mux.HandleFunc("GET /channels/{channelId}/messages", authed("", listMessages))
+	mux.HandleFunc("GET /channels/{channelId}/messages/{messageId}/thread", authed("", getThread))
+	mux.HandleFunc("GET /channels/{channelId}/messages/{messageId}/edits", authed("", listEdits))
+	mux.HandleFunc("GET /channels/{channelId}/messages/{messageId}/receipts", authed("", listReceipts))
+	mux.HandleFunc("PUT /message/{senderId}/{channelId}/{messageId}", authed("senderId", editMessage))
+	mux.HandleFunc("DELETE /message/{senderId}/{channelId}/{messageId}", authed("senderId", deleteMessage))
+	mux.HandleFunc("POST /message/{senderId}/{channelId}/{messageId}/reactions", authed("senderId", toggleReaction))
+	mux.HandleFunc("POST /channels/{channelId}/join/{userId}", authed("userId", joinChannel))
+	mux.HandleFunc("POST /channels/{channelId}/leave/{userId}", authed("userId", leaveChannel))
+	mux.HandleFunc("POST /channels/{channelId}/read/{userId}", authed("userId", markReadHandler))
+	mux.HandleFunc("POST /channels/{channelId}/invite/{inviterId}/{userName}", authed("inviterId", inviteToChannel))
+	mux.HandleFunc("POST /channels/{channelId}/remove/{adminId}/{userId}", authed("adminId", removeMember))
+	mux.HandleFunc("GET /users/{userId}/channels", authed("userId", listUserChannels))
+	mux.HandleFunc("GET /search", authed("", searchMessages))
+	mux.HandleFunc("/status", authed("", fetchOnlineOfflineStatus))
+}
+
 func main() {
-	http.Handle("/", http.FileServer(http.Dir("./asset")))
-	http.HandleFunc("/createUser/{userName}", createUser)
-	http.HandleFunc("/channel/{senderName}/{receiverName}", createChannel)
-	http.HandleFunc("/message/{senderId}/{channelId}", sendMessage)
-
-	wsMap = make(map[int64]*socketio.Conn, 0)
-	connectToDb()
-	wsserver := connectToWebsocket()
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		rebalanceMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		passwdMain(os.Args[2:])
+		return
+	}
+	redisAddr := flag.String("redis", "", "redis address (host:port) to share socket.io broadcasts with other slack instances; empty runs standalone")
+	storeKind := flag.String("store", "mysql", "where to keep users, channels and messages: mysql, or memory to run without a database")
+	shardSpec := flag.String("shards", "", "message shards for -store mysql: a count of local schemas slack_shard0.., or comma separated DSNs; empty keeps messages in the main database")
+	secret := flag.String("secret", "", "key that signs session tokens, shared by all instances; empty picks a random one and tokens die with the process")
+	flag.Parse()
+
+	tokenSecret = []byte(*secret)
+	if len(tokenSecret) == 0 {
+		tokenSecret = make([]byte, 32)
+		rand.Read(tokenSecret)
+		fmt.Println("no -secret given, session tokens won't survive a restart")
+	}
+
+	store = openStore(*storeKind, *shardSpec)
+	go func() {
+		if err := searchIdx.rebuild(); err != nil {
+			fmt.Println("failed to build the search index, err =  ", err)
+		}
+	}()
+	wsserver := connectToWebsocket(*redisAddr)
+	socketServer = wsserver
 	// Start the server in a goroutine
 	go func() {
 		if err := wsserver.Serve(); err != nil {
@@ -457,9 +507,9 @@ func main() {
 	defer wsserver.Close()
 
 	// Setup HTTP handlers
+	routes(http.DefaultServeMux)
 	// Serve the socket.io requests at the default path
 	http.Handle("/socket.io/", wsserver)
-	http.HandleFunc("/status", fetchOnlineOfflineStatus)
 
 	fmt.Println("starting web socket and slack server on port 4444")
 	err := http.ListenAndServe(":4444", nil)
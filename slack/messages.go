@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// MessagePage is one page of a channel's history, oldest message first.
+// Before and After are opaque cursors for the pages either side of it; an
+// empty Before means the start of the channel was reached.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+}
+
+// cursor is a position in a channel's history. created_at alone is not
+// unique, so message_id breaks ties and keeps the order stable.
+type cursor struct {
+	createdAt time.Time
+	messageId int64
+}
+
+func encodeCursor(m Message) string {
+	return cursor{createdAt: m.CreatedAt, messageId: m.MessageID}.encode()
+}
+
+func (c cursor) encode() string {
+	raw := strconv.FormatInt(c.createdAt.UnixNano(), 10) + ":" + strconv.FormatInt(c.messageId, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// covers reports whether m is at or before c.
+func (c cursor) covers(m Message) bool {
+	return m.CreatedAt.Before(c.createdAt) || (m.CreatedAt.Equal(c.createdAt) && m.MessageID <= c.messageId)
+}
+
+// before reports whether the message created at with messageId comes
+// strictly before c.
+func (c cursor) before(at time.Time, messageId int64) bool {
+	return at.Before(c.createdAt) || (at.Equal(c.createdAt) && messageId < c.messageId)
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+func decodeCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return cursor{}, errBadCursor
+	}
+	n, err1 := strconv.ParseInt(nanos, 10, 64)
+	messageId, err2 := strconv.ParseInt(id, 10, 64)
+	if err1 != nil || err2 != nil {
+		return cursor{}, errBadCursor
+	}
+	return cursor{createdAt: time.Unix(0, n), messageId: messageId}, nil
+}
+
+// fetchMessagePage reads up to limit messages of a channel: its top level
+// messages, or with parentId the replies in that thread. Without a cursor
+// it returns the latest ones; with before it pages backwards to older
+// messages and with after forwards to newer ones.
+func fetchMessagePage(channelId, parentId int64, before, after *cursor, limit int) (MessagePage, error) {
+	forward := after != nil
+	// one extra row tells whether there is more beyond this page
+	messages, err := store.Messages(channelId, parentId, before, after, limit+1)
+	if err != nil {
+		return MessagePage{}, err
+	}
+
+	if err := attachReactions(channelId, messages); err != nil {
+		return MessagePage{}, err
+	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if !forward {
+		// fetched newest first, hand them out oldest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	page := MessagePage{Messages: messages}
+	if len(messages) > 0 {
+		// newer messages may always arrive, so After is always given
+		page.After = encodeCursor(messages[len(messages)-1])
+		if forward || more {
+			page.Before = encodeCursor(messages[0])
+		}
+	} else if forward {
+		// caught up: poll again from the same place
+		page.After = after.encode()
+	}
+	return page, nil
+}
+
+// pageParams reads limit, before and after from the query string.
+func pageParams(r *http.Request) (limit int, before, after *cursor, err error) {
+	q := r.URL.Query()
+	limit = defaultPageSize
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return 0, nil, nil, errors.New("limit must be a positive number")
+		}
+		limit = min(limit, maxPageSize)
+	}
+	if q.Get("before") != "" && q.Get("after") != "" {
+		return 0, nil, nil, errors.New("use either before or after")
+	}
+	if before, err = queryCursor(r, "before"); err != nil {
+		return 0, nil, nil, err
+	}
+	if after, err = queryCursor(r, "after"); err != nil {
+		return 0, nil, nil, err
+	}
+	return limit, before, after, nil
+}
+
+// queryCursor decodes the named cursor parameter, nil when absent.
+func queryCursor(r *http.Request, name string) (*cursor, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	c, err := decodeCursor(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &c, nil
+}
+
+// listMessages serves GET /channels/{channelId}/messages?before=&after=&limit=
+func listMessages(w http.ResponseWriter, r *http.Request) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, before, after, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canRead(w, r, channelId) {
+		return
+	}
+
+	page, err := fetchMessagePage(channelId, 0, before, after, limit)
+	if err != nil {
+		fmt.Println("error while fetch messages, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
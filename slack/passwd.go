@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// passwdMain runs `slack passwd -user <name>`, which sets the password of
+// an account from the first line of stdin. Accounts from before login
+// have none and cannot sign in until an admin gives them one; it also
+// resets a forgotten password.
+func passwdMain(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	userName := fs.String("user", "", "user name of the account")
+	fs.Parse(args)
+	if *userName == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal("error while reading the password from stdin | ", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		log.Fatal("the password needs at least 8 characters")
+	}
+
+	store = openStore("mysql", "")
+	user, err := store.UserByName(*userName)
+	if err != nil {
+		log.Fatalf("error while fetch user %q | %v", *userName, err)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.SetPassword(user.Id, hash); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("password of", user.UserName, "set")
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Typing indicators and presence are ephemeral: they are kept in memory,
+// and in redis when instances share one, and never reach MySQL. Only the
+// channel list of a user is read, once, when they connect.
+const (
+	// typingTTL is how long a typing:start holds without being repeated;
+	// clients repeat it every few seconds while the user types
+	typingTTL = 6 * time.Second
+	// typingThrottle is the least time between two typing:start of a user
+	// in a channel passed on to the others, repeats in between only
+	// extend it
+	typingThrottle = 3 * time.Second
+	// presenceTTL drops a connection that stopped sending heartbeats (every
+	// 10s) without a disconnect, e.g. when its instance died
+	presenceTTL = 30 * time.Second
+)
+
+// TypingRequest is what a client sends as typing:start and typing:stop.
+type TypingRequest struct {
+	ChannelID int64 `json:"channel_id"`
+}
+
+// TypingEvent is emitted as typing:start and typing:stop to the online
+// members of the channel, the typist included.
+type TypingEvent struct {
+	ChannelID int64  `json:"channel_id"`
+	UserID    int64  `json:"user_id"`
+	UserName  string `json:"user_name"`
+	// ExpiresAt comes with typing:start: stop showing it then unless it is
+	// repeated, a typing:stop may never come
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PresenceEvent is emitted as presence:join when a user's first connection
+// opens and presence:leave when their last one closes, once per channel of
+// theirs to its online members.
+type PresenceEvent struct {
+	ChannelID int64  `json:"channel_id"`
+	UserID    int64  `json:"user_id"`
+	UserName  string `json:"user_name"`
+}
+
+type typingKey struct {
+	channelId, userId int64
+}
+
+type typingState struct {
+	connId    string
+	userName  string
+	shownAt   time.Time // when typing:start was last passed on
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
+// typingTracker holds who is typing where, for the connections of this
+// instance.
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{active: make(map[typingKey]*typingState)}
+}
+
+func (t *typingTracker) start(connId string, key typingKey, userName string) {
+	now := time.Now()
+	t.mu.Lock()
+	st, ok := t.active[key]
+	if !ok {
+		st = &typingState{userName: userName}
+		st.timer = time.AfterFunc(typingTTL, func() { t.expire(key, st) })
+		t.active[key] = st
+	}
+	st.connId = connId
+	st.expiresAt = now.Add(typingTTL)
+	expiresAt := st.expiresAt
+	show := now.Sub(st.shownAt) >= typingThrottle
+	if show {
+		st.shownAt = now
+	}
+	t.mu.Unlock()
+	if show {
+		emitToChannelRoom(key.channelId, "typing:start", TypingEvent{ChannelID: key.channelId, UserID: key.userId, UserName: userName, ExpiresAt: &expiresAt})
+	}
+}
+
+// stop ends the typing of key, if any, and tells the channel.
+func (t *typingTracker) stop(key typingKey) {
+	t.mu.Lock()
+	st, ok := t.active[key]
+	if ok {
+		st.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+	if ok {
+		emitToChannelRoom(key.channelId, "typing:stop", TypingEvent{ChannelID: key.channelId, UserID: key.userId, UserName: st.userName})
+	}
+}
+
+// expire runs when the timer of st fires. Repeats only move expiresAt, so
+// the timer is set again for the rest.
+func (t *typingTracker) expire(key typingKey, st *typingState) {
+	t.mu.Lock()
+	if t.active[key] != st {
+		t.mu.Unlock()
+		return
+	}
+	if left := time.Until(st.expiresAt); left > 0 {
+		st.timer.Reset(left)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	t.stop(key)
+}
+
+// stopConn ends whatever connId was typing, when it disconnects.
+func (t *typingTracker) stopConn(connId string) {
+	t.mu.Lock()
+	var keys []typingKey
+	for key, st := range t.active {
+		if st.connId == connId {
+			keys = append(keys, key)
+		}
+	}
+	t.mu.Unlock()
+	for _, key := range keys {
+		t.stop(key)
+	}
+}
+
+// presenceBook counts the open connections of each user across instances.
+type presenceBook interface {
+	// online adds connId of userId, reporting whether it is their first.
+	online(userId int64, connId string) (bool, error)
+	// offline removes it, reporting whether it was their last.
+	offline(userId int64, connId string) (bool, error)
+	// refresh keeps connId counted, heartbeats call it.
+	refresh(userId int64, connId string) error
+}
+
+// localPresence is the presenceBook of a standalone instance.
+type localPresence struct {
+	mu    sync.Mutex
+	conns map[int64]map[string]bool
+}
+
+func newLocalPresence() *localPresence {
+	return &localPresence{conns: make(map[int64]map[string]bool)}
+}
+
+func (p *localPresence) online(userId int64, connId string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[userId] == nil {
+		p.conns[userId] = make(map[string]bool)
+	}
+	p.conns[userId][connId] = true
+	return len(p.conns[userId]) == 1, nil
+}
+
+func (p *localPresence) offline(userId int64, connId string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns, ok := p.conns[userId]
+	if !ok {
+		return false, nil
+	}
+	delete(conns, connId)
+	if len(conns) == 0 {
+		delete(p.conns, userId)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *localPresence) refresh(userId int64, connId string) error {
+	return nil
+}
+
+// redisPresence shares presence between instances: a sorted set per user
+// of instance:connection scored by when it lapses without a heartbeat.
+// The same redis carries membership changes and search index updates to the
+// other instances, see followChannel and indexMessage.
+type redisPresence struct {
+	pool     *redis.Pool
+	addr     string
+	instance string
+}
+
+const (
+	followChannelName = "slack:follow"
+	indexChannelName  = "slack:index"
+)
+
+func newRedisPresence(addr string) *redisPresence {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &redisPresence{
+		pool: &redis.Pool{
+			MaxIdle:     4,
+			IdleTimeout: time.Minute,
+			Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		},
+		addr:     addr,
+		instance: hex.EncodeToString(id),
+	}
+}
+
+func presenceKey(userId int64) string {
+	return "slack:presence:" + strconv.FormatInt(userId, 10)
+}
+
+// update adds or removes (cmd ZADD or ZREM) connId in the user's set, in
+// one transaction with dropping the lapsed connections, and reports
+// whether that changed the set and how many connections are left.
+func (p *redisPresence) update(cmd string, userId int64, connId string) (bool, int, error) {
+	conn := p.pool.Get()
+	defer conn.Close()
+	key := presenceKey(userId)
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", time.Now().Unix())
+	if cmd == "ZADD" {
+		conn.Send("ZADD", key, time.Now().Add(presenceTTL).Unix(), p.instance+":"+connId)
+	} else {
+		conn.Send(cmd, key, p.instance+":"+connId)
+	}
+	conn.Send("EXPIRE", key, int(presenceTTL.Seconds()))
+	conn.Send("ZCARD", key)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, 0, err
+	}
+	changed, err := redis.Int(replies[1], nil)
+	if err != nil {
+		return false, 0, err
+	}
+	n, err := redis.Int(replies[3], nil)
+	return changed > 0, n, err
+}
+
+func (p *redisPresence) online(userId int64, connId string) (bool, error) {
+	_, n, err := p.update("ZADD", userId, connId)
+	return n == 1, err
+}
+
+func (p *redisPresence) offline(userId int64, connId string) (bool, error) {
+	removed, n, err := p.update("ZREM", userId, connId)
+	return removed && n == 0, err
+}
+
+func (p *redisPresence) refresh(userId int64, connId string) error {
+	_, _, err := p.update("ZADD", userId, connId)
+	return err
+}
+
+// followMessage is a membership change published to the other instances.
+type followMessage struct {
+	Instance  string `json:"instance"`
+	UserID    int64  `json:"user_id"`
+	ChannelID int64  `json:"channel_id"`
+	Follow    bool   `json:"follow"`
+}
+
+func (p *redisPresence) publishFollow(userId, channelId int64, follow bool) {
+	msg, _ := json.Marshal(followMessage{Instance: p.instance, UserID: userId, ChannelID: channelId, Follow: follow})
+	conn := p.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", followChannelName, msg); err != nil {
+		fmt.Println("failed to publish membership change, err =  ", err)
+	}
+}
+
+// indexUpdate is a search index change published to the other instances.
+type indexUpdate struct {
+	Instance string  `json:"instance"`
+	Message  Message `json:"message"`
+	Remove   bool    `json:"remove"`
+}
+
+func (p *redisPresence) publishIndex(m Message, remove bool) {
+	msg, _ := json.Marshal(indexUpdate{Instance: p.instance, Message: m, Remove: remove})
+	conn := p.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PUBLISH", indexChannelName, msg); err != nil {
+		fmt.Println("failed to publish search index update, err =  ", err)
+	}
+}
+
+// listen applies the membership changes and search index updates of the
+// other instances here, reconnecting to redis when it drops. Updates sent
+// while it was away are missed until the next restart rebuilds the index.
+func (p *redisPresence) listen() {
+	for {
+		conn, err := redis.Dial("tcp", p.addr)
+		if err == nil {
+			psc := redis.PubSubConn{Conn: conn}
+			if err = psc.Subscribe(followChannelName, indexChannelName); err == nil {
+				err = p.receive(psc)
+			}
+			conn.Close()
+		}
+		fmt.Println("updates from redis interrupted, err =  ", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (p *redisPresence) receive(psc redis.PubSubConn) error {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			switch v.Channel {
+			case followChannelName:
+				var msg followMessage
+				if err := json.Unmarshal(v.Data, &msg); err != nil || msg.Instance == p.instance {
+					continue
+				}
+				if msg.Follow {
+					sockets.follow(msg.UserID, msg.ChannelID)
+				} else {
+					sockets.unfollow(msg.UserID, msg.ChannelID)
+				}
+			case indexChannelName:
+				var msg indexUpdate
+				if err := json.Unmarshal(v.Data, &msg); err != nil || msg.Instance == p.instance {
+					continue
+				}
+				if msg.Remove {
+					searchIdx.remove(msg.Message.MessageID)
+				} else {
+					searchIdx.put(msg.Message)
+				}
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+var (
+	typing = newTypingTracker()
+	// presence is a localPresence, or sharedPresence when there is redis
+	presence       presenceBook = newLocalPresence()
+	sharedPresence *redisPresence
+)
+
+// followChannel brings the channel rooms of userId's connections, here and
+// on the other instances, in line with a membership change.
+func followChannel(userId, channelId int64, follow bool) {
+	if follow {
+		sockets.follow(userId, channelId)
+	} else {
+		sockets.unfollow(userId, channelId)
+	}
+	if sharedPresence != nil {
+		sharedPresence.publishFollow(userId, channelId, follow)
+	}
+}
+
+// comeOnline puts a new connection in the rooms of its user's channels and,
+// for their first connection, tells those channels. It must not run in
+// OnConnect: emitting to a connection before its handler returned blocks
+// every room.
+func comeOnline(c socketio.Conn, claims Claims) {
+	channelIds, err := store.MemberOf(claims.UserID)
+	if err != nil {
+		fmt.Println("error while fetch channels of ", claims.UserID, " err =  ", err)
+		return
+	}
+	sockets.follow(claims.UserID, channelIds...)
+	first, err := presence.online(claims.UserID, c.ID())
+	if err != nil {
+		fmt.Println("failed to record presence of ", claims.UserID, " err =  ", err)
+		return
+	}
+	if !sockets.connected(c.ID()) {
+		// closed while this ran, its disconnect may have found nothing
+		// to take offline yet
+		presence.offline(claims.UserID, c.ID())
+		return
+	}
+	if first {
+		for _, channelId := range channelIds {
+			emitToChannelRoom(channelId, "presence:join", PresenceEvent{ChannelID: channelId, UserID: claims.UserID, UserName: claims.UserName})
+		}
+	}
+}
+
+// goOffline is comeOnline in reverse, for a closed connection.
+func goOffline(sc socketConn, claims Claims) {
+	typing.stopConn(sc.conn.ID())
+	last, err := presence.offline(sc.userId, sc.conn.ID())
+	if err != nil {
+		fmt.Println("failed to record presence of ", sc.userId, " err =  ", err)
+	}
+	if last {
+		for _, channelId := range sockets.followed(sc.userId) {
+			emitToChannelRoom(channelId, "presence:leave", PresenceEvent{ChannelID: channelId, UserID: sc.userId, UserName: claims.UserName})
+		}
+	}
+	sockets.forget(sc.userId)
+}
+
+// onTypingStart handles the "typing:start" socket.io event. Clients repeat
+// it while the user types; the server passes it on at most every
+// typingThrottle and ends it typingTTL after the last repeat.
+func onTypingStart(conn socketio.Conn, req TypingRequest) string {
+	claims, _ := conn.Context().(Claims)
+	if !sockets.follows(claims.UserID, req.ChannelID) {
+		return "error: " + errNotMember.Error()
+	}
+	typing.start(conn.ID(), typingKey{channelId: req.ChannelID, userId: claims.UserID}, claims.UserName)
+	return "ok"
+}
+
+// onTypingStop handles the "typing:stop" socket.io event.
+func onTypingStop(conn socketio.Conn, req TypingRequest) string {
+	typing.stop(typingKey{channelId: req.ChannelID, userId: socketUser(conn)})
+	return "ok"
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// copyBatch is how many messages a rebalance copies per round trip.
+const copyBatch = 500
+
+// maxSyncPasses bounds the compare and fix passes of a move. A channel so
+// busy that every pass still finds writes to fix is left moving; running
+// the move again resumes it.
+const maxSyncPasses = 20
+
+// rebalanceMain runs `slack rebalance`, which moves the messages of a
+// channel to another shard while the servers keep serving it:
+//
+//  1. the directory marks the channel as moving; once every server has
+//     seen that (placementTTL) writes go to both shards
+//  2. the existing rows are copied, then compared and fixed up until a
+//     pass finds nothing to fix: a write racing the copy may have missed
+//     the new shard
+//  3. reads switch to the new shard, writes still go to both
+//  4. writes stop going to the old shard and its rows are deleted
+//
+// A move that was interrupted is resumed by running it again.
+func rebalanceMain(args []string) {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	shardSpec := fs.String("shards", "", "the -shards the servers run with")
+	channelId := fs.Int64("channel", 0, "channel to move")
+	to := fs.Int("to", -1, "shard to move the channel to")
+	list := fs.Bool("list", false, "print the channels and messages on each shard")
+	settle := fs.Duration("settle", 2*placementTTL, "how long to wait for every server to see a directory change")
+	fs.Parse(args)
+	if *shardSpec == "" {
+		log.Fatal("-shards is required: without shards everything is in the main database and there is nothing to move")
+	}
+
+	meta, err := sql.Open("mysql", mysqlDSN)
+	if err != nil {
+		log.Fatal("error while connecting to mysql DB | ", err)
+	}
+	shards, err := openShards(*shardSpec)
+	if err != nil {
+		log.Fatal("error while connecting to the shards | ", err)
+	}
+	m := mysqlShards{router: newShardRouter(meta, shards)}
+	b := &rebalancer{shards: m, settle: *settle}
+	switch {
+	case *list:
+		err = m.list()
+	case *channelId != 0 && *to >= 0:
+		err = b.move(*channelId, *to)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// shardDirectory is what a move reads and changes: the channel_shard
+// directory and the rows of a channel on each shard. mysqlShards is the
+// real one.
+type shardDirectory interface {
+	count() int
+	lookup(channelId int64) (placement, error)
+	setPlacement(channelId int64, shard, movingTo int) error
+	// syncPass copies to shard dst what it misses or has stale of the
+	// channel on src, and says how many rows that fixed.
+	syncPass(channelId int64, src, dst int) (int, error)
+	// purge deletes the rows of the channel on shard.
+	purge(channelId int64, shard int) error
+}
+
+type rebalancer struct {
+	shards shardDirectory
+	settle time.Duration
+}
+
+// mysqlShards runs a move on the databases of router.
+type mysqlShards struct {
+	router *shardRouter
+}
+
+func (m mysqlShards) count() int { return len(m.router.shards) }
+
+func (m mysqlShards) lookup(channelId int64) (placement, error) {
+	return m.router.lookup(channelId)
+}
+
+func (m mysqlShards) list() error {
+	for i, db := range m.router.shards {
+		var placed, moving int
+		err := m.router.meta.QueryRow("select count(*), count(moving_to) from channel_shard where shard = ?", i).Scan(&placed, &moving)
+		if err != nil {
+			return err
+		}
+		var channels, messages int
+		if err := db.QueryRow("select count(distinct channel_id), count(*) from message").Scan(&channels, &messages); err != nil {
+			return err
+		}
+		fmt.Printf("shard %d: %d channels placed (%d moving), %d channels and %d messages stored\n", i, placed, moving, channels, messages)
+	}
+	return nil
+}
+
+// setPlacement writes the directory row of channelId; movingTo -1 is none.
+func (m mysqlShards) setPlacement(channelId int64, shard, movingTo int) error {
+	var moving interface{}
+	if movingTo >= 0 {
+		moving = movingTo
+	}
+	_, err := m.router.meta.Exec(`insert into channel_shard (channel_id,shard,moving_to) values (?,?,?)
+		on duplicate key update shard = values(shard), moving_to = values(moving_to)`, channelId, shard, moving)
+	return err
+}
+
+// setPlacement changes the directory and waits for every server to see it.
+func (b *rebalancer) setPlacement(channelId int64, shard, movingTo int) error {
+	if err := b.shards.setPlacement(channelId, shard, movingTo); err != nil {
+		return err
+	}
+	fmt.Println("channel ", channelId, " now on shard ", shard, " moving to ", movingTo, ", waiting ", b.settle, " for the servers")
+	time.Sleep(b.settle)
+	return nil
+}
+
+func (b *rebalancer) move(channelId int64, to int) error {
+	if to >= b.shards.count() {
+		return fmt.Errorf("no shard %d, there are %d", to, b.shards.count())
+	}
+	p, err := b.shards.lookup(channelId)
+	if err != nil {
+		return err
+	}
+	var from int
+	switch {
+	case p.movingTo < 0 && p.shard == to:
+		// a move that died after the last directory change left its rows
+		// on the old shard; no server writes to the others any more
+		for shard := 0; shard < b.shards.count(); shard++ {
+			if shard == to {
+				continue
+			}
+			if err := b.shards.purge(channelId, shard); err != nil {
+				return err
+			}
+		}
+		fmt.Println("channel ", channelId, " is on shard ", to)
+		return nil
+	case p.movingTo < 0 || p.movingTo == to:
+		// starting, or resuming before the reads switched
+		from = p.shard
+		if err := b.setPlacement(channelId, from, to); err != nil {
+			return err
+		}
+		if err := b.sync(channelId, from, to); err != nil {
+			return err
+		}
+		if err := b.setPlacement(channelId, to, from); err != nil {
+			return err
+		}
+	case p.shard == to:
+		// resuming after the reads switched
+		from = p.movingTo
+	default:
+		return fmt.Errorf("channel %d is being moved from shard %d to %d, finish that first", channelId, p.shard, p.movingTo)
+	}
+	if err := b.setPlacement(channelId, to, -1); err != nil {
+		return err
+	}
+	if err := b.shards.purge(channelId, from); err != nil {
+		return err
+	}
+	fmt.Println("channel ", channelId, " moved from shard ", from, " to ", to)
+	return nil
+}
+
+// sync makes the channel's rows on dst match src. It repeats until a pass
+// has nothing to fix, at most maxSyncPasses times.
+func (b *rebalancer) sync(channelId int64, src, dst int) error {
+	for pass := 1; pass <= maxSyncPasses; pass++ {
+		fixed, err := b.shards.syncPass(channelId, src, dst)
+		if err != nil {
+			return err
+		}
+		fmt.Println("channel ", channelId, " pass ", pass, ": ", fixed, " rows copied or fixed")
+		if fixed == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("channel %d still had rows to fix after %d passes, run the move again to resume it", channelId, maxSyncPasses)
+}
+
+func (m mysqlShards) syncPass(channelId int64, src, dst int) (int, error) {
+	from, to := m.router.shards[src], m.router.shards[dst]
+	fixed, err := syncMessages(channelId, from, to)
+	if err != nil {
+		return fixed, err
+	}
+	n, err := syncEdits(channelId, from, to)
+	fixed += n
+	if err != nil {
+		return fixed, err
+	}
+	n, err = syncReactions(channelId, from, to)
+	return fixed + n, err
+}
+
+// syncMessages copies the messages of channelId in id order, so a thread's
+// parent is always there before its replies.
+func syncMessages(channelId int64, src, dst *sql.DB) (int, error) {
+	fixed := 0
+	var last int64
+	for {
+		batch, err := storedMessages(src, "select "+messageColumns+" from message where channel_id = ? and message_id > ? order by message_id limit ?", channelId, last, copyBatch)
+		if err != nil || len(batch) == 0 {
+			return fixed, err
+		}
+		have, err := storedMessages(dst, "select "+messageColumns+" from message where channel_id = ? and message_id > ? and message_id <= ?", channelId, last, batch[len(batch)-1].MessageID)
+		if err != nil {
+			return fixed, err
+		}
+		insert, update := messageFixes(batch, have)
+		for _, m := range insert {
+			_, err := dst.Exec("insert ignore into message ("+messageColumns+") values (?,?,?,?,?,?,?,?,?,?)",
+				m.MessageID, m.SenderID, m.ChannelID, m.Msg, m.CreatedAt, m.ParentID, m.ReplyCount, m.LastReplyAt, m.EditedAt, m.DeletedAt)
+			if err != nil {
+				return fixed, err
+			}
+			fixed++
+		}
+		for _, m := range update {
+			_, err := dst.Exec("update message set msg = ?, reply_count = ?, last_reply_at = ?, edited_at = ?, deleted_at = ? where message_id = ?",
+				m.Msg, m.ReplyCount, m.LastReplyAt, m.EditedAt, m.DeletedAt, m.MessageID)
+			if err != nil {
+				return fixed, err
+			}
+			fixed++
+		}
+		last = batch[len(batch)-1].MessageID
+	}
+}
+
+// messageFixes compares a batch read from the source shard with what the
+// destination has of the same ids: the missing messages are to be
+// inserted, in batch order, and those that changed since to be updated.
+func messageFixes(batch, have []Message) (insert, update []Message) {
+	copied := make(map[int64]Message, len(have))
+	for _, m := range have {
+		copied[m.MessageID] = m
+	}
+	for _, m := range batch {
+		c, ok := copied[m.MessageID]
+		switch {
+		case !ok:
+			insert = append(insert, m)
+		case !sameMessage(c, m):
+			update = append(update, m)
+		}
+	}
+	return insert, update
+}
+
+func storedMessages(db *sql.DB, query string, args ...interface{}) ([]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		m, err := scanStoredMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// sameMessage compares what can change after a message was sent.
+func sameMessage(a, b Message) bool {
+	sameTime := func(x, y *time.Time) bool {
+		return (x == nil && y == nil) || (x != nil && y != nil && x.Equal(*y))
+	}
+	return a.Msg == b.Msg && a.ReplyCount == b.ReplyCount && sameTime(a.LastReplyAt, b.LastReplyAt) &&
+		sameTime(a.EditedAt, b.EditedAt) && sameTime(a.DeletedAt, b.DeletedAt)
+}
+
+// syncEdits copies the edit history; edits are never changed, only added.
+func syncEdits(channelId int64, src, dst *sql.DB) (int, error) {
+	rows, err := src.Query(`select e.edit_id, e.message_id, e.old_msg, e.edited_at
+		  from message_edit e join message m on m.message_id = e.message_id
+		 where m.channel_id = ? order by e.edit_id`, channelId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	fixed := 0
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.EditID, &e.MessageID, &e.OldMsg, &e.EditedAt); err != nil {
+			return fixed, err
+		}
+		result, err := dst.Exec("insert ignore into message_edit (edit_id,message_id,old_msg,edited_at) values (?,?,?,?)", e.EditID, e.MessageID, e.OldMsg, e.EditedAt)
+		if err != nil {
+			return fixed, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			fixed++
+		}
+	}
+	return fixed, rows.Err()
+}
+
+type reactionRow struct {
+	messageId, userId int64
+	emoji             string
+}
+
+// syncReactions adds what dst misses and removes what src no longer has.
+func syncReactions(channelId int64, src, dst *sql.DB) (int, error) {
+	want, err := channelReactions(src, channelId)
+	if err != nil {
+		return 0, err
+	}
+	have, err := channelReactions(dst, channelId)
+	if err != nil {
+		return 0, err
+	}
+	fixed := 0
+	add, drop := reactionFixes(want, have)
+	for _, r := range add {
+		if _, err := dst.Exec("insert ignore into reaction (message_id,user_id,emoji,created_at) values (?,?,?,?)", r.messageId, r.userId, r.emoji, want[r]); err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+	for _, r := range drop {
+		if _, err := dst.Exec("delete from reaction where message_id = ? and user_id = ? and emoji = ?", r.messageId, r.userId, r.emoji); err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+	return fixed, nil
+}
+
+// reactionFixes says which reactions the destination has to add and which
+// to drop to match want, the source's.
+func reactionFixes(want, have map[reactionRow]time.Time) (add, drop []reactionRow) {
+	for r := range want {
+		if _, ok := have[r]; !ok {
+			add = append(add, r)
+		}
+	}
+	for r := range have {
+		if _, ok := want[r]; !ok {
+			drop = append(drop, r)
+		}
+	}
+	return add, drop
+}
+
+func channelReactions(db *sql.DB, channelId int64) (map[reactionRow]time.Time, error) {
+	rows, err := db.Query(`select r.message_id, r.user_id, r.emoji, r.created_at
+		  from reaction r join message m on m.message_id = r.message_id
+		 where m.channel_id = ?`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[reactionRow]time.Time)
+	for rows.Next() {
+		var r reactionRow
+		var at time.Time
+		if err := rows.Scan(&r.messageId, &r.userId, &r.emoji, &at); err != nil {
+			return nil, err
+		}
+		out[r] = at
+	}
+	return out, rows.Err()
+}
+
+// purge deletes what the channel left behind on its old shard, children
+// before the rows they point at.
+func (m mysqlShards) purge(channelId int64, shard int) error {
+	db := m.router.shards[shard]
+	for _, query := range []string{
+		"delete r from reaction r join message m on m.message_id = r.message_id where m.channel_id = ?",
+		"delete e from message_edit e join message m on m.message_id = e.message_id where m.channel_id = ?",
+		"delete from message where channel_id = ? and parent_id is not null",
+		"delete from message where channel_id = ?",
+	} {
+		result, err := db.Exec(query, channelId)
+		if err != nil {
+			return err
+		}
+		n, _ := result.RowsAffected()
+		fmt.Println("purged ", n, " rows => ", query)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeShards is one channel spread over in-memory shards, each holding the
+// ids of the channel's rows.
+type fakeShards struct {
+	p          placement
+	rows       []map[int64]bool
+	placements []placement
+	purged     []int
+	passes     int
+	// busy is how many more passes a write lands on the source only, as
+	// one racing the copy would
+	busy     int
+	nextRow  int64
+	syncErr  error
+	purgeErr error
+}
+
+func newFakeShards(shards int, p placement, ids ...int64) *fakeShards {
+	f := &fakeShards{p: p, nextRow: 100}
+	for i := 0; i < shards; i++ {
+		f.rows = append(f.rows, map[int64]bool{})
+	}
+	for _, id := range ids {
+		f.rows[p.shard][id] = true
+	}
+	return f
+}
+
+func (f *fakeShards) count() int { return len(f.rows) }
+
+func (f *fakeShards) lookup(int64) (placement, error) { return f.p, nil }
+
+func (f *fakeShards) setPlacement(_ int64, shard, movingTo int) error {
+	f.p = placement{shard: shard, movingTo: movingTo}
+	f.placements = append(f.placements, f.p)
+	return nil
+}
+
+func (f *fakeShards) syncPass(_ int64, src, dst int) (int, error) {
+	if f.syncErr != nil {
+		err := f.syncErr
+		f.syncErr = nil
+		return 0, err
+	}
+	if f.p.shard != src || f.p.movingTo != dst {
+		return 0, fmt.Errorf("synced %d to %d while placed at %+v", src, dst, f.p)
+	}
+	f.passes++
+	fixed := 0
+	for id := range f.rows[src] {
+		if !f.rows[dst][id] {
+			f.rows[dst][id] = true
+			fixed++
+		}
+	}
+	if f.busy > 0 {
+		f.busy--
+		f.nextRow++
+		f.rows[src][f.nextRow] = true
+	}
+	return fixed, nil
+}
+
+func (f *fakeShards) purge(_ int64, shard int) error {
+	if f.purgeErr != nil {
+		return f.purgeErr
+	}
+	f.purged = append(f.purged, shard)
+	f.rows[shard] = map[int64]bool{}
+	return nil
+}
+
+func rowIDs(rows map[int64]bool) []int64 {
+	return slices.Sorted(maps.Keys(rows))
+}
+
+func TestMove(t *testing.T) {
+	f := newFakeShards(3, placement{shard: 0, movingTo: -1}, 1, 2)
+	if err := (&rebalancer{shards: f}).move(7, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []placement{{0, 2}, {2, 0}, {2, -1}}; !slices.Equal(f.placements, want) {
+		t.Errorf("placements %v, want %v", f.placements, want)
+	}
+	if got := rowIDs(f.rows[2]); !slices.Equal(got, []int64{1, 2}) {
+		t.Errorf("shard 2 has %v", got)
+	}
+	if len(f.rows[0]) != 0 || !slices.Equal(f.purged, []int{0}) {
+		t.Errorf("shard 0 left with %v after purging %v", rowIDs(f.rows[0]), f.purged)
+	}
+}
+
+func TestMoveResumes(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		f          *fakeShards
+		placements []placement
+		purged     []int
+	}{
+		{
+			name:       "while copying",
+			f:          newFakeShards(3, placement{shard: 0, movingTo: 2}, 1, 2),
+			placements: []placement{{0, 2}, {2, 0}, {2, -1}},
+			purged:     []int{0},
+		},
+		{
+			name:       "after the reads switched",
+			f:          newFakeShards(3, placement{shard: 2, movingTo: 0}, 1, 2),
+			placements: []placement{{2, -1}},
+			purged:     []int{0},
+		},
+		{
+			// the old rows are left: the purge never ran
+			name:   "after the last directory change",
+			f:      newFakeShards(3, placement{shard: 2, movingTo: -1}, 1, 2),
+			purged: []int{0, 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := tc.f
+			// whatever the last run got to, both sides hold the rows
+			f.rows[0] = map[int64]bool{1: true, 2: true}
+			f.rows[2] = map[int64]bool{1: true}
+			if f.p.shard == 2 {
+				f.rows[2][2] = true
+			}
+			if err := (&rebalancer{shards: f}).move(7, 2); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(f.placements, tc.placements) {
+				t.Errorf("placements %v, want %v", f.placements, tc.placements)
+			}
+			if !slices.Equal(f.purged, tc.purged) {
+				t.Errorf("purged %v, want %v", f.purged, tc.purged)
+			}
+			if got := rowIDs(f.rows[2]); !slices.Equal(got, []int64{1, 2}) || len(f.rows[0]) != 0 {
+				t.Errorf("shard 2 has %v and shard 0 %v", got, rowIDs(f.rows[0]))
+			}
+		})
+	}
+}
+
+func TestMoveFailsAndResumes(t *testing.T) {
+	f := newFakeShards(2, placement{shard: 0, movingTo: -1}, 1, 2)
+	down := errors.New("shard 1 is down")
+	f.syncErr = down
+	b := &rebalancer{shards: f}
+	if err := b.move(7, 1); !errors.Is(err, down) {
+		t.Fatalf("move = %v, want %v", err, down)
+	}
+	if f.p != (placement{0, 1}) || len(f.rows[0]) != 2 {
+		t.Fatalf("a failed copy left the channel at %+v with %v on its shard", f.p, rowIDs(f.rows[0]))
+	}
+
+	if err := b.move(7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if f.p != (placement{1, -1}) || len(f.rows[1]) != 2 || len(f.rows[0]) != 0 {
+		t.Errorf("the resumed move ended at %+v with %v and %v", f.p, rowIDs(f.rows[0]), rowIDs(f.rows[1]))
+	}
+
+	// a failed purge is finished by running the move again
+	f = newFakeShards(2, placement{shard: 0, movingTo: -1}, 1)
+	f.purgeErr = errors.New("lock wait timeout")
+	b = &rebalancer{shards: f}
+	if err := b.move(7, 1); err == nil {
+		t.Fatal("a failed purge was not reported")
+	}
+	f.purgeErr = nil
+	if err := b.move(7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.rows[0]) != 0 {
+		t.Errorf("shard 0 still has %v", rowIDs(f.rows[0]))
+	}
+}
+
+func TestMoveSyncPasses(t *testing.T) {
+	f := newFakeShards(2, placement{shard: 0, movingTo: -1}, 1, 2)
+	f.busy = 3
+	if err := (&rebalancer{shards: f}).move(7, 1); err != nil {
+		t.Fatal(err)
+	}
+	// one pass per racing write, then the one that finds nothing
+	if f.passes != 5 {
+		t.Errorf("%d passes, want 5", f.passes)
+	}
+	if got := rowIDs(f.rows[1]); !slices.Equal(got, []int64{1, 2, 101, 102, 103}) {
+		t.Errorf("shard 1 has %v", got)
+	}
+
+	// a channel that keeps every pass busy is left moving
+	f = newFakeShards(2, placement{shard: 0, movingTo: -1}, 1, 2)
+	f.busy = maxSyncPasses
+	b := &rebalancer{shards: f}
+	if err := b.move(7, 1); err == nil {
+		t.Fatal("the move finished while every pass had rows to fix")
+	}
+	if f.passes != maxSyncPasses || f.p != (placement{0, 1}) || len(f.rows[0]) == 0 {
+		t.Fatalf("gave up after %d passes at %+v", f.passes, f.p)
+	}
+	if err := b.move(7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.rows[1]) != 2+maxSyncPasses || len(f.rows[0]) != 0 {
+		t.Errorf("the resumed move left %d rows on shard 1 and %d on shard 0", len(f.rows[1]), len(f.rows[0]))
+	}
+}
+
+func TestMoveRefuses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    placement
+		to   int
+	}{
+		{"no such shard", placement{shard: 0, movingTo: -1}, 3},
+		{"moving elsewhere", placement{shard: 0, movingTo: 1}, 2},
+		{"moving elsewhere after the reads switched", placement{shard: 1, movingTo: 0}, 2},
+	} {
+		f := newFakeShards(3, tc.p, 1)
+		if err := (&rebalancer{shards: f}).move(7, tc.to); err == nil {
+			t.Errorf("%s: moved to %d", tc.name, tc.to)
+		}
+		if len(f.placements) != 0 || len(f.purged) != 0 || f.passes != 0 {
+			t.Errorf("%s: changed %v, purged %v, synced %d times", tc.name, f.placements, f.purged, f.passes)
+		}
+	}
+}
+
+func TestMessageFixes(t *testing.T) {
+	at := time.Date(2024, 1, 31, 12, 0, 0, 0, time.Local)
+	later := at.Add(time.Minute)
+	msg := func(id int64, text string, edited *time.Time) Message {
+		return Message{MessageID: id, ChannelID: 7, Msg: text, CreatedAt: at, EditedAt: edited}
+	}
+	utc := at.UTC()
+	batch := []Message{msg(1, "a", nil), msg(2, "b", &at), msg(3, "c", nil), msg(4, "d", &later)}
+	have := []Message{
+		msg(2, "b", &utc), // the same instant read back in another zone
+		msg(3, "old", nil),
+		msg(4, "d", &at),
+	}
+	insert, update := messageFixes(batch, have)
+	ids := func(ms []Message) []int64 {
+		var out []int64
+		for _, m := range ms {
+			out = append(out, m.MessageID)
+		}
+		return out
+	}
+	if got := ids(insert); !slices.Equal(got, []int64{1}) {
+		t.Errorf("inserts %v, want [1]", got)
+	}
+	if got := ids(update); !slices.Equal(got, []int64{3, 4}) {
+		t.Errorf("updates %v, want [3 4]", got)
+	}
+	if insert, update := messageFixes(batch, batch); insert != nil || update != nil {
+		t.Errorf("a synced batch still has %v to insert and %v to update", ids(insert), ids(update))
+	}
+}
+
+func TestSameMessage(t *testing.T) {
+	at := time.Date(2024, 1, 31, 12, 0, 0, 0, time.Local)
+	utc, later := at.UTC(), at.Add(time.Microsecond)
+	m := Message{Msg: "x", ReplyCount: 1, LastReplyAt: &at}
+	for _, tc := range []struct {
+		name string
+		c    Message
+		want bool
+	}{
+		{"same", m, true},
+		{"other zone", Message{Msg: "x", ReplyCount: 1, LastReplyAt: &utc}, true},
+		{"text", Message{Msg: "y", ReplyCount: 1, LastReplyAt: &at}, false},
+		{"reply count", Message{Msg: "x", ReplyCount: 2, LastReplyAt: &at}, false},
+		{"reply time", Message{Msg: "x", ReplyCount: 1, LastReplyAt: &later}, false},
+		{"no reply time", Message{Msg: "x", ReplyCount: 1}, false},
+		{"deleted", Message{Msg: "x", ReplyCount: 1, LastReplyAt: &at, DeletedAt: &at}, false},
+	} {
+		if got := sameMessage(m, tc.c); got != tc.want {
+			t.Errorf("%s: sameMessage = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReactionFixes(t *testing.T) {
+	at := time.Date(2024, 1, 31, 12, 0, 0, 0, time.Local)
+	thumbs, party, gone := reactionRow{1, 1, "+1"}, reactionRow{1, 2, "tada"}, reactionRow{2, 1, "eyes"}
+	want := map[reactionRow]time.Time{thumbs: at, party: at}
+	have := map[reactionRow]time.Time{thumbs: at.Add(time.Hour), gone: at}
+	add, drop := reactionFixes(want, have)
+	if !slices.Equal(add, []reactionRow{party}) || !slices.Equal(drop, []reactionRow{gone}) {
+		t.Errorf("add %v and drop %v, want [%v] and [%v]", add, drop, party, gone)
+	}
+	if add, drop := reactionFixes(want, want); add != nil || drop != nil {
+		t.Errorf("matching reactions still add %v and drop %v", add, drop)
+	}
+}
+
+func TestUnshardedRouter(t *testing.T) {
+	// opening does not connect: nothing here may reach the database
+	meta, err := sql.Open("mysql", "nobody@tcp(127.0.0.1:1)/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta.Close()
+	r := newShardRouter(meta, nil)
+
+	if p, err := r.lookup(7); err != nil || p != (placement{shard: 0, movingTo: -1}) {
+		t.Errorf("lookup = %+v, %v", p, err)
+	}
+	if err := r.assign(7); err != nil {
+		t.Errorf("assign: %v", err)
+	}
+	if id, err := r.nextID(); err != nil || id != 0 {
+		t.Errorf("nextID = %d, %v, want 0 for auto_increment", id, err)
+	}
+	if db, err := r.reader(7); err != nil || db != meta {
+		t.Errorf("reader is not the main database: %v", err)
+	}
+	if dbs, err := r.writers(7); err != nil || !slices.Equal(dbs, []*sql.DB{meta}) {
+		t.Errorf("writers = %v, %v, want the main database", dbs, err)
+	}
+	if seqID(0) != nil || seqID(5) != int64(5) {
+		t.Errorf("seqID(0) = %v and seqID(5) = %v", seqID(0), seqID(5))
+	}
+}
+
+func TestOpenShards(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		n       int
+		wantErr bool
+	}{
+		{spec: "", n: 0},
+		{spec: "3", n: 3},
+		{spec: "0", wantErr: true},
+		{spec: "a@tcp(h1:3306)/s, a@tcp(h2:3306)/s", n: 2},
+	} {
+		dbs, err := openShards(tc.spec)
+		if (err != nil) != tc.wantErr || len(dbs) != tc.n {
+			t.Errorf("openShards(%q) = %d shards, %v", tc.spec, len(dbs), err)
+		}
+		for _, db := range dbs {
+			db.Close()
+		}
+	}
+}
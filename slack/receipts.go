@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// MarkReadRequest moves a member's read marker. With MessageID zero the
+// whole channel is read up to now.
+type MarkReadRequest struct {
+	UserID    int64 `json:"user_id"`
+	ChannelID int64 `json:"channel_id"`
+	MessageID int64 `json:"message_id"`
+}
+
+// SeenReceipt is emitted as "seen" to the other participants of a DM when
+// one of them reads it.
+type SeenReceipt struct {
+	ChannelID  int64     `json:"channel_id"`
+	UserID     int64     `json:"user_id"`
+	UserName   string    `json:"user_name"`
+	LastReadAt time.Time `json:"last_read_at"`
+}
+
+var errNotMember = errors.New("not a member of this channel")
+
+// markRead sets the read marker of userId in channelId and sends the seen
+// receipt. The marker only moves forward, so a late event for an older
+// message cannot make read messages unread again.
+func markRead(req MarkReadRequest) (time.Time, error) {
+	m, err := store.Membership(req.ChannelID, req.UserID)
+	if errors.Is(err, errNotFound) {
+		return time.Time{}, errNotMember
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	readAt := time.Now()
+	if req.MessageID != 0 {
+		msg, err := store.Message(req.ChannelID, req.MessageID)
+		if err != nil {
+			return time.Time{}, err
+		}
+		readAt = msg.CreatedAt
+	}
+	if m.LastReadAt != nil && !readAt.After(*m.LastReadAt) {
+		return *m.LastReadAt, nil
+	}
+	if err := store.SetLastRead(m.MembershipID, readAt); err != nil {
+		return time.Time{}, err
+	}
+	go sendSeenReceipt(req.ChannelID, req.UserID, readAt)
+	return readAt, nil
+}
+
+func sendSeenReceipt(channelId, userId int64, readAt time.Time) {
+	ch, err := store.Channel(channelId)
+	if err != nil || ch.ChannelType != ChannelDM {
+		return
+	}
+	members, err := store.Members(channelId)
+	if err != nil {
+		fmt.Println("error while fetch members for seen receipt, err =  ", err)
+		return
+	}
+	user, _ := store.User(userId)
+	receipt := SeenReceipt{ChannelID: channelId, UserID: userId, UserName: user.UserName, LastReadAt: readAt}
+	for _, member := range members {
+		if member.UserID == userId {
+			continue
+		}
+		emitToUser(member.UserID, "seen", receipt)
+	}
+}
+
+// markReadHandler serves POST /channels/{channelId}/read/{userId} with an
+// optional {"message_id"} body.
+func markReadHandler(w http.ResponseWriter, r *http.Request) {
+	var req MarkReadRequest
+	var err error
+	if req.ChannelID, err = pathID(r, "channelId"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID, err = pathID(r, "userId"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength != 0 {
+		var body MarkReadRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		req.MessageID = body.MessageID
+	}
+	readAt, err := markRead(req)
+	switch {
+	case errors.Is(err, errNotMember):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errNotFound):
+		http.Error(w, "message not found in this channel", http.StatusNotFound)
+		return
+	case err != nil:
+		fmt.Println("failed to mark read, err =  ", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]time.Time{"last_read_at": readAt})
+}
+
+// onMarkRead handles the "markRead" socket.io event, the realtime twin of
+// markReadHandler. The ack carries the new marker or an error.
+func onMarkRead(conn socketio.Conn, req MarkReadRequest) string {
+	req.UserID = socketUser(conn)
+	readAt, err := markRead(req)
+	if err != nil {
+		fmt.Println("markRead from ", conn.ID(), " failed, err =  ", err)
+		return "error: " + err.Error()
+	}
+	return readAt.Format(time.RFC3339Nano)
+}
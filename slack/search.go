@@ -0,0 +1,484 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The search index lives in process: an inverted index from term to the
+// messages holding it, with the term positions for phrase queries. MySQL
+// stays the source of truth, the index is rebuilt from it on start and
+// kept current by the handlers that insert, edit and delete messages.
+
+type searchDoc struct {
+	channelId int64
+	senderId  int64
+	createdAt time.Time
+	msg       string
+}
+
+type indexOp struct {
+	m      Message
+	remove bool
+}
+
+type textIndex struct {
+	mu       sync.RWMutex
+	docs     map[int64]*searchDoc
+	postings map[string]map[int64][]int // term -> message id -> positions
+	// while a rebuild loads from MySQL, updates are also kept here and
+	// applied to the new index before it replaces the live one
+	rebuilding bool
+	journal    []indexOp
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{docs: make(map[int64]*searchDoc), postings: make(map[string]map[int64][]int)}
+}
+
+var searchIdx = newTextIndex()
+
+// indexMessage puts m in the search index here and, with redis, on the
+// other instances, so a search through any of them finds it.
+func indexMessage(m Message) {
+	searchIdx.put(m)
+	if sharedPresence != nil {
+		sharedPresence.publishIndex(m, m.DeletedAt != nil)
+	}
+}
+
+// unindexMessage drops messageId from the search index everywhere.
+func unindexMessage(messageId int64) {
+	searchIdx.remove(messageId)
+	if sharedPresence != nil {
+		sharedPresence.publishIndex(Message{MessageID: messageId}, true)
+	}
+}
+
+type token struct {
+	term       string
+	start, end int // byte offsets in the text
+}
+
+// tokenize splits s into lower cased runs of letters and digits.
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, token{term: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+func terms(s string) []string {
+	tokens := tokenize(s)
+	out := make([]string, len(tokens))
+	for i, t := range tokens {
+		out[i] = t.term
+	}
+	return out
+}
+
+// put indexes m, replacing what was indexed for it before. Deleted
+// messages are only removed.
+func (idx *textIndex) put(m Message) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.apply(indexOp{m: m, remove: m.DeletedAt != nil})
+}
+
+func (idx *textIndex) remove(messageId int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.apply(indexOp{m: Message{MessageID: messageId}, remove: true})
+}
+
+func (idx *textIndex) apply(op indexOp) {
+	if idx.rebuilding {
+		idx.journal = append(idx.journal, op)
+	}
+	idx.unindex(op.m.MessageID)
+	if op.remove {
+		return
+	}
+	idx.docs[op.m.MessageID] = &searchDoc{channelId: op.m.ChannelID, senderId: op.m.SenderID, createdAt: op.m.CreatedAt, msg: op.m.Msg}
+	for pos, term := range terms(op.m.Msg) {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[int64][]int)
+		}
+		idx.postings[term][op.m.MessageID] = append(idx.postings[term][op.m.MessageID], pos)
+	}
+}
+
+func (idx *textIndex) unindex(messageId int64) {
+	doc, ok := idx.docs[messageId]
+	if !ok {
+		return
+	}
+	for _, term := range terms(doc.msg) {
+		delete(idx.postings[term], messageId)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, messageId)
+}
+
+// rebuild reloads the whole index from the store. Searches keep using the old
+// index until the new one is complete.
+func (idx *textIndex) rebuild() error {
+	idx.mu.Lock()
+	idx.rebuilding = true
+	idx.journal = nil
+	idx.mu.Unlock()
+
+	fresh := newTextIndex()
+	err := store.EachMessage(func(m Message) error {
+		fresh.apply(indexOp{m: m})
+		return nil
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.rebuilding = false
+	if err != nil {
+		idx.journal = nil
+		return err
+	}
+	// updates made while loading may or may not be in what was read, so
+	// replay them all: the last op for a message wins either way
+	for _, op := range idx.journal {
+		fresh.apply(op)
+	}
+	idx.journal = nil
+	idx.docs, idx.postings = fresh.docs, fresh.postings
+	return nil
+}
+
+// searchQuery is a parsed query: words and "quoted phrases" all have to
+// match, the filters narrow down where.
+type searchQuery struct {
+	words   []string
+	phrases [][]string
+	from    string // user name
+	in      string // channel name
+	before  *time.Time
+	after   *time.Time
+}
+
+// parseQuery understands words, "quoted phrases", from:user, in:#channel,
+// before:2006-01-02 and after:2006-01-02. A query of filters only lists
+// the messages they let through.
+func parseQuery(q string) (searchQuery, error) {
+	var sq searchQuery
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		if q[0] == '"' {
+			phrase, rest, ok := strings.Cut(q[1:], `"`)
+			if !ok {
+				return sq, errors.New("unterminated phrase")
+			}
+			q = rest
+			switch words := terms(phrase); len(words) {
+			case 0:
+			case 1:
+				sq.words = append(sq.words, words[0])
+			default:
+				sq.phrases = append(sq.phrases, words)
+			}
+			continue
+		}
+		field, rest, _ := strings.Cut(q, " ")
+		q = rest
+		key, value, ok := strings.Cut(field, ":")
+		if ok && value != "" {
+			key = strings.ToLower(key)
+			switch key {
+			case "from":
+				sq.from = strings.TrimPrefix(value, "@")
+				continue
+			case "in":
+				sq.in = strings.TrimPrefix(value, "#")
+				continue
+			case "before", "after":
+				day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+				if err != nil {
+					return sq, fmt.Errorf("%s: want a date like 2006-01-02", key)
+				}
+				if key == "before" {
+					sq.before = &day
+				} else {
+					after := day.AddDate(0, 0, 1)
+					sq.after = &after
+				}
+				continue
+			}
+		}
+		sq.words = append(sq.words, terms(field)...)
+	}
+	if len(sq.words) == 0 && len(sq.phrases) == 0 && sq.from == "" && sq.in == "" && sq.before == nil && sq.after == nil {
+		return sq, errors.New("nothing to search for")
+	}
+	return sq, nil
+}
+
+// searchFilter is a searchQuery with its names resolved, and who may see
+// what.
+type searchFilter struct {
+	readable map[int64]bool
+	senderId int64
+	channels map[int64]bool // nil when not filtered by channel
+}
+
+type searchHit struct {
+	messageId int64
+	doc       searchDoc
+}
+
+// search returns up to limit+1 matches older than from, newest first.
+func (idx *textIndex) search(sq searchQuery, f searchFilter, from *cursor, limit int) []searchHit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	all := slices.Clone(sq.words)
+	for _, phrase := range sq.phrases {
+		all = append(all, phrase...)
+	}
+	// walk the rarest term's postings and check the others against it,
+	// or every message when there are only filters
+	ids, rest := maps.Keys(idx.docs), all
+	if len(all) > 0 {
+		slices.SortFunc(all, func(a, b string) int { return len(idx.postings[a]) - len(idx.postings[b]) })
+		ids, rest = maps.Keys(idx.postings[all[0]]), all[1:]
+	}
+	var hits []searchHit
+	for messageId := range ids {
+		doc := idx.docs[messageId]
+		if !f.readable[doc.channelId] ||
+			(f.channels != nil && !f.channels[doc.channelId]) ||
+			(f.senderId != 0 && doc.senderId != f.senderId) ||
+			(sq.before != nil && !doc.createdAt.Before(*sq.before)) ||
+			(sq.after != nil && doc.createdAt.Before(*sq.after)) ||
+			(from != nil && !from.before(doc.createdAt, messageId)) {
+			continue
+		}
+		if !idx.hasAll(messageId, rest) || !idx.hasPhrases(messageId, sq.phrases) {
+			continue
+		}
+		hits = append(hits, searchHit{messageId: messageId, doc: *doc})
+	}
+	slices.SortFunc(hits, func(a, b searchHit) int {
+		if c := b.doc.createdAt.Compare(a.doc.createdAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.messageId, a.messageId)
+	})
+	return hits[:min(len(hits), limit+1)]
+}
+
+func (idx *textIndex) hasAll(messageId int64, words []string) bool {
+	for _, w := range words {
+		if _, ok := idx.postings[w][messageId]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *textIndex) hasPhrases(messageId int64, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range idx.postings[phrase[0]][messageId] {
+			found = true
+			for i, w := range phrase[1:] {
+				if !slices.Contains(idx.postings[w][messageId], start+i+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+const snippetContext = 60
+
+// snippet cuts the part of msg around the first match and marks every
+// matched word with <mark>. The rest is HTML escaped, so clients can show
+// it as is.
+func snippet(msg string, sq searchQuery) string {
+	want := make(map[string]bool)
+	for _, w := range sq.words {
+		want[w] = true
+	}
+	for _, phrase := range sq.phrases {
+		for _, w := range phrase {
+			want[w] = true
+		}
+	}
+	var matched []token
+	for _, t := range tokenize(msg) {
+		if want[t.term] {
+			matched = append(matched, t)
+		}
+	}
+	start, end := 0, len(msg)
+	if len(matched) > 0 {
+		start = max(0, matched[0].start-snippetContext)
+		end = min(len(msg), matched[0].end+2*snippetContext)
+	}
+	for start > 0 && !utf8.RuneStart(msg[start]) {
+		start++
+	}
+	for end < len(msg) && !utf8.RuneStart(msg[end]) {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	at := start
+	for _, t := range matched {
+		if t.start < start || t.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(msg[at:t.start]))
+		b.WriteString("<mark>" + html.EscapeString(msg[t.start:t.end]) + "</mark>")
+		at = t.end
+	}
+	b.WriteString(html.EscapeString(msg[at:end]))
+	if end < len(msg) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// SearchResult is one matching message with its highlighted snippet.
+type SearchResult struct {
+	MessageID   int64     `json:"message_id"`
+	ChannelID   int64     `json:"channel_id"`
+	ChannelName string    `json:"channel_name"`
+	SenderID    int64     `json:"sender_id"`
+	SenderName  string    `json:"sender_name"`
+	CreatedAt   time.Time `json:"created_at"`
+	Snippet     string    `json:"snippet"`
+}
+
+// SearchPage is one page of results, newest first. Next is the cursor of
+// the following page, empty on the last one.
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// searchMessages serves GET /search?q=&limit=&cursor=
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	sq, err := parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxPageSize)
+	}
+	from, err := queryCursor(r, "cursor")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f := searchFilter{}
+	if f.readable, err = store.Readable(caller(r).UserID); err != nil {
+		fmt.Println("error while fetch readable channels, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	if sq.from != "" {
+		sender, err := store.UserByName(sq.from)
+		if errors.Is(err, errNotFound) {
+			// nobody by that name sent anything
+			writeJSON(w, http.StatusOK, SearchPage{Results: make([]SearchResult, 0)})
+			return
+		}
+		if err != nil {
+			fmt.Println("error while fetch user, err =  ", err)
+			http.Error(w, "fetch try again", http.StatusInternalServerError)
+			return
+		}
+		f.senderId = sender.Id
+	}
+	if sq.in != "" {
+		named, err := store.ChannelsNamed(sq.in)
+		if err != nil {
+			fmt.Println("error while fetch channel, err =  ", err)
+			http.Error(w, "fetch try again", http.StatusInternalServerError)
+			return
+		}
+		f.channels = make(map[int64]bool)
+		for _, ch := range named {
+			f.channels[ch.ChannelID] = true
+		}
+	}
+
+	hits := searchIdx.search(sq, f, from, limit)
+	page := SearchPage{Results: make([]SearchResult, 0, len(hits))}
+	if len(hits) > limit {
+		hits = hits[:limit]
+		last := hits[limit-1]
+		page.Next = encodeCursor(Message{MessageID: last.messageId, CreatedAt: last.doc.createdAt})
+	}
+	senders := make(map[int64]string)
+	channels := make(map[int64]string)
+	for _, h := range hits {
+		if _, ok := senders[h.doc.senderId]; !ok {
+			sender, _ := store.User(h.doc.senderId)
+			senders[h.doc.senderId] = sender.UserName
+		}
+		if _, ok := channels[h.doc.channelId]; !ok {
+			ch, _ := store.Channel(h.doc.channelId)
+			channels[h.doc.channelId] = ch.ChannelName
+		}
+		page.Results = append(page.Results, SearchResult{
+			MessageID:   h.messageId,
+			ChannelID:   h.doc.channelId,
+			ChannelName: channels[h.doc.channelId],
+			SenderID:    h.doc.senderId,
+			SenderName:  senders[h.doc.senderId],
+			CreatedAt:   h.doc.createdAt,
+			Snippet:     snippet(h.doc.msg, sq),
+		})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
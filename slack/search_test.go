@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []token
+	}{
+		{"", nil},
+		{"Deploy!", []token{{"deploy", 0, 6}}},
+		{"new  build, v2.0", []token{{"new", 0, 3}, {"build", 5, 10}, {"v2", 12, 14}, {"0", 15, 16}}},
+		{"Grüße an ANN", []token{{"grüße", 0, 7}, {"an", 8, 10}, {"ann", 11, 14}}},
+		{"<b>&amp;", []token{{"b", 1, 2}, {"amp", 4, 7}}},
+	} {
+		if got := tokenize(tc.in); !slices.Equal(got, tc.want) {
+			t.Errorf("tokenize(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, _ := time.ParseInLocation(time.DateOnly, s, time.Local)
+		return &d
+	}
+	for _, tc := range []struct {
+		q       string
+		want    searchQuery
+		wantErr bool
+	}{
+		{q: `deploy failed`, want: searchQuery{words: []string{"deploy", "failed"}}},
+		{q: `"new build" ok`, want: searchQuery{words: []string{"ok"}, phrases: [][]string{{"new", "build"}}}},
+		{q: `"Deploy"`, want: searchQuery{words: []string{"deploy"}}},
+		{q: `x from:@ann in:#general`, want: searchQuery{words: []string{"x"}, from: "ann", in: "general"}},
+		{q: `x before:2024-01-31`, want: searchQuery{words: []string{"x"}, before: day("2024-01-31")}},
+		{q: `x Before:2024-01-31`, want: searchQuery{words: []string{"x"}, before: day("2024-01-31")}},
+		// after a day means from the next one on
+		{q: `x AFTER:2024-01-31`, want: searchQuery{words: []string{"x"}, after: day("2024-02-01")}},
+		{q: `from:ann in:#general`, want: searchQuery{from: "ann", in: "general"}},
+		{q: `note:this`, want: searchQuery{words: []string{"note", "this"}}},
+		{q: ``, wantErr: true},
+		{q: `"" ,`, wantErr: true},
+		{q: `"open phrase`, wantErr: true},
+		{q: `x before:yesterday`, wantErr: true},
+	} {
+		got, err := parseQuery(tc.q)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseQuery(%q) error %v, want error %v", tc.q, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if fmt.Sprint(got.words, got.phrases, got.from, got.in) != fmt.Sprint(tc.want.words, tc.want.phrases, tc.want.from, tc.want.in) ||
+			!sameDay(got.before, tc.want.before) || !sameDay(got.after, tc.want.after) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func sameDay(a, b *time.Time) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Equal(*b))
+}
+
+var base = time.Date(2024, 1, 31, 12, 0, 0, 0, time.Local)
+
+// testIndex holds messages at one minute steps from base, in the readable
+// channels 1 and 2 and one in channel 3.
+func testIndex() *textIndex {
+	idx := newTextIndex()
+	for i, m := range []struct {
+		channelId, senderId int64
+		msg                 string
+	}{
+		{1, 1, "deploy the new build"},
+		{1, 2, "new deploy build"},
+		{2, 1, "build is new"},
+		{2, 2, "deploy done"},
+		{3, 1, "deploy in a channel nobody reads"},
+	} {
+		idx.put(Message{MessageID: int64(i + 1), ChannelID: m.channelId, SenderID: m.senderId, Msg: m.msg, CreatedAt: base.Add(time.Duration(i) * time.Minute)})
+	}
+	return idx
+}
+
+func hitIDs(hits []searchHit) []int64 {
+	ids := make([]int64, len(hits))
+	for i, h := range hits {
+		ids[i] = h.messageId
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	idx := testIndex()
+	readable := map[int64]bool{1: true, 2: true}
+	for _, tc := range []struct {
+		q    string
+		f    searchFilter
+		from *cursor
+		want []int64
+	}{
+		{q: "deploy", want: []int64{4, 2, 1}},
+		{q: "deploy build", want: []int64{2, 1}},
+		{q: `"new build"`, want: []int64{1}},
+		{q: `"build new"`, want: nil},
+		{q: "deploy", f: searchFilter{senderId: 2}, want: []int64{4, 2}},
+		{q: "build", f: searchFilter{channels: map[int64]bool{2: true}}, want: []int64{3}},
+		{q: "deploy before:2024-01-31", want: nil},
+		{q: "deploy after:2024-01-30", want: []int64{4, 2, 1}},
+		{q: "missing", want: nil},
+		{q: "from:x", f: searchFilter{senderId: 1}, want: []int64{3, 1}},
+		{q: "deploy", from: &cursor{createdAt: base.Add(3 * time.Minute), messageId: 4}, want: []int64{2, 1}},
+	} {
+		sq, err := parseQuery(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.f.readable = readable
+		if got := hitIDs(idx.search(sq, tc.f, tc.from, 10)); !slices.Equal(got, tc.want) {
+			t.Errorf("search %q %+v = %v, want %v", tc.q, tc.f, got, tc.want)
+		}
+	}
+
+	// one extra hit says there is another page
+	sq, _ := parseQuery("deploy")
+	if got := hitIDs(idx.search(sq, searchFilter{readable: readable}, nil, 1)); !slices.Equal(got, []int64{4, 2}) {
+		t.Errorf("a page of one gave %v, want the hit and the next one", got)
+	}
+}
+
+func TestPutReplacesAndRemoves(t *testing.T) {
+	idx := testIndex()
+	idx.put(Message{MessageID: 1, ChannelID: 1, SenderID: 1, Msg: "rolled back", CreatedAt: base})
+	idx.remove(4)
+	idx.put(Message{MessageID: 2, ChannelID: 1, DeletedAt: &base})
+
+	sq, _ := parseQuery("deploy")
+	if got := hitIDs(idx.search(sq, searchFilter{readable: map[int64]bool{1: true, 2: true}}, nil, 10)); len(got) != 0 {
+		t.Errorf("deploy still finds %v after edit and deletes", got)
+	}
+	if _, ok := idx.postings["deploy"]; !ok {
+		// message 5 still has it
+		t.Error("a term was dropped while a message still holds it")
+	}
+	if _, ok := idx.postings["done"]; ok {
+		t.Error("the postings of a removed message stayed behind")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	for _, tc := range []struct {
+		msg, q, want string
+	}{
+		{"deploy done", "deploy", "<mark>deploy</mark> done"},
+		{`<script>deploy("x")</script> & co`, "deploy", `&lt;script&gt;<mark>deploy</mark>(&#34;x&#34;)&lt;/script&gt; &amp; co`},
+		{"New build, new deploy", `"new deploy"`, "<mark>New</mark> build, <mark>new</mark> <mark>deploy</mark>"},
+		{"no match <here>", "from:ann", "no match &lt;here&gt;"},
+		{long + "deploy", "deploy", "…" + long[len(long)-snippetContext:] + "<mark>deploy</mark>"},
+	} {
+		sq, err := parseQuery(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := snippet(tc.msg, sq); got != tc.want {
+			t.Errorf("snippet(%q, %q) =\n%q, want\n%q", tc.msg, tc.q, got, tc.want)
+		}
+	}
+}
+
+// hookedStore runs during while a rebuild is half way through loading.
+type hookedStore struct {
+	*memStore
+	during func()
+}
+
+func (s hookedStore) EachMessage(fn func(Message) error) error {
+	first := true
+	return s.memStore.EachMessage(func(m Message) error {
+		if err := fn(m); err != nil {
+			return err
+		}
+		if first {
+			first = false
+			s.during()
+		}
+		return nil
+	})
+}
+
+func TestRebuildKeepsUpdatesMadeWhileLoading(t *testing.T) {
+	mem := newMemStore()
+	for _, text := range []string{"alpha", "beta"} {
+		if err := mem.InsertMessage(&Message{ChannelID: 1, SenderID: 1, Msg: text, CreatedAt: base}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	searchIdx = newTextIndex()
+	store = hookedStore{memStore: mem, during: func() {
+		// what the handlers do while the store is read
+		searchIdx.put(Message{MessageID: 3, ChannelID: 1, SenderID: 1, Msg: "gamma", CreatedAt: base})
+		searchIdx.put(Message{MessageID: 1, ChannelID: 1, SenderID: 1, Msg: "delta", CreatedAt: base})
+		searchIdx.remove(2)
+	}}
+	if err := searchIdx.rebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	all := searchFilter{readable: map[int64]bool{1: true}}
+	for q, want := range map[string][]int64{"alpha": nil, "beta": nil, "gamma": {3}, "delta": {1}} {
+		sq, _ := parseQuery(q)
+		if got := hitIDs(searchIdx.search(sq, all, nil, 10)); !slices.Equal(got, want) {
+			t.Errorf("after the rebuild %s finds %v, want %v", q, got, want)
+		}
+	}
+	if searchIdx.rebuilding || searchIdx.journal != nil {
+		t.Error("the rebuild left its journal behind")
+	}
+}
+
+// fakeConn is a redis connection that replies with the pub/sub messages
+// queued in it, then with an error.
+type fakeConn struct {
+	replies []interface{}
+}
+
+func (c *fakeConn) Close() error                                   { return nil }
+func (c *fakeConn) Err() error                                     { return nil }
+func (c *fakeConn) Do(string, ...interface{}) (interface{}, error) { return nil, nil }
+func (c *fakeConn) Send(string, ...interface{}) error              { return nil }
+func (c *fakeConn) Flush() error                                   { return nil }
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		return nil, fmt.Errorf("connection closed")
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply, nil
+}
+
+func (c *fakeConn) publish(channel string, v interface{}) {
+	data, _ := json.Marshal(v)
+	c.replies = append(c.replies, []interface{}{[]byte("message"), []byte(channel), data})
+}
+
+func TestIndexUpdatesFromOtherInstances(t *testing.T) {
+	searchIdx = testIndex()
+	p := &redisPresence{instance: "here"}
+	conn := &fakeConn{}
+	conn.publish(indexChannelName, indexUpdate{Instance: "there", Message: Message{MessageID: 9, ChannelID: 1, SenderID: 1, Msg: "shipped elsewhere", CreatedAt: base}})
+	conn.publish(indexChannelName, indexUpdate{Instance: "there", Message: Message{MessageID: 4}, Remove: true})
+	// our own updates come back too, they are already applied
+	conn.publish(indexChannelName, indexUpdate{Instance: "here", Message: Message{MessageID: 1}, Remove: true})
+	if err := p.receive(redis.PubSubConn{Conn: conn}); err == nil {
+		t.Fatal("receive returned without the connection failing")
+	}
+
+	all := searchFilter{readable: map[int64]bool{1: true, 2: true}}
+	for q, want := range map[string][]int64{"shipped": {9}, "done": nil, "build": {3, 2, 1}} {
+		sq, _ := parseQuery(q)
+		if got := hitIDs(searchIdx.search(sq, all, nil, 10)); !slices.Equal(got, want) {
+			t.Errorf("%s finds %v, want %v", q, got, want)
+		}
+	}
+}
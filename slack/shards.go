@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mysqlDSN = "root:localhost@tcp(localhost:3306)/slack?parseTime=true"
+	// shardDSN is used when -shards is a count: that many schemas on the
+	// local server
+	shardDSN = "root:localhost@tcp(localhost:3306)/slack_shard%d?parseTime=true"
+)
+
+// placementTTL is how long a router trusts a cached placement. A rebalance
+// waits longer than that after each change so every server follows it.
+const placementTTL = 5 * time.Second
+
+// placement is where a channel's messages live. While a rebalance moves the
+// channel, writes also go to movingTo.
+type placement struct {
+	shard    int
+	movingTo int // -1 when not moving
+}
+
+type cachedPlacement struct {
+	placement
+	at time.Time
+}
+
+// shardRouter maps a channel_id to the database holding its messages,
+// message edits and reactions. Users, channels and memberships stay in the
+// main database (meta), along with the channel_shard directory and the id
+// sequence. Without shards meta holds everything and neither of those two
+// tables is used.
+type shardRouter struct {
+	meta    *sql.DB
+	shards  []*sql.DB
+	sharded bool
+
+	mu     sync.Mutex
+	cached map[int64]cachedPlacement
+}
+
+func newShardRouter(meta *sql.DB, shards []*sql.DB) *shardRouter {
+	r := &shardRouter{meta: meta, shards: shards, sharded: len(shards) > 0, cached: make(map[int64]cachedPlacement)}
+	if !r.sharded {
+		r.shards = []*sql.DB{meta}
+	}
+	return r
+}
+
+// openShards reads -shards: empty is no shards, which keeps the messages
+// in the main database, a number N spreads them over the schemas
+// slack_shard0..N-1 on the local server, anything else is a comma
+// separated list of DSNs. Every server and the rebalance tool must be
+// given the same list, in the same order.
+func openShards(spec string) ([]*sql.DB, error) {
+	var dsns []string
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 {
+			return nil, fmt.Errorf("-shards %d: need at least one shard", n)
+		}
+		for i := 0; i < n; i++ {
+			dsns = append(dsns, fmt.Sprintf(shardDSN, i))
+		}
+	} else if spec != "" {
+		dsns = strings.Split(spec, ",")
+	}
+	if len(dsns) == 0 {
+		return nil, nil
+	}
+	shards := make([]*sql.DB, 0, len(dsns))
+	for _, dsn := range dsns {
+		db, err := sql.Open("mysql", strings.TrimSpace(dsn))
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, db)
+	}
+	return shards, nil
+}
+
+// lookup reads the placement of channelId from the directory. A channel
+// without a row is on shard 0: it is from before sharding.
+func (r *shardRouter) lookup(channelId int64) (placement, error) {
+	p := placement{movingTo: -1}
+	if !r.sharded {
+		return p, nil
+	}
+	var movingTo sql.NullInt64
+	err := r.meta.QueryRow("select shard, moving_to from channel_shard where channel_id = ?", channelId).Scan(&p.shard, &movingTo)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return placement{}, err
+	}
+	if movingTo.Valid {
+		p.movingTo = int(movingTo.Int64)
+	}
+	if p.shard >= len(r.shards) || p.movingTo >= len(r.shards) {
+		return placement{}, fmt.Errorf("channel %d is placed on shard %d (moving to %d) but only %d are configured", channelId, p.shard, p.movingTo, len(r.shards))
+	}
+	return p, nil
+}
+
+// place is lookup behind the cache.
+func (r *shardRouter) place(channelId int64) (placement, error) {
+	r.mu.Lock()
+	c, ok := r.cached[channelId]
+	r.mu.Unlock()
+	if ok && time.Since(c.at) < placementTTL {
+		return c.placement, nil
+	}
+	p, err := r.lookup(channelId)
+	if err != nil {
+		return placement{}, err
+	}
+	r.mu.Lock()
+	r.cached[channelId] = cachedPlacement{placement: p, at: time.Now()}
+	r.mu.Unlock()
+	return p, nil
+}
+
+// reader returns the database to read channelId's messages from.
+func (r *shardRouter) reader(channelId int64) (*sql.DB, error) {
+	p, err := r.place(channelId)
+	if err != nil {
+		return nil, err
+	}
+	return r.shards[p.shard], nil
+}
+
+// writers returns the databases a write to channelId goes to: its shard
+// first, then during a rebalance the other side of the move.
+func (r *shardRouter) writers(channelId int64) ([]*sql.DB, error) {
+	p, err := r.place(channelId)
+	if err != nil {
+		return nil, err
+	}
+	dbs := []*sql.DB{r.shards[p.shard]}
+	if p.movingTo >= 0 {
+		dbs = append(dbs, r.shards[p.movingTo])
+	}
+	return dbs, nil
+}
+
+// assign places a new channel. The hash only picks the first home; from
+// then on the directory row decides, so adding shards moves nothing until
+// the rebalance tool does.
+func (r *shardRouter) assign(channelId int64) error {
+	if !r.sharded {
+		return nil
+	}
+	_, err := r.meta.Exec("insert ignore into channel_shard (channel_id,shard) values (?,?)", channelId, int(channelId%int64(len(r.shards))))
+	return err
+}
+
+// nextID hands out message and edit ids. They come from the main database
+// and not from each shard so that a row keeps its id when it moves.
+// Without shards nothing moves: it returns 0 and the table's
+// auto_increment picks the id.
+func (r *shardRouter) nextID() (int64, error) {
+	if !r.sharded {
+		return 0, nil
+	}
+	result, err := r.meta.Exec("replace into id_seq (stub) values ('a')")
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// seqID is id as an insert value: null when nextID left it to
+// auto_increment.
+func seqID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
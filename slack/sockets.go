@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// userRoom is the socket.io room every connection of a user joins. Rooms
+// are what the redis adapter fans out across instances, so emitting to a
+// user's room reaches all their tabs and devices on every slack server.
+func userRoom(userId int64) string {
+	return "user:" + strconv.FormatInt(userId, 10)
+}
+
+// channelRoom is joined by every connection of the channel's members, for
+// the events that go to whoever of them is online (typing, presence).
+func channelRoom(channelId int64) string {
+	return "channel:" + strconv.FormatInt(channelId, 10)
+}
+
+type socketConn struct {
+	conn        socketio.Conn
+	userId      int64 // from the session token it connected with
+	connectedAt time.Time
+}
+
+// connRegistry keeps the socket.io connections of this instance, any
+// number per user, and the channels of the users connected here. Socket
+// handlers run concurrently, hence the lock.
+type connRegistry struct {
+	mu       sync.RWMutex
+	conns    map[string]*socketConn // by connection ID
+	byUser   map[int64]map[string]socketio.Conn
+	channels map[int64]map[int64]bool // by user, whose channel rooms they are in
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:    make(map[string]*socketConn),
+		byUser:   make(map[int64]map[string]socketio.Conn),
+		channels: make(map[int64]map[int64]bool),
+	}
+}
+
+// connect registers c as a connection of userId, the user its session
+// token names, and puts it in the rooms of the user and their channels.
+func (reg *connRegistry) connect(c socketio.Conn, userId int64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.conns[c.ID()] = &socketConn{conn: c, userId: userId, connectedAt: time.Now()}
+	if reg.byUser[userId] == nil {
+		reg.byUser[userId] = make(map[string]socketio.Conn)
+	}
+	reg.byUser[userId][c.ID()] = c
+	c.Join(userRoom(userId))
+	for channelId := range reg.channels[userId] {
+		c.Join(channelRoom(channelId))
+	}
+}
+
+// disconnect forgets c and returns what was known about it.
+func (reg *connRegistry) disconnect(c socketio.Conn) (socketConn, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	sc, ok := reg.conns[c.ID()]
+	if !ok {
+		return socketConn{}, false
+	}
+	delete(reg.conns, c.ID())
+	reg.unbind(sc)
+	return *sc, true
+}
+
+func (reg *connRegistry) unbind(sc *socketConn) {
+	conns := reg.byUser[sc.userId]
+	delete(conns, sc.conn.ID())
+	if len(conns) == 0 {
+		delete(reg.byUser, sc.userId)
+	}
+}
+
+// follow puts every connection of userId here in the rooms of channelIds.
+// Users without a connection here are skipped, they follow on connect.
+func (reg *connRegistry) follow(userId int64, channelIds ...int64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(reg.byUser[userId]) == 0 {
+		return
+	}
+	if reg.channels[userId] == nil {
+		reg.channels[userId] = make(map[int64]bool)
+	}
+	for _, channelId := range channelIds {
+		reg.channels[userId][channelId] = true
+		for _, c := range reg.byUser[userId] {
+			c.Join(channelRoom(channelId))
+		}
+	}
+}
+
+// unfollow takes the connections of userId here out of channelId's room.
+func (reg *connRegistry) unfollow(userId, channelId int64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.channels[userId], channelId)
+	for _, c := range reg.byUser[userId] {
+		c.Leave(channelRoom(channelId))
+	}
+}
+
+// follows reports whether userId is in channelId, as far as this instance
+// knows from connect and the membership changes since.
+func (reg *connRegistry) follows(userId, channelId int64) bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.channels[userId][channelId]
+}
+
+// followed returns the channels of userId known here.
+func (reg *connRegistry) followed(userId int64) []int64 {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	out := make([]int64, 0, len(reg.channels[userId]))
+	for channelId := range reg.channels[userId] {
+		out = append(out, channelId)
+	}
+	return out
+}
+
+// forget drops the channels of userId once their last connection here is
+// gone.
+func (reg *connRegistry) forget(userId int64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(reg.byUser[userId]) == 0 {
+		delete(reg.channels, userId)
+	}
+}
+
+// connected reports whether connId is open here.
+func (reg *connRegistry) connected(connId string) bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	_, ok := reg.conns[connId]
+	return ok
+}
+
+// userConns returns the connections of userId on this instance.
+func (reg *connRegistry) userConns(userId int64) []socketio.Conn {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	out := make([]socketio.Conn, 0, len(reg.byUser[userId]))
+	for _, c := range reg.byUser[userId] {
+		out = append(out, c)
+	}
+	return out
+}
+
+var (
+	sockets      = newConnRegistry()
+	socketServer *socketio.Server
+)
+
+// emitToUser sends event to every connection of userId, wherever it is
+// connected: locally through the room, and with the redis adapter also
+// published to the other instances.
+func emitToUser(userId int64, event string, args ...interface{}) {
+	socketServer.BroadcastToRoom("/", userRoom(userId), event, args...)
+}
+
+// emitToChannelRoom sends event to the online members of channelId, on
+// every instance, without looking up who they are.
+func emitToChannelRoom(channelId int64, event string, args ...interface{}) {
+	socketServer.BroadcastToRoom("/", channelRoom(channelId), event, args...)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNotFound is what a Store returns when the row asked for is missing.
+var errNotFound = errors.New("not found")
+
+// errNameTaken is what CreateUser returns for a user name already in use.
+var errNameTaken = errors.New("user name taken")
+
+// Store is everything the handlers persist: users, channels, memberships
+// and messages. mysqlStore is the real one, memStore keeps it all in
+// process for running without MySQL.
+type Store interface {
+	// users
+	User(userId int64) (User, error)
+	UserByName(userName string) (User, error)
+	Users() ([]User, error)
+	CreateUser(userName, passwordHash string, at time.Time) (User, error)
+	// SetPassword replaces the password of userId, see slack passwd.
+	SetPassword(userId int64, passwordHash string) error
+	Touch(userId int64, at time.Time) error
+
+	// channels
+	Channel(channelId int64) (Channel, error)
+	ChannelsNamed(name string) ([]Channel, error)
+	CreateChannel(channelType, name string) (Channel, error)
+	// DM returns the DM channel between two users.
+	DM(userId, otherId int64) (Channel, error)
+	// Readable lists the channels userId may read: theirs, and the public
+	// and broadcast ones.
+	Readable(userId int64) (map[int64]bool, error)
+	// UserChannels lists the channels of userId with their unread counts.
+	UserChannels(userId int64) ([]UserChannel, error)
+
+	// memberships
+	Membership(channelId, userId int64) (Membership, error)
+	Members(channelId int64) ([]Membership, error)
+	// MemberOf lists the ids of the channels of userId.
+	MemberOf(userId int64) ([]int64, error)
+	// AddMember inserts a membership; deliveredFrom, when set, starts the
+	// delivery cursor there.
+	AddMember(channelId, userId int64, role string, deliveredFrom *time.Time) error
+	RemoveMembership(membershipId int64) error
+	SetRole(membershipId int64, role string) error
+	SetLastRead(membershipId int64, at time.Time) error
+	// AdvanceDelivered moves the delivery cursor of the member to c unless
+	// it is already there or further, reporting whether it moved.
+	AdvanceDelivered(channelId, userId int64, c cursor) (bool, error)
+	// DeliveryCursors returns the channels of userId with where delivery
+	// stands in each, falling back to the read marker; nil is nowhere.
+	DeliveryCursors(userId int64) ([]DeliveryCursor, error)
+	// Recipients returns the delivery and read markers of every member of
+	// channelId but exceptUserId.
+	Recipients(channelId, exceptUserId int64) ([]Recipient, error)
+
+	// messages, each call names the channel so a sharded store knows
+	// where to go
+	Message(channelId, messageId int64) (Message, error)
+	// InsertMessage stores m and sets its MessageID.
+	InsertMessage(m *Message) error
+	// Messages returns up to limit top level messages of channelId, or the
+	// replies to parentId, past the cursor: newer than after in ascending
+	// order, otherwise older than before (or the latest) in descending
+	// order.
+	Messages(channelId, parentId int64, before, after *cursor, limit int) ([]Message, error)
+	// Undelivered returns, oldest first, up to limit messages of channelId
+	// after from that others sent to userId, leaving out deleted ones.
+	Undelivered(channelId, userId int64, from *cursor, limit int) ([]Message, error)
+	// EachMessage calls fn for every message that is not deleted.
+	EachMessage(fn func(Message) error) error
+	AddReply(channelId, parentId int64, at time.Time) error
+	// EditMessage replaces the text, keeping the old one in the history.
+	EditMessage(channelId, messageId int64, msg string, at time.Time) error
+	DeleteMessage(channelId, messageId int64, at time.Time) error
+	Edits(channelId, messageId int64) ([]MessageEdit, error)
+	// ToggleReaction adds the reaction of userId, or removes it if there.
+	ToggleReaction(channelId, messageId, userId int64, emoji string, at time.Time) error
+	// Reactions aggregates the reactions of messageIds, each message's
+	// emojis in the order they were first used.
+	Reactions(channelId int64, messageIds []int64) (map[int64][]Reaction, error)
+}
+
+// DeliveryCursor is where delivery stands for a user in one channel.
+type DeliveryCursor struct {
+	Channel Channel
+	From    *cursor
+}
+
+// Recipient is a member's delivery cursor and read marker.
+type Recipient struct {
+	UserID     int64
+	UserName   string
+	Delivered  *cursor
+	LastReadAt *time.Time
+}
+
+var store Store
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memStore keeps everything in process behind one lock, with the same
+// semantics as mysqlStore. It is for running the server, and its handlers
+// in tests, without MySQL; nothing survives a restart.
+type memStore struct {
+	mu          sync.Mutex
+	users       []User
+	channels    []Channel
+	memberships []*memMembership
+	// membership ids are not reused after a leave
+	membershipSeq int64
+	messages      []*Message // by message id - 1, deleted ones stay
+	edits         []MessageEdit
+	reactions     []memReaction
+}
+
+type memMembership struct {
+	Membership
+	delivered *cursor
+}
+
+type memReaction struct {
+	messageId, userId int64
+	emoji             string
+}
+
+// errDuplicate stands in for the unique key on membership.
+var errDuplicate = errors.New("duplicate membership")
+
+func newMemStore() *memStore {
+	return &memStore{}
+}
+
+func (s *memStore) User(userId int64) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if userId < 1 || int(userId) > len(s.users) {
+		return User{}, errNotFound
+	}
+	return s.users[userId-1], nil
+}
+
+func (s *memStore) UserByName(userName string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.UserName == userName {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memStore) Users() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.users), nil
+}
+
+func (s *memStore) CreateUser(userName, passwordHash string, at time.Time) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.UserName == userName {
+			return User{}, errNameTaken
+		}
+	}
+	u := User{Id: int64(len(s.users) + 1), UserName: userName, LastTimestamp: at, PasswordHash: passwordHash}
+	s.users = append(s.users, u)
+	return u, nil
+}
+
+func (s *memStore) SetPassword(userId int64, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if userId < 1 || int(userId) > len(s.users) {
+		return errNotFound
+	}
+	s.users[userId-1].PasswordHash = passwordHash
+	return nil
+}
+
+func (s *memStore) Touch(userId int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if userId >= 1 && int(userId) <= len(s.users) {
+		s.users[userId-1].LastTimestamp = at
+	}
+	return nil
+}
+
+func (s *memStore) Channel(channelId int64) (Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if channelId < 1 || int(channelId) > len(s.channels) {
+		return Channel{}, errNotFound
+	}
+	return s.channels[channelId-1], nil
+}
+
+func (s *memStore) ChannelsNamed(name string) ([]Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Channel, 0)
+	for _, ch := range s.channels {
+		if ch.ChannelName == name {
+			out = append(out, ch)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) CreateChannel(channelType, name string) (Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := Channel{ChannelID: int64(len(s.channels) + 1), ChannelType: channelType, ChannelName: name}
+	s.channels = append(s.channels, ch)
+	return ch, nil
+}
+
+func (s *memStore) membership(channelId, userId int64) *memMembership {
+	for _, m := range s.memberships {
+		if m.ChannelID == channelId && m.UserID == userId {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *memStore) DM(userId, otherId int64) (Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.memberships {
+		ch := s.channels[m.ChannelID-1]
+		if m.UserID == userId && ch.ChannelType == ChannelDM && s.membership(ch.ChannelID, otherId) != nil {
+			return ch, nil
+		}
+	}
+	return Channel{}, errNotFound
+}
+
+func (s *memStore) Readable(userId int64) (map[int64]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readable := make(map[int64]bool)
+	for _, ch := range s.channels {
+		if ch.ChannelType == ChannelPublic || ch.ChannelType == ChannelBroadcast {
+			readable[ch.ChannelID] = true
+		}
+	}
+	for _, m := range s.memberships {
+		if m.UserID == userId {
+			readable[m.ChannelID] = true
+		}
+	}
+	return readable, nil
+}
+
+func (s *memStore) UserChannels(userId int64) ([]UserChannel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	output := make([]UserChannel, 0)
+	for _, m := range s.memberships {
+		if m.UserID != userId {
+			continue
+		}
+		uc := UserChannel{Channel: s.channels[m.ChannelID-1], Role: m.Role, LastReadAt: m.LastReadAt}
+		for _, msg := range s.messages {
+			if msg.ChannelID != m.ChannelID || msg.SenderID == userId || msg.DeletedAt != nil || msg.ParentID != nil {
+				continue
+			}
+			if m.LastReadAt == nil || msg.CreatedAt.After(*m.LastReadAt) {
+				uc.Unread++
+			}
+		}
+		output = append(output, uc)
+	}
+	slices.SortFunc(output, func(a, b UserChannel) int { return cmp.Compare(a.ChannelID, b.ChannelID) })
+	return output, nil
+}
+
+func (s *memStore) Membership(channelId, userId int64) (Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.membership(channelId, userId); m != nil {
+		return m.Membership, nil
+	}
+	return Membership{}, errNotFound
+}
+
+func (s *memStore) Members(channelId int64) ([]Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]Membership, 0)
+	for _, m := range s.memberships {
+		if m.ChannelID == channelId {
+			members = append(members, m.Membership)
+		}
+	}
+	return members, nil
+}
+
+func (s *memStore) MemberOf(userId int64) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channelIds := make([]int64, 0)
+	for _, m := range s.memberships {
+		if m.UserID == userId {
+			channelIds = append(channelIds, m.ChannelID)
+		}
+	}
+	return channelIds, nil
+}
+
+func (s *memStore) AddMember(channelId, userId int64, role string, deliveredFrom *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.membership(channelId, userId) != nil {
+		return errDuplicate
+	}
+	s.membershipSeq++
+	m := &memMembership{Membership: Membership{MembershipID: s.membershipSeq, ChannelID: channelId, UserID: userId, Role: role}}
+	if deliveredFrom != nil {
+		m.delivered = &cursor{createdAt: *deliveredFrom}
+	}
+	s.memberships = append(s.memberships, m)
+	return nil
+}
+
+func (s *memStore) byMembershipId(membershipId int64) *memMembership {
+	for _, m := range s.memberships {
+		if m.MembershipID == membershipId {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *memStore) RemoveMembership(membershipId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memberships = slices.DeleteFunc(s.memberships, func(m *memMembership) bool { return m.MembershipID == membershipId })
+	return nil
+}
+
+func (s *memStore) SetRole(membershipId int64, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.byMembershipId(membershipId); m != nil {
+		m.Role = role
+	}
+	return nil
+}
+
+func (s *memStore) SetLastRead(membershipId int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.byMembershipId(membershipId); m != nil {
+		m.LastReadAt = &at
+	}
+	return nil
+}
+
+func (s *memStore) AdvanceDelivered(channelId, userId int64, c cursor) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.membership(channelId, userId)
+	if m == nil || (m.delivered != nil && !m.delivered.before(c.createdAt, c.messageId)) {
+		return false, nil
+	}
+	m.delivered = &c
+	return true, nil
+}
+
+func (s *memStore) DeliveryCursors(userId int64) ([]DeliveryCursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cursors []DeliveryCursor
+	for _, m := range s.memberships {
+		if m.UserID != userId {
+			continue
+		}
+		dc := DeliveryCursor{Channel: s.channels[m.ChannelID-1], From: m.delivered}
+		if dc.From == nil && m.LastReadAt != nil {
+			dc.From = &cursor{createdAt: *m.LastReadAt}
+		}
+		cursors = append(cursors, dc)
+	}
+	return cursors, nil
+}
+
+func (s *memStore) Recipients(channelId, exceptUserId int64) ([]Recipient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recipients := make([]Recipient, 0)
+	for _, m := range s.memberships {
+		if m.ChannelID != channelId || m.UserID == exceptUserId {
+			continue
+		}
+		recipients = append(recipients, Recipient{UserID: m.UserID, UserName: s.users[m.UserID-1].UserName, Delivered: m.delivered, LastReadAt: m.LastReadAt})
+	}
+	return recipients, nil
+}
+
+// message returns a copy with the text of a deleted message blanked, like
+// scanMessage does.
+func (s *memStore) message(m *Message) Message {
+	out := *m
+	out.Reactions = nil
+	if out.DeletedAt != nil {
+		out.Msg = ""
+	}
+	return out
+}
+
+func (s *memStore) Message(channelId, messageId int64) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if messageId < 1 || int(messageId) > len(s.messages) || s.messages[messageId-1].ChannelID != channelId {
+		return Message{}, errNotFound
+	}
+	return s.message(s.messages[messageId-1]), nil
+}
+
+func (s *memStore) InsertMessage(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.MessageID = int64(len(s.messages) + 1)
+	stored := *m
+	s.messages = append(s.messages, &stored)
+	return nil
+}
+
+// ordered returns the messages matching keep, oldest first.
+func (s *memStore) ordered(keep func(*Message) bool) []*Message {
+	var out []*Message
+	for _, m := range s.messages {
+		if keep(m) {
+			out = append(out, m)
+		}
+	}
+	slices.SortFunc(out, func(a, b *Message) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.MessageID, b.MessageID)
+	})
+	return out
+}
+
+func (s *memStore) Messages(channelId, parentId int64, before, after *cursor, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.ordered(func(m *Message) bool {
+		if m.ChannelID != channelId || (parentId == 0) != (m.ParentID == nil) || (m.ParentID != nil && *m.ParentID != parentId) {
+			return false
+		}
+		switch {
+		case after != nil:
+			return !after.covers(*m)
+		case before != nil:
+			return before.before(m.CreatedAt, m.MessageID)
+		}
+		return true
+	})
+	if after == nil {
+		slices.Reverse(found)
+	}
+	out := make([]Message, 0, min(limit, len(found)))
+	for _, m := range found[:min(limit, len(found))] {
+		out = append(out, s.message(m))
+	}
+	return out, nil
+}
+
+func (s *memStore) Undelivered(channelId, userId int64, from *cursor, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.ordered(func(m *Message) bool {
+		return m.ChannelID == channelId && m.SenderID != userId && m.DeletedAt == nil &&
+			(from == nil || !from.covers(*m))
+	})
+	out := make([]Message, 0, min(limit, len(found)))
+	for _, m := range found[:min(limit, len(found))] {
+		out = append(out, s.message(m))
+	}
+	return out, nil
+}
+
+func (s *memStore) EachMessage(fn func(Message) error) error {
+	s.mu.Lock()
+	var messages []Message
+	for _, m := range s.messages {
+		if m.DeletedAt == nil {
+			messages = append(messages, s.message(m))
+		}
+	}
+	s.mu.Unlock()
+	for _, m := range messages {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) stored(messageId int64) *Message {
+	if messageId < 1 || int(messageId) > len(s.messages) {
+		return nil
+	}
+	return s.messages[messageId-1]
+}
+
+func (s *memStore) AddReply(channelId, parentId int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.stored(parentId); m != nil {
+		m.ReplyCount++
+		m.LastReplyAt = &at
+	}
+	return nil
+}
+
+func (s *memStore) EditMessage(channelId, messageId int64, msg string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.stored(messageId)
+	if m == nil {
+		return errNotFound
+	}
+	s.edits = append(s.edits, MessageEdit{EditID: int64(len(s.edits) + 1), MessageID: messageId, OldMsg: m.Msg, EditedAt: at})
+	m.Msg, m.EditedAt = msg, &at
+	return nil
+}
+
+func (s *memStore) DeleteMessage(channelId, messageId int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.stored(messageId); m != nil {
+		m.DeletedAt = &at
+	}
+	return nil
+}
+
+func (s *memStore) Edits(channelId, messageId int64) ([]MessageEdit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	edits := make([]MessageEdit, 0)
+	for _, e := range s.edits {
+		if e.MessageID == messageId {
+			edits = append(edits, e)
+		}
+	}
+	return edits, nil
+}
+
+func (s *memStore) ToggleReaction(channelId, messageId, userId int64, emoji string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := memReaction{messageId: messageId, userId: userId, emoji: emoji}
+	if i := slices.Index(s.reactions, r); i >= 0 {
+		s.reactions = slices.Delete(s.reactions, i, i+1)
+	} else {
+		// kept in the order they were made, like order by created_at
+		s.reactions = append(s.reactions, r)
+	}
+	return nil
+}
+
+func (s *memStore) Reactions(channelId int64, messageIds []int64) (map[int64][]Reaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int64][]Reaction)
+	for _, r := range s.reactions {
+		if slices.Contains(messageIds, r.messageId) {
+			out[r.messageId] = addReaction(out[r.messageId], r.emoji, r.userId)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlStore keeps users, channels and memberships in db and the messages
+// of each channel on the shard the router picks.
+type mysqlStore struct {
+	db     *sql.DB
+	shards *shardRouter
+}
+
+func newMySQLStore(db *sql.DB, shards *shardRouter) *mysqlStore {
+	return &mysqlStore{db: db, shards: shards}
+}
+
+// notFound turns sql.ErrNoRows into errNotFound.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *mysqlStore) User(userId int64) (User, error) {
+	return s.scanUser(s.db.QueryRow("select id, userName, last_timestamp, password_hash from user where id = ?", userId))
+}
+
+func (s *mysqlStore) UserByName(userName string) (User, error) {
+	return s.scanUser(s.db.QueryRow("select id, userName, last_timestamp, password_hash from user where userName = ?", userName))
+}
+
+func (s *mysqlStore) scanUser(row scanner) (User, error) {
+	var u User
+	var hash sql.NullString
+	err := row.Scan(&u.Id, &u.UserName, &u.LastTimestamp, &hash)
+	u.PasswordHash = hash.String
+	return u, notFound(err)
+}
+
+func (s *mysqlStore) Users() ([]User, error) {
+	rows, err := s.db.Query("select id, userName, last_timestamp, password_hash from user")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		u, err := s.scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *mysqlStore) CreateUser(userName, passwordHash string, at time.Time) (User, error) {
+	res, err := s.db.Exec("insert into user (userName,password_hash,last_timestamp) values (?,?,?)", userName, passwordHash, at)
+	var dup *mysql.MySQLError
+	if errors.As(err, &dup) && dup.Number == 1062 {
+		return User{}, errNameTaken
+	}
+	if err != nil {
+		return User{}, err
+	}
+	u := User{UserName: userName, LastTimestamp: at, PasswordHash: passwordHash}
+	u.Id, err = res.LastInsertId()
+	return u, err
+}
+
+func (s *mysqlStore) SetPassword(userId int64, passwordHash string) error {
+	res, err := s.db.Exec("update user set password_hash = ? where id = ?", passwordHash, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *mysqlStore) Touch(userId int64, at time.Time) error {
+	_, err := s.db.Exec("update user set last_timestamp = ? where id = ?", at, userId)
+	return err
+}
+
+func (s *mysqlStore) Channel(channelId int64) (Channel, error) {
+	var ch Channel
+	err := s.db.QueryRow("select channel_id, channel_type, channel_name from channel where channel_id = ?", channelId).
+		Scan(&ch.ChannelID, &ch.ChannelType, &ch.ChannelName)
+	return ch, notFound(err)
+}
+
+func (s *mysqlStore) ChannelsNamed(name string) ([]Channel, error) {
+	return s.channels("select channel_id, channel_type, channel_name from channel where channel_name = ?", name)
+}
+
+func (s *mysqlStore) channels(query string, args ...interface{}) ([]Channel, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	channels := make([]Channel, 0)
+	for rows.Next() {
+		var ch Channel
+		if err := rows.Scan(&ch.ChannelID, &ch.ChannelType, &ch.ChannelName); err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+func (s *mysqlStore) CreateChannel(channelType, name string) (Channel, error) {
+	result, err := s.db.Exec("insert into channel (channel_type,channel_name) values (?,?)", channelType, name)
+	if err != nil {
+		return Channel{}, err
+	}
+	ch := Channel{ChannelType: channelType, ChannelName: name}
+	if ch.ChannelID, err = result.LastInsertId(); err != nil {
+		return Channel{}, err
+	}
+	return ch, s.shards.assign(ch.ChannelID)
+}
+
+func (s *mysqlStore) DM(userId, otherId int64) (Channel, error) {
+	channels, err := s.channels(`SELECT c.channel_id, c.channel_type, c.channel_name
+	FROM channel c
+	JOIN membership m1 ON c.channel_id = m1.channel_id
+	JOIN membership m2 ON c.channel_id = m2.channel_id
+	WHERE c.channel_type = ?
+	  AND m1.user_id = ?
+	  AND m2.user_id = ?`, ChannelDM, userId, otherId)
+	if err != nil {
+		return Channel{}, err
+	}
+	if len(channels) == 0 {
+		return Channel{}, errNotFound
+	}
+	return channels[0], nil
+}
+
+func (s *mysqlStore) Readable(userId int64) (map[int64]bool, error) {
+	rows, err := s.db.Query(`select channel_id from channel where channel_type in (?, ?)
+		union select channel_id from membership where user_id = ?`, ChannelPublic, ChannelBroadcast, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	readable := make(map[int64]bool)
+	for rows.Next() {
+		var channelId int64
+		if err := rows.Scan(&channelId); err != nil {
+			return nil, err
+		}
+		readable[channelId] = true
+	}
+	return readable, rows.Err()
+}
+
+func (s *mysqlStore) UserChannels(userId int64) ([]UserChannel, error) {
+	rows, err := s.db.Query(`SELECT c.channel_id, c.channel_type, c.channel_name, m.role, m.last_read_at
+	FROM channel c
+	JOIN membership m ON c.channel_id = m.channel_id
+	WHERE m.user_id = ?
+	ORDER BY c.channel_id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]UserChannel, 0)
+	for rows.Next() {
+		var uc UserChannel
+		if err := rows.Scan(&uc.ChannelID, &uc.ChannelType, &uc.ChannelName, &uc.Role, &uc.LastReadAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		output = append(output, uc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// the messages are on the shards, so unread is counted per channel
+	for i := range output {
+		if output[i].Unread, err = s.unread(output[i].ChannelID, userId, output[i].LastReadAt); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+// unread counts what others posted in channelId after the read marker.
+// Deleted messages and thread replies are not counted, the channel does
+// not show them.
+func (s *mysqlStore) unread(channelId, userId int64, lastReadAt *time.Time) (int, error) {
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = db.QueryRow(`select count(*) from message
+		where channel_id = ? and sender_id <> ? and deleted_at is null and parent_id is null
+		and (? is null or created_at > ?)`, channelId, userId, lastReadAt, lastReadAt).Scan(&n)
+	return n, err
+}
+
+const membershipColumns = "membership_id, channel_id, user_id, role, last_read_at"
+
+func scanMembership(row scanner) (Membership, error) {
+	var m Membership
+	err := row.Scan(&m.MembershipID, &m.ChannelID, &m.UserID, &m.Role, &m.LastReadAt)
+	return m, notFound(err)
+}
+
+func (s *mysqlStore) Membership(channelId, userId int64) (Membership, error) {
+	return scanMembership(s.db.QueryRow("select "+membershipColumns+" from membership where channel_id = ? and user_id = ?", channelId, userId))
+}
+
+func (s *mysqlStore) Members(channelId int64) ([]Membership, error) {
+	rows, err := s.db.Query("select "+membershipColumns+" from membership where channel_id = ? order by membership_id", channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]Membership, 0)
+	for rows.Next() {
+		m, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *mysqlStore) MemberOf(userId int64) ([]int64, error) {
+	rows, err := s.db.Query("select channel_id from membership where user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	channelIds := make([]int64, 0)
+	for rows.Next() {
+		var channelId int64
+		if err := rows.Scan(&channelId); err != nil {
+			return nil, err
+		}
+		channelIds = append(channelIds, channelId)
+	}
+	return channelIds, rows.Err()
+}
+
+func (s *mysqlStore) AddMember(channelId, userId int64, role string, deliveredFrom *time.Time) error {
+	_, err := s.db.Exec("insert into membership (channel_id,user_id,role,delivered_upto) values (?,?,?,?)", channelId, userId, role, deliveredFrom)
+	return err
+}
+
+func (s *mysqlStore) RemoveMembership(membershipId int64) error {
+	_, err := s.db.Exec("delete from membership where membership_id = ?", membershipId)
+	return err
+}
+
+func (s *mysqlStore) SetRole(membershipId int64, role string) error {
+	_, err := s.db.Exec("update membership set role = ? where membership_id = ?", role, membershipId)
+	return err
+}
+
+// SetLastRead keeps the marker to the microsecond, like created_at, so a
+// message from the same second is on the right side of it.
+func (s *mysqlStore) SetLastRead(membershipId int64, at time.Time) error {
+	at = at.Truncate(time.Microsecond)
+	_, err := s.db.Exec("update membership set last_read_at = ? where membership_id = ?", at, membershipId)
+	return err
+}
+
+// AdvanceDelivered keeps the forward-only condition in the update, so
+// concurrent acks from several devices cannot move the cursor back.
+func (s *mysqlStore) AdvanceDelivered(channelId, userId int64, c cursor) (bool, error) {
+	result, err := s.db.Exec(`update membership set delivered_upto = ?, delivered_message_id = ?
+		where channel_id = ? and user_id = ?
+		  and (delivered_upto is null or delivered_upto < ? or (delivered_upto = ? and coalesce(delivered_message_id, 0) < ?))`,
+		c.createdAt, c.messageId, channelId, userId, c.createdAt, c.createdAt, c.messageId)
+	if err != nil {
+		return false, err
+	}
+	moved, err := result.RowsAffected()
+	return moved > 0, err
+}
+
+func (s *mysqlStore) DeliveryCursors(userId int64) ([]DeliveryCursor, error) {
+	rows, err := s.db.Query(`select c.channel_id, c.channel_type, c.channel_name,
+		       coalesce(m.delivered_upto, m.last_read_at), coalesce(m.delivered_message_id, 0)
+		  from membership m join channel c on c.channel_id = m.channel_id
+		 where m.user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cursors []DeliveryCursor
+	for rows.Next() {
+		var dc DeliveryCursor
+		var upto *time.Time
+		var messageId int64
+		if err := rows.Scan(&dc.Channel.ChannelID, &dc.Channel.ChannelType, &dc.Channel.ChannelName, &upto, &messageId); err != nil {
+			return nil, err
+		}
+		if upto != nil {
+			dc.From = &cursor{createdAt: *upto, messageId: messageId}
+		}
+		cursors = append(cursors, dc)
+	}
+	return cursors, rows.Err()
+}
+
+func (s *mysqlStore) Recipients(channelId, exceptUserId int64) ([]Recipient, error) {
+	rows, err := s.db.Query(`select m.user_id, u.userName, m.delivered_upto, coalesce(m.delivered_message_id, 0), m.last_read_at
+		  from membership m join user u on u.id = m.user_id
+		 where m.channel_id = ? and m.user_id != ? order by m.membership_id`, channelId, exceptUserId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := make([]Recipient, 0)
+	for rows.Next() {
+		var rc Recipient
+		var deliveredUpto *time.Time
+		var deliveredId int64
+		if err := rows.Scan(&rc.UserID, &rc.UserName, &deliveredUpto, &deliveredId, &rc.LastReadAt); err != nil {
+			return nil, err
+		}
+		if deliveredUpto != nil {
+			rc.Delivered = &cursor{createdAt: *deliveredUpto, messageId: deliveredId}
+		}
+		recipients = append(recipients, rc)
+	}
+	return recipients, rows.Err()
+}
+
+const messageColumns = "message_id, sender_id, channel_id, msg, created_at, parent_id, reply_count, last_reply_at, edited_at, deleted_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanStoredMessage reads a row selected with messageColumns as it is
+// stored, deleted text included. Only the rebalance wants that.
+func scanStoredMessage(row scanner) (Message, error) {
+	var m Message
+	err := row.Scan(&m.MessageID, &m.SenderID, &m.ChannelID, &m.Msg, &m.CreatedAt, &m.ParentID, &m.ReplyCount, &m.LastReplyAt, &m.EditedAt, &m.DeletedAt)
+	return m, notFound(err)
+}
+
+// scanMessage reads a row selected with messageColumns. The text of a
+// deleted message never leaves the database.
+func scanMessage(row scanner) (Message, error) {
+	m, err := scanStoredMessage(row)
+	if m.DeletedAt != nil {
+		m.Msg = ""
+	}
+	return m, err
+}
+
+func queryMessages(db *sql.DB, query string, args ...interface{}) ([]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]Message, 0)
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// exec runs a write on the shard of channelId and, while a rebalance moves
+// the channel, on the shard it moves to as well, returning the first
+// result. A write the other shard did not take fails the call: once the
+// rebalance made its last pass nothing copies it any more, and it would
+// be lost when reads switch over.
+func (s *mysqlStore) exec(channelId int64, query string, args ...interface{}) (sql.Result, error) {
+	dbs, err := s.shards.writers(channelId)
+	if err != nil {
+		return nil, err
+	}
+	result, err := dbs[0].Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs[1:] {
+		if _, err := db.Exec(query, args...); err != nil {
+			return nil, fmt.Errorf("dual write for channel %d: %w", channelId, err)
+		}
+	}
+	return result, nil
+}
+
+func (s *mysqlStore) Message(channelId, messageId int64) (Message, error) {
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return Message{}, err
+	}
+	return scanMessage(db.QueryRow("select "+messageColumns+" from message where message_id = ? and channel_id = ?", messageId, channelId))
+}
+
+func (s *mysqlStore) InsertMessage(m *Message) error {
+	id, err := s.shards.nextID()
+	if err != nil {
+		return err
+	}
+	// created_at is timestamp(6): the cursor handed out for m must be the
+	// one the row is read back with, not a few nanoseconds past it
+	m.CreatedAt = m.CreatedAt.Truncate(time.Microsecond)
+	result, err := s.exec(m.ChannelID, "insert into message (message_id,sender_id,channel_id,msg,created_at,parent_id) values (?,?,?,?,?,?)", seqID(id), m.SenderID, m.ChannelID, m.Msg, m.CreatedAt, m.ParentID)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		id, err = result.LastInsertId()
+	}
+	m.MessageID = id
+	return err
+}
+
+func (s *mysqlStore) Messages(channelId, parentId int64, before, after *cursor, limit int) ([]Message, error) {
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return nil, err
+	}
+	query := "select " + messageColumns + " from message where channel_id = ?"
+	args := []interface{}{channelId}
+	if parentId == 0 {
+		query += " and parent_id is null"
+	} else {
+		query += " and parent_id = ?"
+		args = append(args, parentId)
+	}
+	switch {
+	case after != nil:
+		query += " and (created_at > ? or (created_at = ? and message_id > ?)) order by created_at, message_id"
+		args = append(args, after.createdAt, after.createdAt, after.messageId)
+	case before != nil:
+		query += " and (created_at < ? or (created_at = ? and message_id < ?)) order by created_at desc, message_id desc"
+		args = append(args, before.createdAt, before.createdAt, before.messageId)
+	default:
+		query += " order by created_at desc, message_id desc"
+	}
+	query += " limit ?"
+	args = append(args, limit)
+	return queryMessages(db, query, args...)
+}
+
+func (s *mysqlStore) Undelivered(channelId, userId int64, from *cursor, limit int) ([]Message, error) {
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return nil, err
+	}
+	query := "select " + messageColumns + " from message where channel_id = ? and sender_id != ? and deleted_at is null"
+	args := []interface{}{channelId, userId}
+	if from != nil {
+		query += " and (created_at > ? or (created_at = ? and message_id > ?))"
+		args = append(args, from.createdAt, from.createdAt, from.messageId)
+	}
+	query += " order by created_at, message_id limit ?"
+	args = append(args, limit)
+	return queryMessages(db, query, args...)
+}
+
+// EachMessage walks every shard. A channel being moved has rows on two
+// shards, only those on the shard it is read from count.
+func (s *mysqlStore) EachMessage(fn func(Message) error) error {
+	for i, db := range s.shards.shards {
+		if err := s.eachMessageOn(i, db, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) eachMessageOn(shard int, db *sql.DB, fn func(Message) error) error {
+	rows, err := db.Query("select " + messageColumns + " from message where deleted_at is null")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		p, err := s.shards.place(m.ChannelID)
+		if err != nil {
+			return err
+		}
+		if p.shard != shard {
+			continue
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *mysqlStore) AddReply(channelId, parentId int64, at time.Time) error {
+	_, err := s.exec(channelId, "update message set reply_count = reply_count + 1, last_reply_at = ? where message_id = ?", at, parentId)
+	return err
+}
+
+func (s *mysqlStore) EditMessage(channelId, messageId int64, msg string, at time.Time) error {
+	editId, err := s.shards.nextID()
+	if err != nil {
+		return err
+	}
+	dbs, err := s.shards.writers(channelId)
+	if err != nil {
+		return err
+	}
+	if err := editOn(dbs[0], editId, messageId, msg, at); err != nil {
+		return err
+	}
+	for _, db := range dbs[1:] {
+		if err := editOn(db, editId, messageId, msg, at); err != nil {
+			return fmt.Errorf("dual write for channel %d: %w", channelId, err)
+		}
+	}
+	return nil
+}
+
+// editOn keeps the old text in message_edit and replaces it, in one
+// transaction on db.
+func editOn(db *sql.DB, editId, messageId int64, msg string, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into message_edit (edit_id,message_id,old_msg,edited_at) select ?, message_id, msg, ? from message where message_id = ?", seqID(editId), at, messageId)
+	if err == nil {
+		_, err = tx.Exec("update message set msg = ?, edited_at = ? where message_id = ?", msg, at, messageId)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlStore) DeleteMessage(channelId, messageId int64, at time.Time) error {
+	_, err := s.exec(channelId, "update message set deleted_at = ? where message_id = ?", at, messageId)
+	return err
+}
+
+func (s *mysqlStore) Edits(channelId, messageId int64) ([]MessageEdit, error) {
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select edit_id, message_id, old_msg, edited_at from message_edit where message_id = ? order by edit_id", messageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	edits := make([]MessageEdit, 0)
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.EditID, &e.MessageID, &e.OldMsg, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// ToggleReaction decides on the channel's shard whether the reaction goes
+// or comes, and makes the other side of a move follow that decision.
+func (s *mysqlStore) ToggleReaction(channelId, messageId, userId int64, emoji string, at time.Time) error {
+	dbs, err := s.shards.writers(channelId)
+	if err != nil {
+		return err
+	}
+	query, args := "delete from reaction where message_id = ? and user_id = ? and emoji = ?", []interface{}{messageId, userId, emoji}
+	result, err := dbs[0].Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		query, args = "insert ignore into reaction (message_id,user_id,emoji,created_at) values (?,?,?,?)", []interface{}{messageId, userId, emoji, at}
+		if _, err := dbs[0].Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	for _, db := range dbs[1:] {
+		if _, err := db.Exec(query, args...); err != nil {
+			return fmt.Errorf("dual write for channel %d: %w", channelId, err)
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) Reactions(channelId int64, messageIds []int64) (map[int64][]Reaction, error) {
+	out := make(map[int64][]Reaction)
+	if len(messageIds) == 0 {
+		return out, nil
+	}
+	db, err := s.shards.reader(channelId)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(messageIds))
+	for i, id := range messageIds {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIds)), ",")
+	rows, err := db.Query("select message_id, emoji, user_id from reaction where message_id in ("+placeholders+") order by created_at, user_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageId, userId int64
+		var emoji string
+		if err := rows.Scan(&messageId, &emoji, &userId); err != nil {
+			return nil, err
+		}
+		out[messageId] = addReaction(out[messageId], emoji, userId)
+	}
+	return out, rows.Err()
+}
+
+// addReaction counts one more userId on emoji in reactions.
+func addReaction(reactions []Reaction, emoji string, userId int64) []Reaction {
+	i := 0
+	for i < len(reactions) && reactions[i].Emoji != emoji {
+		i++
+	}
+	if i == len(reactions) {
+		reactions = append(reactions, Reaction{Emoji: emoji})
+	}
+	reactions[i].Count++
+	reactions[i].UserIDs = append(reactions[i].UserIDs, userId)
+	return reactions
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ThreadContext travels with a "realtime" emit: which message it is and,
+// for a reply, the thread it belongs to with the updated counters.
+type ThreadContext struct {
+	ChannelID   int64      `json:"channel_id"`
+	MessageID   int64      `json:"message_id"`
+	ParentID    int64      `json:"parent_id,omitempty"`
+	ReplyCount  int        `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+}
+
+// Thread is a parent message with one page of its replies.
+type Thread struct {
+	Parent  Message     `json:"parent"`
+	Replies MessagePage `json:"replies"`
+}
+
+// checkThreadParent makes sure a reply goes to a top level message of the
+// same channel; threads are one level deep.
+func checkThreadParent(parentId, channelId int64) error {
+	parent, err := store.Message(channelId, parentId)
+	if errors.Is(err, errNotFound) {
+		return errors.New("parent message not found in this channel")
+	}
+	if err != nil {
+		return err
+	}
+	if parent.ParentID != nil {
+		return errors.New("cannot reply to a reply")
+	}
+	if parent.DeletedAt != nil {
+		return errors.New("cannot reply to a deleted message")
+	}
+	return nil
+}
+
+// addReply bumps the counters of the parent after replyId was stored.
+func addReply(channelId, parentId, replyId int64, at time.Time) (*ThreadContext, error) {
+	if err := store.AddReply(channelId, parentId, at); err != nil {
+		return nil, err
+	}
+	parent, err := store.Message(channelId, parentId)
+	if err != nil {
+		return nil, err
+	}
+	return &ThreadContext{
+		ChannelID:   parent.ChannelID,
+		MessageID:   replyId,
+		ParentID:    parentId,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	}, nil
+}
+
+// getThread serves GET /channels/{channelId}/messages/{messageId}/thread
+// with the same paging parameters as the channel history.
+func getThread(w http.ResponseWriter, r *http.Request) {
+	channelId, err := pathID(r, "channelId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messageId, err := pathID(r, "messageId")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, before, after, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !canRead(w, r, channelId) {
+		return
+	}
+	parent, err := store.Message(channelId, messageId)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error while fetch message, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	reactions, err := store.Reactions(channelId, []int64{parent.MessageID})
+	if err != nil {
+		fmt.Println("error while fetch reactions, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	parent.Reactions = reactions[parent.MessageID]
+	replies, err := fetchMessagePage(channelId, messageId, before, after, limit)
+	if err != nil {
+		fmt.Println("error while fetch thread, err =  ", err)
+		http.Error(w, "fetch try again", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, Thread{Parent: parent, Replies: replies})
+}